@@ -1,11 +1,82 @@
 package main
 
 import (
+	"bufio"
 	"crazydocker/pkg/api"
+	"crazydocker/pkg/auth"
+	"crazydocker/pkg/config"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 )
 
+// hashPassword prints the users file line of the user, the password is read
+// from stdin so that it does not end up in the shell history
+func hashPassword(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s hash-password <username>", os.Args[0])
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	line, err := auth.HashPassword(args[0], strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(line)
+	return nil
+}
+
+// rotateMasterKey encrypts the secrets of the config with the key in the
+// given file, a new key is generated when the file does not exist. The
+// current key is read from the environment like the server does.
+func rotateMasterKey(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s rotate-master-key <new key file>", os.Args[0])
+	}
+	oldKey, err := config.LoadMasterKey()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(args[0]); errors.Is(err, os.ErrNotExist) {
+		encoded, err := config.GenerateMasterKey()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(args[0], []byte(encoded+"\n"), 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "generated a new master key in %s\n", args[0])
+	}
+	newKey, err := config.ReadMasterKeyFile(args[0])
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("%s/config.yaml", os.Getenv("CONFIG_FOLDER"))
+	if err := config.RotateMasterKey(path, oldKey, newKey); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "secrets of %s are encrypted with the new key, restart the server with MASTER_KEY_FILE=%s\n", path, args[0])
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		if err := hashPassword(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-master-key" {
+		if err := rotateMasterKey(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	if err := api.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -9,6 +9,8 @@ import MachineExec from "./components/MachineExec";
 import ContainerExec from "./components/ContainerExec";
 import ContainerLog from "./components/ContainerLog";
 import Config from "./components/Config";
+import Login from "./components/Login";
+import Approvals from "./components/Approvals";
 import IconButton from '@mui/material/IconButton';
 import CloseIcon from '@mui/icons-material/Close';
 
@@ -38,6 +40,8 @@ export default function App() {
           <Route path="/container/exec" element={<ContainerExec />} />
           <Route path="/container/log" element={<ContainerLog />} />
           <Route path="/config" element={<Config />} />
+          <Route path="/login" element={<Login />} />
+          <Route path="/approvals" element={<Approvals />} />
         </Routes>
       </SnackbarProvider >
     </div>
@@ -0,0 +1,61 @@
+// REACT_APP_API_SERVER_TLS=true talks to an api server serving https
+const secure = process.env.REACT_APP_API_SERVER_TLS === 'true';
+const apiURL = `${secure ? 'https' : 'http'}://${process.env.REACT_APP_API_SERVER_URL}`;
+const csrfKey = 'csrfToken';
+const unsafeMethods = ['POST', 'PUT', 'PATCH', 'DELETE'];
+
+// wsURL returns the websocket url of the api path
+export function wsURL(path) {
+  return `${secure ? 'wss' : 'ws'}://${process.env.REACT_APP_API_SERVER_URL}${path}`;
+}
+
+// oidcLoginURL returns the url starting the single sign-on, the browser comes
+// back to next once signed in
+export function oidcLoginURL(next) {
+  return `${apiURL}/oidc/login?next=${encodeURIComponent(next)}`;
+}
+
+// setCSRFToken keeps the csrf token of the session returned by /login and /me
+export function setCSRFToken(token) {
+  if (token) {
+    sessionStorage.setItem(csrfKey, token);
+  } else {
+    sessionStorage.removeItem(csrfKey);
+  }
+}
+
+// csrfToken returns the csrf token of the session, it is asked from /me when
+// the tab did not log in itself
+function csrfToken() {
+  const token = sessionStorage.getItem(csrfKey);
+  if (token) {
+    return Promise.resolve(token);
+  }
+  return fetch(`${apiURL}/me`, { credentials: 'include' })
+    .then(response => response.ok ? response.json() : {})
+    .then(data => {
+      setCSRFToken(data.CSRFToken);
+      return data.CSRFToken;
+    });
+}
+
+// apiFetch calls the api server with the session cookie, the login page is
+// opened when the session is missing or expired. Requests changing something
+// carry the csrf token of the session.
+export function apiFetch(path, options = {}) {
+  const method = (options.method || 'GET').toUpperCase();
+  const token = unsafeMethods.includes(method) && path !== '/login' ? csrfToken() : Promise.resolve(null);
+  return token
+    .then(token => fetch(`${apiURL}${path}`, {
+      ...options,
+      headers: token ? { ...options.headers, 'X-CSRF-Token': token } : options.headers,
+      credentials: 'include'
+    }))
+    .then(response => {
+      if (response.status === 401 && window.location.pathname !== '/login') {
+        setCSRFToken(null);
+        window.location.assign(`/login?next=${encodeURIComponent(window.location.pathname + window.location.search)}`);
+      }
+      return response;
+    });
+}
@@ -0,0 +1,122 @@
+import React, { useState, useEffect, useCallback } from 'react';
+import { AgGridReact } from 'ag-grid-react';
+import { enqueueSnackbar } from 'notistack'
+import IconButton from '@mui/material/IconButton';
+import Tooltip from '@mui/material/Tooltip';
+import { FaCheck, FaTimes } from 'react-icons/fa';
+import 'ag-grid-community/styles/ag-grid.css';
+import 'ag-grid-community/styles/ag-theme-quartz.css';
+import NavBar from './NavBar'
+import './styles/GridTheme.css';
+import { apiFetch } from '../api';
+
+// what the request runs, the container or the image and args of a create
+const target = (params) => {
+  const data = params.data
+  if (data.Image) {
+    return `${data.Args || ''} ${data.Image}`.trim()
+  }
+  return data.Container || ''
+}
+
+export default function Approvals() {
+  const [rows, setRows] = useState([]);
+
+  const load = useCallback(() => {
+    apiFetch(`/approvals`)
+      .then(response => response.json())
+      .then(data => {
+        if (data.Error) {
+          enqueueSnackbar(data.Error, { variant: "error" })
+          setRows([])
+        } else {
+          setRows(data.Approvals)
+        }
+      })
+      .catch(error => {
+        console.error(error)
+        setRows([])
+        enqueueSnackbar("something went wrong while connecting to api server", { variant: "error" })
+      });
+  }, []);
+
+  useEffect(() => {
+    load()
+    // pending requests expire and get decided by others, keep the list fresh
+    const timer = setInterval(load, 10000)
+    return () => clearInterval(timer)
+  }, [load]);
+
+  const decide = (id, decision) => {
+    apiFetch(`/approvals/${id}/${decision}`, { method: 'POST' })
+      .then(response => response.json())
+      .then(data => {
+        if (data.Error) {
+          enqueueSnackbar(data.Error, { variant: "error" })
+        } else {
+          enqueueSnackbar(`request ${id} ${data.Approval.Status}`, { variant: "success" })
+        }
+        load()
+      })
+      .catch(error => {
+        console.error(error)
+        enqueueSnackbar("something went wrong while connecting to api server", { variant: "error" })
+      });
+  }
+
+  const decisionButtons = (params) => {
+    if (params.data.Status !== 'pending') {
+      return ''
+    }
+    return (
+      <span>
+        <Tooltip title="Approve" arrow>
+          <IconButton onClick={() => decide(params.data.ID, 'approve')} style={{ borderRadius: '4px' }}>
+            <FaCheck style={{ color: 'green', fontSize: '16px' }} />
+          </IconButton>
+        </Tooltip>
+        <Tooltip title="Reject" arrow>
+          <IconButton onClick={() => decide(params.data.ID, 'reject')} style={{ borderRadius: '4px' }}>
+            <FaTimes style={{ color: 'red', fontSize: '16px' }} />
+          </IconButton>
+        </Tooltip>
+      </span>
+    )
+  }
+
+  const gridOptions = {
+    autoSizeStrategy: { type: 'fitGridWidth' },
+    resizable: true,
+    sortable: true,
+    wrapText: true,
+    autoHeight: true,
+    pagination: true,
+    suppressRowClickSelection: true,
+  };
+
+  return (
+    <div>
+      <NavBar linkMap={[{ link: "/", name: "Machines" }, { link: `/config`, name: "Config" }]} />
+      <h2 style={{ textAlign: 'center', margin: '20px 0' }}>Approvals</h2>
+      <div className="ag-theme-quartz" style={{ height: '80vh' }}>
+        <AgGridReact
+          gridOptions={gridOptions}
+          columnDefs={[
+            { headerName: 'Id', field: 'ID', filter: 'agTextColumnFilter' },
+            { headerName: 'Operation', field: 'Name', filter: 'agTextColumnFilter' },
+            { headerName: 'Host', field: 'Host', tooltipField: 'Host', filter: 'agTextColumnFilter' },
+            { headerName: 'Target', valueGetter: target, filter: 'agTextColumnFilter' },
+            { headerName: 'Requester', field: 'Requester', filter: 'agTextColumnFilter' },
+            { headerName: 'Approver Role', field: 'ApproverRole', filter: 'agTextColumnFilter' },
+            { headerName: 'Status', field: 'Status', filter: 'agTextColumnFilter' },
+            { headerName: 'Approver', field: 'Approver', filter: 'agTextColumnFilter' },
+            { headerName: 'Expires', field: 'Expires', sortable: true },
+            { headerName: 'Error', field: 'Error', tooltipField: 'Error', filter: 'agTextColumnFilter' },
+            { headerName: 'Decide', field: 'Decide', cellRenderer: decisionButtons },
+          ]}
+          rowData={rows}
+        ></AgGridReact>
+      </div>
+    </div>
+  );
+}
@@ -11,6 +11,7 @@ import PublishIcon from '@mui/icons-material/Publish';
 import Tooltip from '@mui/material/Tooltip';
 import ComputerIcon from '@mui/icons-material/Computer';
 import TextField from '@mui/material/TextField';
+import { apiFetch } from "../api";
 
 // Import YAML mode correctly
 import { yaml as yamlMode } from "@codemirror/legacy-modes/mode/yaml";
@@ -48,7 +49,7 @@ export default function Config() {
     // Fetch the config data on component mount
     useEffect(() => {
         setButtonDisabled(true);
-        fetch(`http://${process.env.REACT_APP_API_SERVER_URL}/config`)
+        apiFetch(`/config`)
             .then(resp => resp.json())
             .then(data => {
                 setConfig(data.Data);
@@ -67,10 +68,10 @@ export default function Config() {
     }, []);
 
     // Handle button press actions
-    const handleButtonPress = (event, url, action, payload) => {
+    const handleButtonPress = (event, method, url, action, payload) => {
         setButtonDisabled(true);
-        fetch(url, {
-            method: 'POST',
+        apiFetch(url, {
+            method: method,
             headers: {
                 'Accept': 'application/json',
                 'Content-Type': 'application/json'
@@ -93,14 +94,15 @@ export default function Config() {
             });
     };
 
-    // Handle config update
+    // Handle config update, the secrets are redacted and left as they are
+    // unless they were changed
     const handleUpdateConfig = (event) => {
-        handleButtonPress(event, `http://${process.env.REACT_APP_API_SERVER_URL}/config/update`, "updated", config);
+        handleButtonPress(event, 'PUT', `/config`, "updated", config);
     };
 
     // Handle config reload
     const handleReloadConfig = (event) => {
-        handleButtonPress(event, `http://${process.env.REACT_APP_API_SERVER_URL}/config/reload`, "reloaded", "");
+        handleButtonPress(event, 'POST', `/config/reload`, "reloaded", "");
     };
 
     return (
@@ -115,6 +117,26 @@ export default function Config() {
                 maxRows={Infinity}
                 defaultValue={`# Private key file is always relative to the config folder env variable
 # No comments allowed in the actual config file          
+# access:
+#   - user: admin
+#     role: admin
+#   - group: ops
+#     role: operator
+#   - user: oidc:248289761001
+#     role: viewer
+# oidc:
+#   issuer: https://idp.example.com
+#   clientID: dockerfrenzy
+#   clientSecret: env:OIDC_CLIENT_SECRET
+#   redirectURL: http://localhost:8080/oidc/callback
+# approval:
+#   ttl: 1h
+#   rules:
+#     - hosts: [10.0.0.1]
+#       operations: [container.rm, container.kill, container.create, machine.exec]
+# recording:
+#   enabled: true
+#   retention: 720h
 # configList:
 #   - sshConfig:
 #       passwordAuth:
@@ -128,6 +150,27 @@ export default function Config() {
 #         PrivateKeyFile: password
 #       ips:
 #         - 
+#       access:
+#         - user: alice
+#           role: operator
+#       hosts:
+#         - address: 
+#           port: 2222
+#           user: root
+#           name: 
+#           connectTimeout: 10s
+#           privilegeEscalation:
+#             sudo: true
+#             sudoPassword: env:SUDO_PASSWORD
+#   - dockerConfig:
+#       endpoints:
+#         - host: unix:///var/run/docker.sock
+#           name: local
+#         - host: tcp://10.0.0.9:2376
+#           tls:
+#             caFile: ca.pem
+#             certFile: cert.pem
+#             keyFile: key.pem
                 `}
             />
             <Tooltip title="Update Config" arrow>
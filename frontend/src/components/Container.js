@@ -15,6 +15,7 @@ import {
   LaunchOutlined as ExecIcon
 } from '@mui/icons-material';
 import NavBar from './NavBar'
+import { apiFetch, wsURL } from '../api';
 
 
 function useQuery() {
@@ -41,15 +42,18 @@ export default function Container() {
     onMessage: handleMessage
   };
 
-  useWebSocket(`ws://${process.env.REACT_APP_API_SERVER_URL}/container/stream?ip=${query.get("ip")}&containerID=${query.get("containerID")}`, options);
+  useWebSocket(wsURL(`/container/stream?ip=${query.get("ip")}&containerID=${query.get("containerID")}`), options);
 
   const performAction = (action) => {
     setButtonsDisabled(true); // Disable buttons when performing action
-    fetch(`http://${process.env.REACT_APP_API_SERVER_URL}/container/action?action=${action}&ip=${query.get("ip")}&containerID=${query.get("containerID")}`)
+    apiFetch(`/container/action?action=${action}&ip=${query.get("ip")}&containerID=${query.get("containerID")}`, { method: 'POST' })
       .then(resp => resp.json())
       .then(data => {
         if (data.Error) {
           enqueueSnackbar("something went wrong while connecting to api server", { variant: "error" })
+        } else if (data.Approval) {
+          // the action runs once another user approves it
+          enqueueSnackbar(`container ${action} waits for the approval of a user with the ${data.Approval.ApproverRole} role, request ${data.Approval.ID}`, { variant: "info" })
         } else {
           enqueueSnackbar(`container ${action}ed successfully`, { variant: "success" })
         }
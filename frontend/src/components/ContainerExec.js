@@ -1,5 +1,6 @@
 import React from 'react';
 import Exec from './Exec'
+import { wsURL } from '../api';
 import { useLocation } from 'react-router-dom';
 
 function useQuery() {
@@ -10,6 +11,6 @@ function useQuery() {
 export default function ContainerExec() {
     const query = useQuery();
     return (
-        <Exec url={`ws://${process.env.REACT_APP_API_SERVER_URL}/container/exec?ip=${query.get("ip")}&containerID=${query.get("containerID")}`} readOnly={false} />
+        <Exec url={wsURL(`/container/exec?ip=${query.get("ip")}&containerID=${query.get("containerID")}`)} readOnly={false} />
     )
 }
\ No newline at end of file
@@ -1,6 +1,7 @@
 import React, { useState } from 'react';
 import { useLocation } from 'react-router-dom';
 import './styles/CreateContainer.css'
+import { apiFetch } from '../api';
 
 function useQuery() {
   const { search } = useLocation();
@@ -11,6 +12,12 @@ const Response = (props) => {
   const query = useQuery();
   if (props.Error !== "") {
     return <p className="response_error">{props.Msg}</p>;
+  } else if (props.Approval) {
+    return (
+      <p className="response_success">
+        The container is created once a user with the {props.Approval.ApproverRole} role approves <a href="/approvals" target="_blank">request {props.Approval.ID}</a>
+      </p>
+    );
   } else {
     return (
       <p className="response_success">
@@ -32,7 +39,7 @@ const Modal = (props) => {
     if (command.trim() === '') {
       setResponse('Please enter args.');
     } else {
-      let response = await fetch(`http://${process.env.REACT_APP_API_SERVER_URL}/container/create`, {
+      let response = await apiFetch(`/container/create`, {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
@@ -56,7 +63,7 @@ const Modal = (props) => {
           value={command}
           onChange={(e) => setCommand(e.target.value)}
         /><br />
-        {response && <Response Msg={response.Msg} Error={response.Error} />}
+        {response && <Response Msg={response.Msg} Error={response.Error} Approval={response.Approval} />}
         <button className="close-btn" onClick={handleCloseModal}>
            Close
         </button>
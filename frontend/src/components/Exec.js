@@ -12,7 +12,9 @@ export default function Exec(props) {
             term.loadAddon(fitAddon);
             term.open(document.getElementById('terminal'));
             fitAddon.fit()
-            var socket = new WebSocket(props.url)
+            // the initial size is sent with the url, later changes as resize control messages
+            const separator = props.url.includes("?") ? "&" : "?"
+            var socket = new WebSocket(`${props.url}${separator}cols=${term.cols}&rows=${term.rows}`)
             socket.addEventListener("message", async (event) => {
                 if (event.data.constructor.name === 'Blob') {
                     term.write(await event.data.text())
@@ -20,12 +22,20 @@ export default function Exec(props) {
                     term.write(event.data)
                 }
             })
+            term.onResize(({ cols, rows }) => {
+                if (socket.readyState === WebSocket.OPEN) {
+                    socket.send(JSON.stringify({ type: "resize", cols: cols, rows: rows }))
+                }
+            })
+            window.addEventListener("resize", () => fitAddon.fit())
             if (!props.readOnly) {
-                term.onData((data) => socket.send(data))
+                // keystrokes are sent as binary frames, text frames are reserved for control messages
+                const encoder = new TextEncoder()
+                term.onData((data) => socket.send(encoder.encode(data)))
             }
         }
     }, [])
     return (
         <div id="terminal" style={{ width: "100vw", height: "100vh" }}></div>
     )
-}
\ No newline at end of file
+}
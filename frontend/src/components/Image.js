@@ -10,6 +10,7 @@ import {
   LaunchOutlined as CreateContainerIcon
 } from '@mui/icons-material';
 import NavBar from './NavBar';
+import { wsURL } from '../api';
 import CreateContainer from './CreateContainer'
 
 function useQuery() {
@@ -43,7 +44,7 @@ export default function Container() {
     onMessage: handleMessage
   };
 
-  useWebSocket(`ws://${process.env.REACT_APP_API_SERVER_URL}/image/stream?ip=${query.get("ip")}&imageID=${query.get("imageID")}`, options);
+  useWebSocket(wsURL(`/image/stream?ip=${query.get("ip")}&imageID=${query.get("imageID")}`), options);
 
   const handleCreateContainer = () => {
     setModalOpen(true);
@@ -0,0 +1,82 @@
+import React, { useState, useEffect } from 'react';
+import { useLocation, useNavigate } from 'react-router-dom';
+import { enqueueSnackbar } from 'notistack'
+import TextField from '@mui/material/TextField';
+import { apiFetch, oidcLoginURL, setCSRFToken } from '../api';
+
+function useQuery() {
+  const { search } = useLocation();
+  return React.useMemo(() => new URLSearchParams(search), [search]);
+}
+
+export default function Login() {
+  const navigate = useNavigate();
+  const query = useQuery();
+  const [username, setUsername] = useState("");
+  const [password, setPassword] = useState("");
+  const [buttonDisabled, setButtonDisabled] = useState(false);
+  const [oidcEnabled, setOIDCEnabled] = useState(false);
+
+  useEffect(() => {
+    apiFetch(`/login/options`)
+      .then(resp => resp.json())
+      .then(data => setOIDCEnabled(data.OIDC))
+      .catch(error => console.error(error));
+  }, []);
+
+  // only follow paths of the frontend itself
+  const nextPath = () => {
+    const next = query.get("next");
+    return next && next.startsWith("/") && !next.startsWith("//") ? next : "/";
+  };
+
+  const handleSSO = () => {
+    window.location.assign(oidcLoginURL(window.location.origin + nextPath()));
+  };
+
+  const handleLogin = (event) => {
+    event.preventDefault();
+    setButtonDisabled(true);
+    apiFetch(`/login`, {
+      method: 'POST',
+      headers: {
+        'Accept': 'application/json',
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify({ username: username, password: password })
+    })
+      .then(resp => resp.json())
+      .then(data => {
+        setButtonDisabled(false);
+        if (data.Error) {
+          enqueueSnackbar(data.Error, { variant: "error" });
+          return;
+        }
+        setCSRFToken(data.CSRFToken);
+        navigate(nextPath());
+      })
+      .catch(error => {
+        console.error(error);
+        enqueueSnackbar("Something went wrong while connecting to API server", { variant: "error" });
+        setButtonDisabled(false);
+      });
+  };
+
+  return (
+    <div style={{ display: 'flex', justifyContent: 'center', marginTop: '15vh' }}>
+      <form onSubmit={handleLogin} style={{ display: 'flex', flexDirection: 'column', gap: '15px', width: '300px' }}>
+        <h2 style={{ textAlign: 'center' }}>Login</h2>
+        <TextField label="Username" autoComplete="username" value={username} onChange={(e) => setUsername(e.target.value)} />
+        <TextField label="Password" type="password" autoComplete="current-password" value={password} onChange={(e) => setPassword(e.target.value)} />
+        <button type="submit" disabled={buttonDisabled} style={{ backgroundColor: '#007bff', color: '#fff', border: 'none', borderRadius: '8px', padding: '10px 20px', cursor: 'pointer' }}>
+          Login
+        </button>
+        {oidcEnabled &&
+          <button type="button" onClick={handleSSO} style={{ backgroundColor: '#fff', color: '#007bff', border: '1px solid #007bff', borderRadius: '8px', padding: '10px 20px', cursor: 'pointer' }}>
+            Sign in with SSO
+          </button>
+        }
+      </form>
+    </div>
+  );
+}
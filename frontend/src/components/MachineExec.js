@@ -1,6 +1,7 @@
 import React from 'react';
 import { useLocation } from 'react-router-dom';
 import Exec from './Exec'
+import { wsURL } from '../api';
 
 
 function useQuery() {
@@ -11,6 +12,6 @@ function useQuery() {
 export default function MachineExec() {
     const query = useQuery();
     return (
-        <Exec url={`ws://${process.env.REACT_APP_API_SERVER_URL}/machine/exec?ip=${query.get("ip")}`} readOnly={false} />
+        <Exec url={wsURL(`/machine/exec?ip=${query.get("ip")}`)} readOnly={false} />
     )
 }
\ No newline at end of file
@@ -8,6 +8,7 @@ import './styles/GridTheme.css';
 import { FaUndo } from 'react-icons/fa';
 import NavBar from './NavBar'
 import { enqueueSnackbar } from 'notistack';
+import { apiFetch } from '../api';
 
 function useQuery() {
   const { search } = useLocation();
@@ -51,7 +52,7 @@ export default function MachineInfo() {
 
   const onContainerGridReady = useCallback((params) => {
     setContainerGridApi(params.api)
-    fetch(`http://${process.env.REACT_APP_API_SERVER_URL}/containers?ip=${query.get("ip")}`)
+    apiFetch(`/containers?ip=${query.get("ip")}`)
       .then(resp => resp.json())
       .then(data => {
         if (data.Error) {
@@ -70,7 +71,7 @@ export default function MachineInfo() {
 
   const onImageGridReady = useCallback((params) => {
     setImageGridApi(params.api)
-    fetch(`http://${process.env.REACT_APP_API_SERVER_URL}/images?ip=${query.get("ip")}`)
+    apiFetch(`/images?ip=${query.get("ip")}`)
       .then(resp => resp.json())
       .then(data => {
         if (data.Error) {
@@ -11,6 +11,7 @@ import { FaCheck, FaTimes, FaUndo } from 'react-icons/fa';
 import NavBar from './NavBar'
 import './styles/GridTheme.css';
 import './styles/ErrorModal.css'
+import { apiFetch } from '../api';
 
 const sshIntoMachine = () => {
   return (<Tooltip title="Exec Into Machine" arrow>
@@ -49,7 +50,7 @@ export default function Machines() {
   const [showModal, setShowModal] = useState(false);
 
   useEffect(() => {
-    fetch(`http://${process.env.REACT_APP_API_SERVER_URL}/machines`)
+    apiFetch(`/machines`)
       .then(response => response.json())
       .then(data => {
         if (data.error !== "") {
@@ -80,9 +81,9 @@ export default function Machines() {
       setShowModal(true); // Show modal if machine is offline
     } else if (row.event.defaultPrevented) {
       // then we navigate to machine exec
-      window.open(`/machine/exec?ip=${row.data.Ip}`, '_blank');
+      window.open(`/machine/exec?ip=${encodeURIComponent(row.data.Ip)}`, '_blank');
     } else {
-      navigate(`/machine?ip=${row.data.Ip}`);
+      navigate(`/machine?ip=${encodeURIComponent(row.data.Ip)}`);
     }
   };
 
@@ -140,9 +141,11 @@ export default function Machines() {
         <AgGridReact
           gridOptions={gridOptions}
           columnDefs={[
+            { headerName: 'Name', field: 'Name', filter: 'agTextColumnFilter', sortable: true },
             { headerName: 'HostName', field: 'HostName', filter: 'agTextColumnFilter', sortable: true },
             { headerName: 'Ip', tooltipField: 'Ip', field: 'Ip', filter: 'agTextColumnFilter', sortable: true },
             { headerName: 'Os', field: 'Os', filter: 'agTextColumnFilter', sortable: true },
+            { headerName: 'Docker', field: 'DockerAccess', filter: 'agTextColumnFilter', sortable: true },
             { headerName: 'Status', field: 'Status', cellRenderer: getStatusIcon, filter: 'agSetColumnFilter', filterParams: statusFilterParams, sortable: true },
             { headerName: 'Error', field: 'Error', tooltipField: 'Error', filter: 'agTextColumnFilter', sortable: true },
             { headerName: "ssh", field: "SSH into machine", cellRenderer: sshIntoMachine },
@@ -1,5 +1,14 @@
 import React from 'react';
+import { apiFetch, setCSRFToken } from '../api';
 
+const logout = (event) => {
+  event.preventDefault()
+  apiFetch(`/logout`, { method: 'POST' })
+    .finally(() => {
+      setCSRFToken(null)
+      window.location.assign('/login')
+    })
+}
 
 export default function NavBar(props) {
   let linksArray = []
@@ -14,7 +23,13 @@ export default function NavBar(props) {
     <nav style={{ backgroundColor: '#333', padding: '10px', marginBottom: '20px' }}>
       <ul style={{ listStyleType: 'none', margin: 0, padding: 0 }}>
         {linksArray}
+        <li key="logout" style={{ display: 'inline', float: 'right' }}>
+          <a href="/login" onClick={logout} style={{ color: '#fff', textDecoration: 'none' }}>Logout</a>
+        </li>
+        <li key="approvals" style={{ display: 'inline', float: 'right', marginRight: '20px' }}>
+          <a href="/approvals" style={{ color: '#fff', textDecoration: 'none' }}>Approvals</a>
+        </li>
       </ul>
     </nav>
   )
-}
\ No newline at end of file
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"crazydocker/pkg/approval"
+	"crazydocker/pkg/audit"
+	"crazydocker/pkg/config"
+	"crazydocker/pkg/rbac"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const notifyTimeout = 10 * time.Second
+
+// sessions waiting for an approval are pinged this often, the wait ends
+// when the browser is gone
+const approvalPingInterval = 15 * time.Second
+
+var approvals *approval.Store
+
+// requestApproval parks the operation when the approval policy asks for it,
+// required is false when it can run right away
+func requestApproval(c *gin.Context, op approval.Operation) (req approval.Request, required bool, err error) {
+	required, approverRole := ce.ApprovalRequired(op.Host, op.Name)
+	if !required {
+		return approval.Request{}, false, nil
+	}
+	token := ""
+	if t := requestToken(c); t != nil {
+		token = t.ID
+	}
+	req, err = approvals.Create(op, currentUser(c), token, approverRole, ce.Approval().TTL)
+	if err != nil {
+		return approval.Request{}, true, err
+	}
+	if event := auditEvent(c); event != nil {
+		event.Approval = req.ID
+	}
+	notifyApprovers(req)
+	return req, true, nil
+}
+
+// notifyApprovers logs the request and posts it to the webhook of the policy
+func notifyApprovers(req approval.Request) {
+	log.Println(req.Summary())
+	webhook, err := config.ResolveSecret(ce.Approval().Webhook)
+	if err != nil {
+		log.Printf("unable to read the approval webhook :%s\n", err)
+		return
+	}
+	if webhook == "" {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := approval.Notify(ctx, webhook, req); err != nil {
+			log.Printf("unable to notify the approvers of %s :%s\n", req.ID, err)
+		}
+	}()
+}
+
+// parkOperation answers 202 with the approval request of an operation which
+// has to be approved first
+func parkOperation(c *gin.Context, op approval.Operation) {
+	req, _, err := requestApproval(c, op)
+	if err != nil {
+		c.Error(err)
+		c.JSON(500, &ApprovalResponse{Response: Response{Error: err.Error()}})
+		return
+	}
+	c.JSON(202, &ApprovalResponse{Approval: &req})
+}
+
+// awaitApproval holds an exec session back until its request is decided,
+// the terminal shows what it waits for. It returns false when the session
+// must not start, the connection is closed then.
+func awaitApproval(c *gin.Context, conn *websocket.Conn, op approval.Operation) bool {
+	req, required, err := requestApproval(c, op)
+	if !required {
+		return true
+	}
+	if err != nil {
+		sessionEnded(c, audit.OutcomeFailure, err)
+		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()+"\r\n"))
+		conn.Close()
+		return false
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("waiting until %s for a user with the %s role to approve request %s\r\n",
+		req.Expires.Format("15:04:05 MST"), req.ApproverRole, req.ID)))
+	for {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), approvalPingInterval)
+		decided, err := approvals.Wait(ctx, req.ID)
+		cancel()
+		if err == nil {
+			req = decided
+			break
+		}
+		if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+			// the browser went away, nobody is left to use the session
+			approvals.Reject(req.ID, req.Requester)
+			sessionEnded(c, audit.OutcomeFailure, errors.New("the session closed while waiting for the approval"))
+			conn.Close()
+			return false
+		}
+	}
+	if event := auditEvent(c); event != nil {
+		event.Approver = req.Approver
+	}
+	if req.Status != approval.StatusApproved {
+		sessionEnded(c, audit.OutcomeDenied, fmt.Errorf("the approval request was %s", req.Status))
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("request %s was %s\r\n", req.ID, req.Status)))
+		conn.Close()
+		return false
+	}
+	if err := requesterAllowed(req); err != nil {
+		approvals.SetError(req.ID, err)
+		sessionEnded(c, audit.OutcomeDenied, err)
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("request %s was approved but %s\r\n", req.ID, err)))
+		conn.Close()
+		return false
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("request %s was approved by %s\r\n", req.ID, req.Approver)))
+	return true
+}
+
+// visibleApproval returns the request of the id param when the user made it
+// or can decide it, it answers 404 otherwise
+func visibleApproval(c *gin.Context) (approval.Request, bool) {
+	req, err := approvals.Get(c.Param("id"))
+	if err == nil && (req.Requester == currentUser(c).Username || role(c, req.Host).Allows(req.ApproverRole)) {
+		return req, true
+	}
+	if err == nil {
+		err = approval.ErrNotFound
+	}
+	c.JSON(404, &ApprovalResponse{Response: Response{Error: err.Error()}})
+	return approval.Request{}, false
+}
+
+// listApprovals returns the requests the user made or can decide, the
+// newest first, status filters them
+func listApprovals(c *gin.Context) {
+	status := c.Request.URL.Query().Get("status")
+	username := currentUser(c).Username
+	found := []approval.Request{}
+	for _, req := range approvals.List() {
+		if status != "" && string(req.Status) != status {
+			continue
+		}
+		if req.Requester != username && !role(c, req.Host).Allows(req.ApproverRole) {
+			continue
+		}
+		found = append(found, req)
+	}
+	c.JSON(200, &ApprovalListResponse{Approvals: found})
+}
+
+func getApproval(c *gin.Context) {
+	if req, ok := visibleApproval(c); ok {
+		c.JSON(200, &ApprovalResponse{Approval: &req})
+	}
+}
+
+// decisionEvent adds the request to the audit event of the approve and
+// reject routes
+func decisionEvent(c *gin.Context, req approval.Request) {
+	if event := auditEvent(c); event != nil {
+		event.Approval = req.ID
+		event.Host = req.Host
+		event.Container = req.Container
+		event.Command = req.Name
+	}
+}
+
+// decisionError answers the errors of the store
+func decisionError(c *gin.Context, req approval.Request, err error) {
+	c.Error(err)
+	status := 500
+	switch {
+	case errors.Is(err, approval.ErrNotFound):
+		status = 404
+	case errors.Is(err, approval.ErrSelfApproval):
+		status = 403
+	case errors.Is(err, approval.ErrNotPending):
+		status = 409
+	}
+	c.JSON(status, &ApprovalResponse{Approval: &req, Response: Response{Error: err.Error()}})
+}
+
+// approveRequest lets a parked operation run. Container actions and creates
+// run right away on behalf of the requester, exec sessions start in the
+// terminal of the requester.
+func approveRequest(c *gin.Context) {
+	req, ok := visibleApproval(c)
+	if !ok {
+		return
+	}
+	decisionEvent(c, req)
+	if !authorize(c, req.Host, req.ApproverRole) {
+		return
+	}
+	req, err := approvals.Approve(req.ID, currentUser(c).Username)
+	if err != nil {
+		decisionError(c, req, err)
+		return
+	}
+	if strings.HasSuffix(req.Name, ".exec") {
+		c.JSON(200, &ApprovalResponse{Approval: &req})
+		return
+	}
+	if err := requesterAllowed(req); err != nil {
+		approvals.SetError(req.ID, err)
+		req.Error = err.Error()
+		c.Error(err)
+		c.JSON(403, &ApprovalResponse{Approval: &req, Response: Response{Error: err.Error()}})
+		return
+	}
+	out, err := runApproved(c, req)
+	if err != nil {
+		approvals.SetError(req.ID, err)
+		req.Error = err.Error()
+		c.Error(err)
+		c.JSON(errorStatus(err), &ApprovalResponse{Approval: &req, Msg: out, Response: Response{Error: err.Error()}})
+		return
+	}
+	c.JSON(200, &ApprovalResponse{Approval: &req, Msg: out})
+}
+
+// requesterAllowed checks that the requester can still run the operation,
+// its api token, its sign in or its role may be gone since it asked
+func requesterAllowed(req approval.Request) error {
+	required := rbac.RoleOperator
+	if req.Name == "machine.exec" {
+		required = rbac.RoleAdmin
+	}
+	user := req.Owner
+	if req.Token != "" {
+		token, err := tokens.Get(req.Token)
+		if err != nil || token.Expired() || !token.AllowsHost(req.Host) {
+			return fmt.Errorf("the api token request %s was made with was revoked or expired", req.ID)
+		}
+		user = token.Owner()
+	}
+	if !userActive(user) {
+		return fmt.Errorf("%s can no longer use the api", req.Requester)
+	}
+	if role := ce.Role(user.Username, req.Host, user.Groups...); !role.Allows(required) {
+		return fmt.Errorf("%s no longer has the %s role on %s", req.Requester, required, req.Host)
+	}
+	return nil
+}
+
+// runApproved runs an approved container action or create, it is recorded
+// in the audit log like the request it was parked from
+func runApproved(c *gin.Context, req approval.Request) (out string, err error) {
+	event := audit.Event{
+		Time:      time.Now(),
+		User:      req.Requester,
+		ClientIP:  c.ClientIP(),
+		Host:      req.Host,
+		Container: req.Container,
+		Token:     req.Token,
+		Approval:  req.ID,
+		Approver:  req.Approver,
+	}
+	if req.Name == "container.create" {
+		event.Action = "container.create"
+		event.Command = fmt.Sprintf("run %s %s", req.Args, req.Image)
+		out, err = ce.CreateContainer(c.Request.Context(), req.Host, req.Image, req.Args)
+	} else {
+		event.Action = "container.action"
+		event.Command = strings.TrimPrefix(req.Name, "container.")
+		_, err = ce.PerformAction(c.Request.Context(), req.Host, req.Container, event.Command)
+	}
+	event.Duration = time.Since(event.Time)
+	event.Outcome, event.Status = audit.OutcomeSuccess, 200
+	if err != nil {
+		event.Outcome, event.Status, event.Error = audit.OutcomeFailure, errorStatus(err), err.Error()
+	}
+	if err := auditLog.Record(event); err != nil {
+		log.Printf("unable to write audit event :%s\n", err)
+	}
+	return out, err
+}
+
+// rejectRequest drops a parked operation, requesters can cancel their own
+// requests
+func rejectRequest(c *gin.Context) {
+	req, ok := visibleApproval(c)
+	if !ok {
+		return
+	}
+	decisionEvent(c, req)
+	username := currentUser(c).Username
+	if req.Requester != username && !authorize(c, req.Host, req.ApproverRole) {
+		return
+	}
+	req, err := approvals.Reject(req.ID, username)
+	if err != nil {
+		decisionError(c, req, err)
+		return
+	}
+	c.JSON(200, &ApprovalResponse{Approval: &req})
+}
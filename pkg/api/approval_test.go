@@ -0,0 +1,162 @@
+package api
+
+import (
+	"crazydocker/pkg/core"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// approvalConfig parks container actions until an admin approves them, carol
+// is an operator
+func approvalConfig(carolRole string) string {
+	return "approval:\n  rules:\n    - operations: [container.stop]\n" +
+		strings.Replace(hostConfig("10.1.1.1"), "access:\n", "access:\n  - user: carol\n    role: "+carolRole+"\n", 1)
+}
+
+// bearerTransport authenticates the requests with an api token
+type bearerTransport struct {
+	secret string
+}
+
+func (b *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+b.secret)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// approvalRequest is the request of a parked operation
+type approvalRequest struct {
+	Error    string
+	Approval struct {
+		ID     string
+		Status string
+		Error  string
+	}
+}
+
+// parkStop asks for the stop of the web container and returns the id of its
+// approval request
+func (s *testServer) parkStop(t *testing.T, client *http.Client) string {
+	t.Helper()
+	var parked approvalRequest
+	if status := s.call(t, client, "POST", "/container/action?ip=10.1.1.1&containerID=web&action=stop", nil, &parked); status != 202 {
+		t.Fatalf("expected the stop to wait for an approval, got %d: %s", status, parked.Error)
+	}
+	return parked.Approval.ID
+}
+
+func TestApprovedActionRunsAsRequester(t *testing.T) {
+	stop := fmt.Sprintf("docker 'stop' '%s'", core.FakeContainerID)
+	transport := core.NewOnlineFakeHost().On(stop, core.FakeContainerID+"\n", nil)
+	s := newTestServer(t, testExecutor(t, approvalConfig("operator"), transport))
+	id := s.parkStop(t, s.login(t, "carol"))
+	var approved approvalRequest
+	if status := s.call(t, s.login(t, "admin"), "POST", "/approvals/"+id+"/approve", nil, &approved); status != 200 {
+		t.Fatalf("expected the stop to run, got %d: %s", status, approved.Error)
+	}
+	if commands := transport.Commands(); commands[len(commands)-1] != stop {
+		t.Fatalf("expected %q to run, got %v", stop, commands)
+	}
+	if event := s.waitEvent(t, "container.action"); event.User != "carol" || event.Approver != "admin" {
+		t.Fatalf("expected the stop to be audited for carol, got %+v", event)
+	}
+}
+
+func TestApprovedActionRechecksRequester(t *testing.T) {
+	tests := []struct {
+		name string
+		// change runs between the request and its approval
+		change func(t *testing.T, s *testServer, ce *core.CommandExecutor, tokenID string)
+		token  bool
+		err    string
+	}{
+		{
+			name: "role removed",
+			change: func(t *testing.T, s *testServer, ce *core.CommandExecutor, tokenID string) {
+				if err := ce.UpdateConfig([]byte(approvalConfig("viewer"))); err != nil {
+					t.Fatal(err)
+				}
+			},
+			err: "carol no longer has the operator role on 10.1.1.1",
+		},
+		{
+			name:  "token revoked",
+			token: true,
+			change: func(t *testing.T, s *testServer, ce *core.CommandExecutor, tokenID string) {
+				if status := s.call(t, s.login(t, "carol"), "DELETE", "/tokens/"+tokenID, nil, nil); status != 200 {
+					t.Fatalf("expected the token to be revoked, got %d", status)
+				}
+			},
+			err: "was revoked or expired",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stop := fmt.Sprintf("docker 'stop' '%s'", core.FakeContainerID)
+			transport := core.NewOnlineFakeHost().On(stop, core.FakeContainerID+"\n", nil)
+			ce := testExecutor(t, approvalConfig("operator"), transport)
+			s := newTestServer(t, ce)
+			client, tokenID := s.login(t, "carol"), ""
+			if test.token {
+				var created TokenResponse
+				payload := &TokenPayload{Name: "ci", Hosts: []string{"10.1.1.1"}, Actions: []string{"stop"}}
+				if status := s.call(t, client, "POST", "/tokens", payload, &created); status != 200 {
+					t.Fatalf("expected the token to be created, got %d: %s", status, created.Error)
+				}
+				client, tokenID = &http.Client{Transport: &bearerTransport{secret: created.Secret}}, created.Token.ID
+			}
+			id := s.parkStop(t, client)
+			test.change(t, s, ce, tokenID)
+			admin := s.login(t, "admin")
+			var approved approvalRequest
+			if status := s.call(t, admin, "POST", "/approvals/"+id+"/approve", nil, &approved); status != 403 || !strings.Contains(approved.Error, test.err) {
+				t.Fatalf("expected the approval to be refused with %q, got %d: %s", test.err, status, approved.Error)
+			}
+			for _, command := range transport.Commands() {
+				if command == stop {
+					t.Fatal("expected the stop not to run")
+				}
+			}
+			// the request is approved but failed
+			var got approvalRequest
+			if status := s.call(t, admin, "GET", "/approvals/"+id, nil, &got); status != 200 || got.Approval.Status != "approved" || !strings.Contains(got.Approval.Error, test.err) {
+				t.Fatalf("expected the request to record the error, got %d %+v", status, got.Approval)
+			}
+		})
+	}
+}
+
+func TestApprovedExecRechecksRequester(t *testing.T) {
+	config := strings.Replace(approvalConfig("operator"), "[container.stop]", "[container.exec]", 1)
+	transport := core.NewOnlineFakeHost().On(fmt.Sprintf("docker exec -it '%s' sh", core.FakeContainerID), "/ # ", nil)
+	ce := testExecutor(t, config, transport)
+	s := newTestServer(t, ce)
+	conn := s.dial(t, s.login(t, "carol"), "/container/exec?ip=10.1.1.1&containerID=web")
+	if _, msg, err := conn.ReadMessage(); err != nil || !strings.Contains(string(msg), "waiting until") {
+		t.Fatalf("expected the session to wait for the approval, got %q %v", msg, err)
+	}
+	admin := s.login(t, "admin")
+	var list struct{ Approvals []struct{ ID string } }
+	if status := s.call(t, admin, "GET", "/approvals?status=pending", nil, &list); status != 200 || len(list.Approvals) != 1 {
+		t.Fatalf("expected the pending request, got %d %+v", status, list)
+	}
+	// carol loses the operator role while the request is pending
+	if err := ce.UpdateConfig([]byte(strings.Replace(config, "role: operator", "role: viewer", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if status := s.call(t, admin, "POST", "/approvals/"+list.Approvals[0].ID+"/approve", nil, nil); status != 200 {
+		t.Fatalf("expected the request to be approved, got %d", status)
+	}
+	if out := readAll(conn); !strings.Contains(out, "carol no longer has the operator role on 10.1.1.1") {
+		t.Fatalf("expected the session to end, got %q", out)
+	}
+	if len(transport.Terminals()) != 0 {
+		t.Fatal("expected no terminal to be opened")
+	}
+	event := s.waitEvent(t, "container.exec")
+	if event.Outcome != "denied" || event.Status != 101 || event.Approval != list.Approvals[0].ID {
+		t.Fatalf("expected the session to be denied, got %+v", event)
+	}
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"crazydocker/pkg/audit"
+	"crazydocker/pkg/auth"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const auditKey = "audit"
+const maxAuditEvents = 1000
+
+var auditLog *audit.Log
+
+// audited records the request in the audit log once it is done, exec
+// sessions are recorded when they end. Handlers add what only they know
+// through auditEvent and report failures with c.Error, websocket handlers
+// set the outcome with sessionEnded once the connection is upgraded.
+func audited(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		query := c.Request.URL.Query()
+		event := &audit.Event{
+			Time:      start,
+			Action:    action,
+			ClientIP:  c.ClientIP(),
+			Host:      query.Get("ip"),
+			Container: query.Get("containerID"),
+			Command:   query.Get("action"),
+		}
+		if event.Host == "" {
+			// the host key routes name the host directly
+			event.Host = query.Get("host")
+		}
+		c.Set(auditKey, event)
+		c.Next()
+		event.Duration = time.Since(start)
+		if user, ok := c.Get(userKey); ok {
+			event.User = user.(auth.User).Username
+		}
+		if token := requestToken(c); token != nil {
+			event.Token = token.ID
+		}
+		if event.Outcome != "" {
+			// the handler recorded how its websocket session ended, gin
+			// knows nothing about hijacked connections
+			record(event)
+			return
+		}
+		event.Status = c.Writer.Status()
+		switch {
+		case event.Status == 403:
+			event.Outcome = audit.OutcomeDenied
+		case len(c.Errors) > 0 || event.Status >= 400:
+			event.Outcome = audit.OutcomeFailure
+		case event.Status == 202:
+			// the operation was parked until it is approved
+			event.Outcome = audit.OutcomePending
+		default:
+			event.Outcome = audit.OutcomeSuccess
+		}
+		if err := c.Errors.Last(); err != nil {
+			event.Error = err.Error()
+		}
+		record(event)
+	}
+}
+
+func record(event *audit.Event) {
+	if err := auditLog.Record(*event); err != nil {
+		log.Printf("unable to write audit event :%s\n", err)
+	}
+}
+
+// sessionEnded sets the outcome of a websocket session once the connection
+// was upgraded, err is the reason it failed or was denied
+func sessionEnded(c *gin.Context, outcome string, err error) {
+	if err != nil {
+		c.Error(err)
+	}
+	event := auditEvent(c)
+	if event == nil {
+		return
+	}
+	event.Status = http.StatusSwitchingProtocols
+	event.Outcome = outcome
+	if err != nil {
+		event.Error = err.Error()
+	}
+}
+
+// auditEvent returns the event of an audited request, it is nil for the
+// routes which are not audited
+func auditEvent(c *gin.Context) *audit.Event {
+	event, ok := c.Get(auditKey)
+	if !ok {
+		return nil
+	}
+	return event.(*audit.Event)
+}
+
+func listAuditEvents(c *gin.Context) {
+	query := c.Request.URL.Query()
+	filter := audit.Filter{Host: query.Get("host"), User: query.Get("user"), Limit: 100}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				c.JSON(400, &AuditResponse{Response: Response{Error: name + " must be an RFC 3339 time"}})
+				return
+			}
+			*t = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			c.JSON(400, &AuditResponse{Response: Response{Error: "limit must be a positive number"}})
+			return
+		}
+		filter.Limit = min(limit, maxAuditEvents)
+	}
+	events, err := auditLog.Query(filter)
+	if err != nil {
+		c.JSON(500, &AuditResponse{Response: Response{Error: err.Error()}})
+		return
+	}
+	c.JSON(200, &AuditResponse{Events: events})
+}
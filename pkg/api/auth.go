@@ -0,0 +1,137 @@
+package api
+
+import (
+	"crazydocker/pkg/auth"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sessionCookie = "crazydocker_session"
+const userKey = "user"
+
+// certificateKey is set for requests authenticated by a client certificate
+const certificateKey = "certificate"
+
+var users *auth.Users
+var sessions *auth.Sessions
+
+// requireSession rejects requests without a valid session, websocket
+// upgrades included as the browser sends the cookie with them. Requests with
+// an api token, websocket upgrades with a ticket and requests with a verified
+// client certificate of a user do not need a session.
+func requireSession(c *gin.Context) {
+	if value, ok := bearerToken(c); ok {
+		token, valid := tokens.Authenticate(value)
+		if !valid || !userActive(token.Owner()) {
+			c.AbortWithStatusJSON(401, &Response{Error: "invalid or expired api token"})
+			return
+		}
+		useToken(c, &token)
+		return
+	}
+	if ticket := c.Request.URL.Query().Get("ticket"); ticket != "" && c.IsWebsocket() {
+		redeemTicket(c, ticket)
+		return
+	}
+	token, err := c.Cookie(sessionCookie)
+	if err == nil {
+		// sessions of users removed from the users file end right away
+		if user, ok := sessions.Get(token); ok && userActive(user) {
+			c.Set(userKey, user)
+			c.Next()
+			return
+		}
+	}
+	if user, ok := certificateUser(c.Request); ok {
+		c.Set(userKey, user)
+		c.Set(certificateKey, true)
+		c.Next()
+		return
+	}
+	c.AbortWithStatusJSON(401, &Response{Error: "authentication required"})
+}
+
+// certificateUser returns the user named by the common name of the client
+// certificate, only certificates verified against TLS_CLIENT_CA_FILE count
+func certificateUser(r *http.Request) (auth.User, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return auth.User{}, false
+	}
+	username := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if username == "" || !users.Exists(username) {
+		return auth.User{}, false
+	}
+	return auth.User{Username: username}, true
+}
+
+// userActive tells whether the user can still use the api, local users
+// removed from the users file can not. Users signed in with OIDC are not in
+// the file, they are active until their id token expires.
+func userActive(user auth.User) bool {
+	if user.OIDC {
+		return time.Now().Before(user.Expires)
+	}
+	return users.Exists(user.Username)
+}
+
+// currentUser returns the user set by requireSession
+func currentUser(c *gin.Context) auth.User {
+	user, _ := c.Get(userKey)
+	return user.(auth.User)
+}
+
+func setSessionCookie(c *gin.Context, token string, maxAge int) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, token, maxAge, "/", "", c.Request.TLS != nil, true)
+}
+
+func login(c *gin.Context) {
+	var payload *LoginPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(400, &Response{Error: err.Error()})
+		return
+	}
+	if event := auditEvent(c); event != nil {
+		event.User = payload.Username
+	}
+	user, err := users.Authenticate(payload.Username, payload.Password)
+	if err != nil {
+		c.Error(err)
+		if errors.Is(err, auth.ErrInvalidCredentials) {
+			c.JSON(401, &Response{Error: err.Error()})
+			return
+		}
+		log.Printf("unable to read users :%s\n", err)
+		c.JSON(500, &Response{Error: "unable to read users"})
+		return
+	}
+	token, expires, err := sessions.Create(*user)
+	if err != nil {
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	setSessionCookie(c, token, int(time.Until(expires).Seconds()))
+	c.JSON(200, &UserResponse{User: user, Role: ce.GlobalRole(user.Username), CSRFToken: auth.CSRFToken(token)})
+}
+
+func logout(c *gin.Context) {
+	if token, err := c.Cookie(sessionCookie); err == nil {
+		sessions.Delete(token)
+	}
+	setSessionCookie(c, "", -1)
+	c.JSON(200, &Response{Error: ""})
+}
+
+func me(c *gin.Context) {
+	user := currentUser(c)
+	response := &UserResponse{User: &user, Role: role(c, "")}
+	// api tokens need no csrf token
+	if requestToken(c) == nil {
+		response.CSRFToken = csrfToken(c)
+	}
+	c.JSON(200, response)
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"crazydocker/pkg/audit"
+	"crazydocker/pkg/auth"
+	"crazydocker/pkg/core"
+	"crazydocker/pkg/recording"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "pw"
+
+// accessConfig makes admin an admin and bob a viewer of every host, carol
+// has no role
+const accessConfig = "access:\n  - user: admin\n    role: admin\n  - user: bob\n    role: viewer\n"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	os.Exit(m.Run())
+}
+
+// hostConfig is a config with a single password host and the roles of
+// accessConfig
+func hostConfig(ip string) string {
+	return accessConfig + core.FakeHostConfig(ip)
+}
+
+// testExecutor starts a command executor on the config, the hosts use the
+// transport or ssh when it is nil
+func testExecutor(t *testing.T, yaml string, transport core.Transport) *core.CommandExecutor {
+	t.Helper()
+	ce, err := core.NewFakeExecutor(t.TempDir(), yaml, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ce
+}
+
+// testServer serves the api of an executor to the users admin, bob and
+// carol
+type testServer struct {
+	*httptest.Server
+	audit *audit.Log
+}
+
+func newTestServer(t *testing.T, executor *core.CommandExecutor, opts ...Option) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	// the cheapest hash keeps the logins fast, the users file accepts any
+	// bcrypt cost
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	for _, username := range []string{"admin", "bob", "carol"} {
+		lines = append(lines, username+":"+string(hash))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "users"), []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u, err := auth.NewUsers(filepath.Join(dir, "users"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := audit.NewLog(filepath.Join(dir, "audit.log"), audit.DefaultMaxSize, audit.DefaultMaxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	store, err := recording.NewStore(filepath.Join(dir, "recordings"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStore, err := auth.NewTokens(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router, err := NewRouter(executor, append([]Option{WithUsers(u), WithAuditLog(l), WithRecordings(store), WithTokens(tokenStore)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{Server: httptest.NewServer(router), audit: l}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// login returns a client with the session of the user, it sends the csrf
+// token of the session like the frontend does
+func (s *testServer) login(t *testing.T, username string) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+	resp, err := client.Post(s.URL+"/login", "application/json", strings.NewReader(`{"username":"`+username+`","password":"`+testPassword+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("login of %s failed with %d", username, resp.StatusCode)
+	}
+	client.Transport = &csrfTransport{jar: jar}
+	return client
+}
+
+// csrfTransport adds the csrf token of the session cookie to the requests
+type csrfTransport struct {
+	jar http.CookieJar
+}
+
+func (c *csrfTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for _, cookie := range c.jar.Cookies(r.URL) {
+		if cookie.Name == sessionCookie {
+			r.Header.Set(csrfHeader, auth.CSRFToken(cookie.Value))
+		}
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// call sends the body as JSON and decodes the JSON response into out, it
+// returns the status code
+func (s *testServer) call(t *testing.T, client *http.Client, method string, path string, body any, out any) int {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// dial opens a websocket with the session of the client
+func (s *testServer) dial(t *testing.T, client *http.Client, path string) *websocket.Conn {
+	t.Helper()
+	u, err := url.Parse(s.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	for _, cookie := range client.Jar.Cookies(u) {
+		header.Add("Cookie", cookie.String())
+	}
+	u.Scheme = "ws"
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("dial %s: %v (%d)", path, err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readAll reads the websocket until it is closed
+func readAll(conn *websocket.Conn) string {
+	var out strings.Builder
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return out.String()
+		}
+		out.Write(data)
+	}
+}
+
+// waitEvent waits for the audit event of the action, websocket handlers
+// record it once they are done which is after the client saw the socket
+// close
+func (s *testServer) waitEvent(t *testing.T, action string) audit.Event {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, err := s.audit.Query(audit.Filter{Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range events {
+			if event.Action == action {
+				return event
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a %s audit event", action)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lastEvent returns the newest audit event
+func (s *testServer) lastEvent(t *testing.T) audit.Event {
+	t.Helper()
+	events, err := s.audit.Query(audit.Filter{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 {
+		t.Fatal("expected an audit event")
+	}
+	return events[0]
+}
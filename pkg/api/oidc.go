@@ -0,0 +1,135 @@
+package api
+
+import (
+	"crazydocker/pkg/auth"
+	"crazydocker/pkg/oidc"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// oidcStateCookie ties a login to the browser which started it
+const oidcStateCookie = "crazydocker_oidc_state"
+
+var oidcLock sync.Mutex
+var oidcProvider *oidc.Provider
+
+// currentOIDCProvider returns the provider of the config, it is nil when
+// OIDC is disabled. A new provider is made when the settings change.
+func currentOIDCProvider() (*oidc.Provider, error) {
+	settings := ce.OIDC()
+	if !settings.Enabled() {
+		return nil, nil
+	}
+	oidcLock.Lock()
+	defer oidcLock.Unlock()
+	if oidcProvider != nil && reflect.DeepEqual(oidcProvider.Settings(), settings) {
+		return oidcProvider, nil
+	}
+	p, err := oidc.NewProvider(settings)
+	if err != nil {
+		return nil, err
+	}
+	oidcProvider = p
+	return p, nil
+}
+
+// validNext tells whether the browser can be sent to next after the login,
+// only paths of the api server and pages of allowed origins are
+func validNext(next string) bool {
+	if strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "//") && !strings.HasPrefix(next, "/\\") {
+		return true
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Host == "" || u.User != nil {
+		return false
+	}
+	return originAllowed(u.Scheme + "://" + u.Host)
+}
+
+func loginOptions(c *gin.Context) {
+	c.JSON(200, &LoginOptionsResponse{OIDC: ce.OIDC().Enabled()})
+}
+
+// oidcLogin sends the browser to the provider, next is where it goes once
+// the login is done
+func oidcLogin(c *gin.Context) {
+	provider, err := currentOIDCProvider()
+	if err != nil {
+		log.Printf("unable to set up oidc :%s\n", err)
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	if provider == nil {
+		c.JSON(404, &Response{Error: "oidc is not enabled"})
+		return
+	}
+	next := c.Request.URL.Query().Get("next")
+	if next != "" && !validNext(next) {
+		c.JSON(400, &Response{Error: "next has to be a path or a page of an allowed origin"})
+		return
+	}
+	authURL, state, err := provider.AuthCodeURL(c.Request.Context(), next)
+	if err != nil {
+		log.Printf("unable to start the oidc login :%s\n", err)
+		c.JSON(502, &Response{Error: err.Error()})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int((10 * time.Minute).Seconds()), "/oidc", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// oidcCallback is where the provider sends the browser back to, the user
+// gets a session like with a password
+func oidcCallback(c *gin.Context) {
+	query := c.Request.URL.Query()
+	provider, err := currentOIDCProvider()
+	if err != nil || provider == nil {
+		c.JSON(404, &Response{Error: "oidc is not enabled"})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, "/oidc", "", c.Request.TLS != nil, true)
+	if e := query.Get("error"); e != "" {
+		c.Error(errors.New(e))
+		c.JSON(401, &Response{Error: "the oidc provider refused the login: " + e + " " + query.Get("error_description")})
+		return
+	}
+	state := query.Get("state")
+	if cookie, err := c.Cookie(oidcStateCookie); err != nil || state == "" || cookie != state {
+		c.JSON(401, &Response{Error: "the login was not started by this browser, start again"})
+		return
+	}
+	identity, next, err := provider.Exchange(c.Request.Context(), state, query.Get("code"))
+	if err != nil {
+		c.Error(err)
+		c.JSON(401, &Response{Error: err.Error()})
+		return
+	}
+	// the username is prefixed so that it can not be taken for a local user,
+	// in role bindings, approvals or the audit log
+	user := auth.User{Username: auth.OIDCPrefix + identity.Username, Groups: identity.Groups, OIDC: true, Expires: identity.Expires}
+	if event := auditEvent(c); event != nil {
+		event.User = user.Username
+	}
+	token, expires, err := sessions.Create(user)
+	if err != nil {
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	setSessionCookie(c, token, int(time.Until(expires).Seconds()))
+	if next != "" {
+		c.Redirect(http.StatusFound, next)
+		return
+	}
+	c.Set(userKey, user)
+	c.JSON(200, &UserResponse{User: &user, Role: role(c, ""), CSRFToken: auth.CSRFToken(token)})
+}
@@ -0,0 +1,195 @@
+package api
+
+import (
+	"crazydocker/pkg/auth"
+	"crazydocker/pkg/core"
+	"crazydocker/pkg/oidctest"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// oidcServer serves a host to the users of a test issuer, admin is a local
+// admin, the users of the ops group are operators and the subject of carol
+// is an admin. The username is read from the claim, the subject by default.
+func oidcServer(t *testing.T, config oidctest.Config, usernameClaim string) (*testServer, *oidctest.Issuer) {
+	t.Helper()
+	config.ClientID = "dockerfrenzy"
+	issuer, err := oidctest.NewIssuer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+	yaml := "oidc:\n  issuer: " + issuer.URL() + "\n  clientID: dockerfrenzy\n  redirectURL: http://127.0.0.1/oidc/callback\n"
+	if usernameClaim != "" {
+		yaml += "  usernameClaim: " + usernameClaim + "\n"
+	}
+	yaml += "access:\n  - user: admin\n    role: admin\n  - group: ops\n    role: operator\n  - user: oidc:sub-carol\n    role: admin\n" +
+		core.FakeHostConfig("10.1.1.1")
+	return newTestServer(t, testExecutor(t, yaml, core.NewOnlineFakeHost())), issuer
+}
+
+// oidcUser is the answer of the callback
+type oidcUser struct {
+	Error     string
+	User      auth.User
+	Role      string
+	CSRFToken string
+}
+
+// startOIDCLogin starts a login and follows the issuer, it returns the
+// client holding the state cookie and the query the issuer sent back
+func (s *testServer) startOIDCLogin(t *testing.T) (*http.Client, url.Values) {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	location := s.URL + "/oidc/login"
+	// the api sends the browser to the issuer which sends it back
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(location)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusFound {
+			t.Fatalf("expected a redirect from %s, got %d", location, resp.StatusCode)
+		}
+		location = resp.Header.Get("Location")
+	}
+	back, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, back.Query()
+}
+
+// callback finishes the login with the query
+func (s *testServer) callback(t *testing.T, client *http.Client, query url.Values) (int, oidcUser) {
+	t.Helper()
+	resp, err := client.Get(s.URL + "/oidc/callback?" + query.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var user oidcUser
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, user
+}
+
+// oidcLogin signs the user of the issuer in, the client sends the csrf
+// token like the frontend does
+func (s *testServer) oidcLogin(t *testing.T) (*http.Client, oidcUser) {
+	t.Helper()
+	client, query := s.startOIDCLogin(t)
+	status, user := s.callback(t, client, query)
+	if status != 200 {
+		t.Fatalf("expected the login to succeed, got %d: %s", status, user.Error)
+	}
+	client.CheckRedirect = nil
+	client.Transport = &csrfTransport{jar: client.Jar}
+	return client, user
+}
+
+func TestOIDCLogin(t *testing.T) {
+	// the user of the provider is named like the local admin
+	s, _ := oidcServer(t, oidctest.Config{Username: "admin", Groups: []string{"ops"}}, "preferred_username")
+	client, user := s.oidcLogin(t)
+	if user.User.Username != "oidc:admin" || !user.User.OIDC {
+		t.Fatalf("expected the user of the provider, got %+v", user.User)
+	}
+	if until := time.Until(user.User.Expires); until < 50*time.Minute || until > time.Hour {
+		t.Fatalf("expected the sign in to end with the id token, got %s", user.User.Expires)
+	}
+	// the role comes from the group, not from the local admin
+	if user.Role != "operator" {
+		t.Fatalf("expected the operator role of the group, got %s", user.Role)
+	}
+	var response Response
+	if status := s.call(t, client, "GET", "/containers?ip=10.1.1.1", nil, &response); status != 200 {
+		t.Fatalf("expected the operator to list the containers, got %d: %s", status, response.Error)
+	}
+	if status := s.call(t, client, "GET", "/config", nil, &response); status != 403 {
+		t.Fatalf("expected the config to be refused to the operator, got %d", status)
+	}
+	if event := s.waitEvent(t, "login.oidc"); event.User != "oidc:admin" || event.Outcome != "success" {
+		t.Fatalf("expected the login to be audited for oidc:admin, got %+v", event)
+	}
+}
+
+func TestOIDCUserBinding(t *testing.T) {
+	s, _ := oidcServer(t, oidctest.Config{Username: "carol"}, "")
+	_, user := s.oidcLogin(t)
+	if user.User.Username != "oidc:sub-carol" || user.Role != "admin" {
+		t.Fatalf("expected the binding of the subject of carol to apply, got %+v %s", user.User, user.Role)
+	}
+	// the local carol has no binding
+	var me oidcUser
+	if status := s.call(t, s.login(t, "carol"), "GET", "/me", nil, &me); status != 200 || me.Role != "none" {
+		t.Fatalf("expected the local carol to have no role, got %d %s", status, me.Role)
+	}
+}
+
+func TestOIDCCallbackRejectsForeignLogins(t *testing.T) {
+	s, _ := oidcServer(t, oidctest.Config{Username: "alice", Groups: []string{"ops"}}, "")
+	client, query := s.startOIDCLogin(t)
+	tests := []struct {
+		name   string
+		client *http.Client
+		query  url.Values
+	}{
+		// another browser got hold of the redirect
+		{name: "without the state cookie", client: &http.Client{}, query: query},
+		{name: "other state", client: client, query: url.Values{"state": {"other"}, "code": {query.Get("code")}}},
+		{name: "refused by the provider", client: client, query: url.Values{"error": {"access_denied"}, "state": {query.Get("state")}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status, user := s.callback(t, test.client, test.query); status != 401 {
+				t.Fatalf("expected 401, got %d %+v", status, user)
+			}
+		})
+	}
+}
+
+func TestOIDCSessionEndsWithIDToken(t *testing.T) {
+	s, _ := oidcServer(t, oidctest.Config{Username: "alice", Groups: []string{"ops"}, TokenTTL: 2 * time.Second}, "")
+	client, user := s.oidcLogin(t)
+	var response TokenResponse
+	payload := &TokenPayload{Name: "ci", Hosts: []string{"10.1.1.1"}, Actions: []string{"read"}, ExpiresIn: "1h"}
+	if status := s.call(t, client, "POST", "/tokens", payload, &response); status != 400 {
+		t.Fatalf("expected a token outliving the sign in to be refused, got %d", status)
+	}
+	payload.ExpiresIn = ""
+	if status := s.call(t, client, "POST", "/tokens", payload, &response); status != 200 {
+		t.Fatalf("expected the token to be created, got %d: %s", status, response.Error)
+	}
+	if !response.Token.Expires.Equal(user.User.Expires) {
+		t.Fatalf("expected the token to expire with the sign in at %s, got %s", user.User.Expires, response.Token.Expires)
+	}
+	time.Sleep(time.Until(user.User.Expires) + 100*time.Millisecond)
+	var me Response
+	if status := s.call(t, client, "GET", "/me", nil, &me); status != 401 {
+		t.Fatalf("expected the session to end with the id token, got %d", status)
+	}
+	req, err := http.NewRequest("GET", s.URL+"/containers?ip=10.1.1.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+response.Secret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 {
+		t.Fatalf("expected the token to end with the sign in, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"crazydocker/pkg/auth"
+	"crazydocker/pkg/config"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const csrfHeader = "X-CSRF-Token"
+
+// envOrigins are the allowed origins set in ALLOWED_ORIGINS, comma separated
+var envOrigins []string
+
+func loadEnvOrigins() {
+	envOrigins = []string{}
+	for _, o := range strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",") {
+		if strings.TrimSpace(o) == "" {
+			continue
+		}
+		origin, err := config.NormalizeOrigin(strings.TrimSpace(o))
+		if err != nil {
+			log.Printf("ignoring ALLOWED_ORIGINS entry :%s\n", err)
+			continue
+		}
+		envOrigins = append(envOrigins, origin)
+	}
+}
+
+// originAllowed tells whether web pages of the origin may use the api, the
+// origins of ALLOWED_ORIGINS and of the config are allowed
+func originAllowed(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range append(ce.AllowedOrigins(), envOrigins...) {
+		if o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// requestOriginAllowed tells whether the request comes from the api server
+// itself or from an allowed origin. Requests without an origin are not made
+// by a web page of another origin, browsers send it with those.
+func requestOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return originAllowed(origin)
+}
+
+// certificateCSRFKey keys the csrf tokens of the users authenticated by a
+// client certificate, the certificate is no secret to derive them from
+var certificateCSRFKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// csrfToken returns the csrf token of the request, it is derived from the
+// session token or from the client certificate of the user
+func csrfToken(c *gin.Context) string {
+	if c.GetBool(certificateKey) {
+		mac := hmac.New(sha256.New, certificateCSRFKey)
+		mac.Write(c.Request.TLS.VerifiedChains[0][0].Raw)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	token, _ := c.Cookie(sessionCookie)
+	return auth.CSRFToken(token)
+}
+
+// requireCSRFToken rejects the requests changing something which do not
+// carry the csrf token of their session or certificate, web pages of other
+// origins can not read it. Browsers send the session cookie and present the
+// client certificate on their own, even with the forms of other sites. Only
+// requests authenticated by an api token do not need it, browsers never add
+// those.
+func requireCSRFToken(c *gin.Context) {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+	if requestToken(c) != nil {
+		c.Next()
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader(csrfHeader)), []byte(csrfToken(c))) != 1 {
+		c.AbortWithStatusJSON(403, &Response{Error: "missing or invalid csrf token"})
+		return
+	}
+	c.Next()
+}
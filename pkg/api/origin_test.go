@@ -0,0 +1,118 @@
+package api
+
+import (
+	"crazydocker/pkg/core"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// certificateClient serves the api of s over TLS and returns a client
+// presenting a certificate of the user, signed by the client CA of the server
+func certificateClient(t *testing.T, s *testServer, username string) (*http.Client, string) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: username},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server := httptest.NewUnstartedServer(s.Config.Handler)
+	server.TLS = &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+	return client, server.URL
+}
+
+func TestCertificateUsersNeedCSRFToken(t *testing.T) {
+	stop := fmt.Sprintf("docker 'stop' '%s'", core.FakeContainerID)
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), core.NewOnlineFakeHost().On(stop, core.FakeContainerID+"\n", nil)))
+	client, url := certificateClient(t, s, "admin")
+	post := func(origin string, csrf string) int {
+		req, err := http.NewRequest("POST", url+"/container/action?ip=10.1.1.1&containerID=web&action=stop", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// the form of another site is sent with the certificate of the browser
+	if status := post("https://evil.example.com", ""); status != 403 {
+		t.Fatalf("expected 403 for the form of another site, got %d", status)
+	}
+	if status := post("", ""); status != 403 {
+		t.Fatalf("expected 403 without the csrf token, got %d", status)
+	}
+	resp, err := client.Get(url + "/me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var me struct {
+		User      struct{ Username string }
+		CSRFToken string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	if me.User.Username != "admin" || me.CSRFToken == "" {
+		t.Fatalf("expected the certificate to sign admin in with a csrf token, got %+v", me)
+	}
+	if status := post("", me.CSRFToken); status != 200 {
+		t.Fatalf("expected the stop to run with the csrf token, got %d", status)
+	}
+}
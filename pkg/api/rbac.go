@@ -0,0 +1,43 @@
+package api
+
+import (
+	"crazydocker/pkg/rbac"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authorize checks the role of the user on the host, or on the server itself
+// when host is empty, and answers 403 when it is not enough
+func authorize(c *gin.Context, host string, required rbac.Role) bool {
+	role := role(c, host)
+	if role.Allows(required) {
+		return true
+	}
+	response := &ForbiddenResponse{Required: required, Role: role, Host: host}
+	if host == "" {
+		response.Error = fmt.Sprintf("%s requires the %s role", c.FullPath(), required)
+	} else {
+		response.Error = fmt.Sprintf("%s requires the %s role on %s", c.FullPath(), required, host)
+	}
+	c.AbortWithStatusJSON(403, response)
+	return false
+}
+
+// requireHostRole guards the routes taking the host as the ip query param
+func requireHostRole(required rbac.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authorize(c, c.Request.URL.Query().Get("ip"), required) {
+			c.Next()
+		}
+	}
+}
+
+// requireServerRole guards the routes managing the server itself
+func requireServerRole(required rbac.Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if authorize(c, "", required) {
+			c.Next()
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"crazydocker/pkg/core"
+	"crazydocker/pkg/rbac"
+	"crazydocker/pkg/recording"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var recordings *recording.Store
+
+// recordings past their retention are deleted this often, and whenever a
+// session starts
+const recordingCleanupInterval = time.Hour
+
+// cleanupRecordings deletes the recordings past the retention of the
+// config, it is read on every run so that reloads apply
+func cleanupRecordings(executor *core.CommandExecutor, store *recording.Store) {
+	if err := store.Cleanup(executor.Recording().Retention); err != nil {
+		log.Printf("unable to delete old recordings :%s\n", err)
+	}
+}
+
+// cleanupRecordingsEvery runs the cleanup on a ticker until ctx is done
+func cleanupRecordingsEvery(ctx context.Context, interval time.Duration, executor *core.CommandExecutor, store *recording.Store) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cleanupRecordings(executor, store)
+		}
+	}
+}
+
+// startRecording records the exec session of the request when recording is
+// enabled, the session has to run with the returned context and call stop
+// once it ends
+func startRecording(c *gin.Context, host string, container string, command string) (ctx context.Context, stop func(), err error) {
+	ctx = c.Request.Context()
+	settings := ce.Recording()
+	if !settings.Enabled {
+		return ctx, func() {}, nil
+	}
+	cleanupRecordings(ce, recordings)
+	rec, err := recordings.Create(recording.Meta{
+		User:      currentUser(c).Username,
+		Host:      host,
+		Container: container,
+		Command:   command,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to record the session: %w", err)
+	}
+	if event := auditEvent(c); event != nil {
+		event.Recording = rec.ID()
+	}
+	return core.WithTerminalRecorder(ctx, rec), func() {
+		if err := rec.Close(); err != nil {
+			log.Printf("unable to close recording %s :%s\n", rec.ID(), err)
+		}
+	}, nil
+}
+
+// listRecordings returns the recordings of the hosts the user is admin on,
+// the newest first
+func listRecordings(c *gin.Context) {
+	query := c.Request.URL.Query()
+	host, user := query.Get("host"), query.Get("user")
+	all, err := recordings.List()
+	if err != nil {
+		c.JSON(500, &RecordingListResponse{Response: Response{Error: err.Error()}})
+		return
+	}
+	found := []recording.Meta{}
+	for _, r := range all {
+		if (host != "" && r.Host != host) || (user != "" && r.User != user) {
+			continue
+		}
+		if !role(c, r.Host).Allows(rbac.RoleAdmin) {
+			continue
+		}
+		found = append(found, r)
+	}
+	c.JSON(200, &RecordingListResponse{Recordings: found})
+}
+
+// playRecording streams the asciicast file of a recording, sessions still
+// running are returned up to now
+func playRecording(c *gin.Context) {
+	id := c.Param("id")
+	meta, err := recordings.Get(id)
+	if err != nil {
+		c.Error(err)
+		if errors.Is(err, recording.ErrNotFound) {
+			c.JSON(404, &Response{Error: err.Error()})
+			return
+		}
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	if event := auditEvent(c); event != nil {
+		event.Host = meta.Host
+		event.Container = meta.Container
+		event.Recording = meta.ID
+	}
+	if !authorize(c, meta.Host, rbac.RoleAdmin) {
+		return
+	}
+	file, err := recordings.Open(id)
+	if err != nil {
+		c.Error(err)
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	defer file.Close()
+	c.Header("Content-Type", "application/x-asciicast")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", meta.ID+".cast"))
+	c.Status(200)
+	io.Copy(c.Writer, file)
+}
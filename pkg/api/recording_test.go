@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"crazydocker/pkg/core"
+	"crazydocker/pkg/recording"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// oldRecording writes a recording last changed two days ago
+func oldRecording(t *testing.T, dir string, id string) string {
+	t.Helper()
+	path := filepath.Join(dir, id+".cast")
+	if err := os.WriteFile(path, []byte("{}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRecordingsCleanedUpAtStartup(t *testing.T) {
+	dir := t.TempDir()
+	store, err := recording.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := oldRecording(t, dir, "0123456789abcdef0123456789abcdef")
+	config := "recording:\n  enabled: true\n  retention: 24h\n" + hostConfig("10.1.1.1")
+	newTestServer(t, testExecutor(t, config, core.NewOnlineFakeHost()), WithRecordings(store))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the old recording to be deleted at startup, got %v", err)
+	}
+}
+
+func TestRecordingsCleanedUpOnTicker(t *testing.T) {
+	dir := t.TempDir()
+	store, err := recording.NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := testExecutor(t, "recording:\n  retention: 24h\n"+hostConfig("10.1.1.1"), core.NewOnlineFakeHost())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		cleanupRecordingsEvery(ctx, 10*time.Millisecond, ce, store)
+		close(stopped)
+	}()
+	// recordings are deleted without a session starting, even when
+	// recording was turned off
+	path := oldRecording(t, dir, "fedcba9876543210fedcba9876543210")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the old recording to be deleted by the ticker")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the ticker ends with the server
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the cleanup to stop once cancelled")
+	}
+}
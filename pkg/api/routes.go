@@ -1,14 +1,18 @@
 package api
 
 import (
+	"crazydocker/pkg/approval"
+	"crazydocker/pkg/audit"
 	"crazydocker/pkg/core"
+	"crazydocker/pkg/rbac"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/spf13/viper"
 )
 
 var ce *core.CommandExecutor
@@ -16,13 +20,32 @@ var ce *core.CommandExecutor
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	// browsers do not apply cors to websockets, the origin is checked here
+	CheckOrigin: requestOriginAllowed,
+}
+
+// errorStatus returns the status code of an operation error, operations
+// which ran out of time are reported as gateway timeouts
+func errorStatus(err error) int {
+	var timeoutErr *core.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return http.StatusGatewayTimeout
+	}
+	var invalidErr *core.InvalidRequestError
+	if errors.As(err, &invalidErr) {
+		return http.StatusBadRequest
+	}
+	return 500
 }
 
 func listMachines(c *gin.Context) {
-	machines := ce.ListMachines()
+	// only the machines the user has a role on are listed
+	machines := []*core.Machine{}
+	for _, m := range ce.ListMachines() {
+		if role(c, m.Ip).Allows(rbac.RoleViewer) {
+			machines = append(machines, m)
+		}
+	}
 	c.JSON(200, &MachineListResponse{Machines: machines})
 }
 
@@ -32,9 +55,9 @@ func listContainers(c *gin.Context) {
 		c.JSON(500, &ContainerListResponse{Containers: nil, Response: Response{Error: "Please provide valid ip"}})
 		return
 	}
-	containers, err := ce.ListContainers(ip)
+	containers, err := ce.ListContainers(c.Request.Context(), ip)
 	if err != nil {
-		c.JSON(500, &ContainerListResponse{Containers: nil, Response: Response{Error: err.Error()}})
+		c.JSON(errorStatus(err), &ContainerListResponse{Containers: nil, Response: Response{Error: err.Error()}})
 		return
 	}
 	c.JSON(200, &ContainerListResponse{Containers: containers})
@@ -48,9 +71,26 @@ func performActionOnContainer(c *gin.Context) {
 		c.JSON(500, &Response{Error: "Please provide both ip and containerID"})
 		return
 	}
-	_, err := ce.PerformAction(ip, containerId, action)
+	if required, _ := ce.ApprovalRequired(ip, "container."+action); required {
+		// the action is checked before it is parked for an approval
+		if _, err := core.ParseContainerAction(action); err != nil {
+			c.Error(err)
+			c.JSON(errorStatus(err), &Response{Error: err.Error()})
+			return
+		}
+		containerId, err := ce.ResolveContainer(c.Request.Context(), ip, containerId)
+		if err != nil {
+			c.Error(err)
+			c.JSON(errorStatus(err), &Response{Error: err.Error()})
+			return
+		}
+		parkOperation(c, approval.Operation{Name: "container." + action, Host: ip, Container: containerId})
+		return
+	}
+	_, err := ce.PerformAction(c.Request.Context(), ip, containerId, action)
 	if err != nil {
-		c.JSON(500, &Response{Error: err.Error()})
+		c.Error(err)
+		c.JSON(errorStatus(err), &Response{Error: err.Error()})
 		return
 	}
 	c.JSON(200, &Response{Error: ""})
@@ -63,17 +103,21 @@ func streamContainer(c *gin.Context) {
 		c.JSON(500, &ContainerResponse{Container: nil, Response: Response{Error: "Please provide both ip and containerID"}})
 		return
 	}
-	// upgrade to websocket and start streaming container info
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	containerId, err := ce.ResolveContainer(c.Request.Context(), ip, containerId)
 	if err != nil {
-		c.JSON(500, &Response{Error: "unable to upgrade the connection to ws"})
+		c.JSON(errorStatus(err), &ContainerResponse{Container: nil, Response: Response{Error: err.Error()}})
 		return
 	}
-	err = ce.StreamContainer(conn, ip, containerId)
+	// upgrade to websocket and start streaming container info
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		c.JSON(500, &Response{Error: err.Error()})
+		// the upgrader already answered the request
+		c.Error(err)
 		return
 	}
+	if err := ce.StreamContainer(c.Request.Context(), conn, ip, containerId); err != nil {
+		c.Error(err)
+	}
 }
 
 func streamImage(c *gin.Context) {
@@ -83,17 +127,21 @@ func streamImage(c *gin.Context) {
 		c.JSON(500, &ImageResponse{Image: nil, Response: Response{Error: "Please provide both ip and containerID"}})
 		return
 	}
-	// upgrade to websocket and start streaming container info
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	imageId, err := ce.ResolveImage(c.Request.Context(), ip, imageId)
 	if err != nil {
-		c.JSON(500, &Response{Error: "unable to upgrade the connection to ws"})
+		c.JSON(errorStatus(err), &ImageResponse{Image: nil, Response: Response{Error: err.Error()}})
 		return
 	}
-	err = ce.StreamImage(conn, ip, imageId)
+	// upgrade to websocket and start streaming container info
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		c.JSON(500, &Response{Error: err.Error()})
+		// the upgrader already answered the request
+		c.Error(err)
 		return
 	}
+	if err := ce.StreamImage(c.Request.Context(), conn, ip, imageId); err != nil {
+		c.Error(err)
+	}
 }
 
 func listImages(c *gin.Context) {
@@ -102,9 +150,9 @@ func listImages(c *gin.Context) {
 		c.JSON(500, &ImageListResponse{Images: nil, Response: Response{Error: "Please provide valid ip"}})
 		return
 	}
-	Images, err := ce.ListImages(ip)
+	Images, err := ce.ListImages(c.Request.Context(), ip)
 	if err != nil {
-		c.JSON(500, &ImageListResponse{Images: nil, Response: Response{Error: err.Error()}})
+		c.JSON(errorStatus(err), &ImageListResponse{Images: nil, Response: Response{Error: err.Error()}})
 		return
 	}
 
@@ -112,7 +160,7 @@ func listImages(c *gin.Context) {
 }
 
 func getConfig(c *gin.Context) {
-	data, err := os.ReadFile(viper.ConfigFileUsed())
+	data, err := ce.GetConfig()
 	if err != nil {
 		c.JSON(500, &Response{Error: err.Error()})
 		return
@@ -127,30 +175,74 @@ func createContainer(c *gin.Context) {
 		c.JSON(500, &Response{Error: err.Error()})
 		return
 	}
-	out, err := ce.CreateContainer(payload.Ip, payload.Image, payload.Args)
+	if event := auditEvent(c); event != nil {
+		event.Host = payload.Ip
+		event.Command = fmt.Sprintf("run %s %s", payload.Args, payload.Image)
+	}
+	if !authorize(c, payload.Ip, rbac.RoleOperator) {
+		return
+	}
+	if required, _ := ce.ApprovalRequired(payload.Ip, "container.create"); required {
+		// the create is checked before it is parked for an approval
+		if err := ce.CheckCreate(c.Request.Context(), payload.Ip, payload.Image, payload.Args); err != nil {
+			c.Error(err)
+			c.JSON(errorStatus(err), &CreateContainerResponse{Response: Response{Error: err.Error()}})
+			return
+		}
+		parkOperation(c, approval.Operation{Name: "container.create", Host: payload.Ip, Image: payload.Image, Args: payload.Args})
+		return
+	}
+	out, err := ce.CreateContainer(c.Request.Context(), payload.Ip, payload.Image, payload.Args)
 	if err != nil {
-		c.JSON(500, &CreateContainerResponse{Msg: out, Response: Response{Error: err.Error()}})
+		c.Error(err)
+		c.JSON(errorStatus(err), &CreateContainerResponse{Msg: out, Response: Response{Error: err.Error()}})
 		return
 	}
 	c.JSON(200, &CreateContainerResponse{Msg: out})
 }
 
+// terminalSize reads the initial terminal size from the cols and rows query
+// params, missing or invalid values fall back to the defaults
+func terminalSize(c *gin.Context) core.TerminalSize {
+	cols, _ := strconv.Atoi(c.Request.URL.Query().Get("cols"))
+	rows, _ := strconv.Atoi(c.Request.URL.Query().Get("rows"))
+	return core.TerminalSize{Cols: cols, Rows: rows}
+}
+
 func execIntoMachine(c *gin.Context) {
 	ip := c.Request.URL.Query().Get("ip")
 	if ip == "" {
 		c.JSON(500, &Response{Error: "please provide valid ip"})
 		return
 	}
+	if err := ce.CheckHost(ip); err != nil {
+		c.Error(err)
+		c.JSON(errorStatus(err), &Response{Error: err.Error()})
+		return
+	}
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		c.JSON(500, &Response{Error: "unable to upgrade the connection to ws"})
+		// the upgrader already answered the request
+		c.Error(err)
+		return
+	}
+	if !awaitApproval(c, conn, approval.Operation{Name: "machine.exec", Host: ip}) {
+		return
+	}
+	ctx, stop, err := startRecording(c, ip, "", "shell")
+	if err != nil {
+		sessionEnded(c, audit.OutcomeFailure, err)
+		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+		conn.Close()
 		return
 	}
+	defer stop()
 	// get the machine
-	if err := ce.ExecIntoMachine(conn, ip); err != nil {
-		c.JSON(500, &Response{Error: fmt.Sprintf("got error %s", err)})
+	if err := ce.ExecIntoMachine(ctx, conn, ip, terminalSize(c)); err != nil {
+		sessionEnded(c, audit.OutcomeFailure, err)
 		return
 	}
+	sessionEnded(c, audit.OutcomeSuccess, nil)
 }
 
 func execIntoContainer(c *gin.Context) {
@@ -160,15 +252,34 @@ func execIntoContainer(c *gin.Context) {
 		c.JSON(500, &Response{Error: "please provide valid ip and container id"})
 		return
 	}
+	containerID, err := ce.ResolveContainer(c.Request.Context(), ip, containerID)
+	if err != nil {
+		c.Error(err)
+		c.JSON(errorStatus(err), &Response{Error: err.Error()})
+		return
+	}
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		c.JSON(500, &Response{Error: "unable to upgrade the connection to ws"})
+		// the upgrader already answered the request
+		c.Error(err)
 		return
 	}
-	if err := ce.ExecIntoContainer(conn, ip, containerID); err != nil {
-		c.JSON(500, &Response{Error: fmt.Sprintf("got error %s", err)})
+	if !awaitApproval(c, conn, approval.Operation{Name: "container.exec", Host: ip, Container: containerID}) {
+		return
+	}
+	ctx, stop, err := startRecording(c, ip, containerID, "exec")
+	if err != nil {
+		sessionEnded(c, audit.OutcomeFailure, err)
+		conn.WriteMessage(websocket.TextMessage, []byte(err.Error()))
+		conn.Close()
 		return
 	}
+	defer stop()
+	if err := ce.ExecIntoContainer(ctx, conn, ip, containerID, terminalSize(c)); err != nil {
+		sessionEnded(c, audit.OutcomeFailure, err)
+		return
+	}
+	sessionEnded(c, audit.OutcomeSuccess, nil)
 }
 
 func streamContainerLogs(c *gin.Context) {
@@ -178,21 +289,27 @@ func streamContainerLogs(c *gin.Context) {
 		c.JSON(500, &Response{Error: "please provide valid ip and container id"})
 		return
 	}
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	containerID, err := ce.ResolveContainer(c.Request.Context(), ip, containerID)
 	if err != nil {
-		c.JSON(500, &Response{Error: "unable to upgrade the connection to ws"})
+		c.JSON(errorStatus(err), &Response{Error: err.Error()})
 		return
 	}
-	if err := ce.StreamContainerLogs(conn, ip, containerID); err != nil {
-		c.JSON(500, &Response{Error: fmt.Sprintf("got error %s", err)})
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// the upgrader already answered the request
+		c.Error(err)
 		return
 	}
+	if err := ce.StreamContainerLogs(c.Request.Context(), conn, ip, containerID, terminalSize(c)); err != nil {
+		c.Error(err)
+	}
 }
 
 func reloadConfig(c *gin.Context) {
 	err := ce.ReloadConfig()
 	response := &Response{Error: ""}
 	if err != nil {
+		c.Error(err)
 		response.Error = err.Error()
 		c.JSON(500, response)
 		return
@@ -200,7 +317,18 @@ func reloadConfig(c *gin.Context) {
 	c.JSON(200, response)
 }
 
+// updateConfig replaces the config, patchConfig merges the payload into it.
+// Both take the redacted config, placeholders left as they are keep the
+// secret they stand for.
 func updateConfig(c *gin.Context) {
+	writeConfig(c, ce.UpdateConfig)
+}
+
+func patchConfig(c *gin.Context) {
+	writeConfig(c, ce.PatchConfig)
+}
+
+func writeConfig(c *gin.Context, write func(data []byte) error) {
 	var ConfigData struct {
 		Config string `json:"config"`
 	}
@@ -209,8 +337,46 @@ func updateConfig(c *gin.Context) {
 		c.JSON(500, &Response{Error: err.Error()})
 		return
 	}
-	err = ce.UpdateConfig([]byte(ConfigData.Config))
+	if event := auditEvent(c); event != nil {
+		// the config holds secrets, only its hash is recorded
+		event.Command = fmt.Sprintf("update sha256:%x", sha256.Sum256([]byte(ConfigData.Config)))
+	}
+	err = write([]byte(ConfigData.Config))
 	if err != nil {
+		c.Error(err)
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	c.JSON(200, &Response{Error: ""})
+}
+
+func listHostKeys(c *gin.Context) {
+	c.JSON(200, &HostKeyListResponse{HostKeys: ce.ListHostKeys()})
+}
+
+func approveHostKey(c *gin.Context) {
+	host := c.Request.URL.Query().Get("host")
+	fingerprint := c.Request.URL.Query().Get("fingerprint")
+	if host == "" || fingerprint == "" {
+		c.JSON(500, &Response{Error: "Please provide both host and fingerprint"})
+		return
+	}
+	if err := ce.ApproveHostKey(host, fingerprint); err != nil {
+		c.Error(err)
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	c.JSON(200, &Response{Error: ""})
+}
+
+func revokeHostKey(c *gin.Context) {
+	host := c.Request.URL.Query().Get("host")
+	if host == "" {
+		c.JSON(500, &Response{Error: "Please provide valid host"})
+		return
+	}
+	if err := ce.RevokeHostKey(host); err != nil {
+		c.Error(err)
 		c.JSON(500, &Response{Error: err.Error()})
 		return
 	}
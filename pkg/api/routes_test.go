@@ -0,0 +1,197 @@
+package api
+
+import (
+	"crazydocker/pkg/audit"
+	"crazydocker/pkg/core"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestListMachines(t *testing.T) {
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), core.NewOnlineFakeHost()))
+	tests := []struct {
+		username string
+		machines int
+	}{
+		{username: "admin", machines: 1},
+		{username: "bob", machines: 1},
+		// machines without a role are not listed
+		{username: "carol", machines: 0},
+	}
+	for _, test := range tests {
+		var response MachineListResponse
+		if status := s.call(t, s.login(t, test.username), "GET", "/machines", nil, &response); status != 200 {
+			t.Fatalf("expected 200 for %s, got %d", test.username, status)
+		}
+		if len(response.Machines) != test.machines {
+			t.Fatalf("expected %d machines for %s, got %d", test.machines, test.username, len(response.Machines))
+		}
+	}
+	var response MachineListResponse
+	s.call(t, s.login(t, "admin"), "GET", "/machines", nil, &response)
+	if m := response.Machines[0]; m.Ip != "10.1.1.1" || m.HostName != "web-1" {
+		t.Fatalf("expected the probed machine, got %+v", m)
+	}
+}
+
+func TestListContainersAndImages(t *testing.T) {
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), core.NewOnlineFakeHost()))
+	client := s.login(t, "bob")
+	var containers ContainerListResponse
+	if status := s.call(t, client, "GET", "/containers?ip=10.1.1.1", nil, &containers); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, containers.Error)
+	}
+	if len(containers.Containers) != 1 || containers.Containers[0].ID != core.FakeContainerID {
+		t.Fatalf("expected the web container, got %+v", containers.Containers)
+	}
+	var images ImageListResponse
+	if status := s.call(t, client, "GET", "/images?ip=10.1.1.1", nil, &images); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, images.Error)
+	}
+	if len(images.Images) != 1 || images.Images[0].ID != core.FakeImageID {
+		t.Fatalf("expected the nginx image, got %+v", images.Images)
+	}
+	var response Response
+	if status := s.call(t, s.login(t, "carol"), "GET", "/containers?ip=10.1.1.1", nil, &response); status != 403 {
+		t.Fatalf("expected 403 without a role, got %d", status)
+	}
+	if status := s.call(t, s.login(t, "admin"), "GET", "/containers?ip=10.9.9.9", nil, &response); status != 400 {
+		t.Fatalf("expected 400 for an unknown host, got %d", status)
+	}
+}
+
+func TestRequiresSession(t *testing.T) {
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), core.NewOnlineFakeHost()))
+	var response Response
+	if status := s.call(t, http.DefaultClient, "GET", "/machines", nil, &response); status != 401 {
+		t.Fatalf("expected 401 without a session, got %d", status)
+	}
+	// the session cookie alone does not allow changes
+	client := s.login(t, "admin")
+	client.Transport = nil
+	if status := s.call(t, client, "POST", "/container/action?ip=10.1.1.1&containerID=web&action=stop", nil, &response); status != 403 {
+		t.Fatalf("expected 403 without the csrf token, got %d", status)
+	}
+}
+
+func TestContainerAction(t *testing.T) {
+	stop := fmt.Sprintf("docker 'stop' '%s'", core.FakeContainerID)
+	transport := core.NewOnlineFakeHost().On(stop, core.FakeContainerID+"\n", nil)
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), transport))
+	var response Response
+	if status := s.call(t, s.login(t, "admin"), "POST", "/container/action?ip=10.1.1.1&containerID=web&action=stop", nil, &response); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, response.Error)
+	}
+	commands := transport.Commands()
+	if commands[len(commands)-1] != stop {
+		t.Fatalf("expected %q to run, got %v", stop, commands)
+	}
+	event := s.lastEvent(t)
+	if event.User != "admin" || event.Action != "container.action" || event.Command != "stop" || event.Outcome != audit.OutcomeSuccess {
+		t.Fatalf("expected the stop to be audited, got %+v", event)
+	}
+	tests := []struct {
+		username string
+		action   string
+		status   int
+		outcome  string
+	}{
+		{username: "bob", action: "stop", status: 403, outcome: audit.OutcomeDenied},
+		{username: "admin", action: "rm%20-f", status: 400, outcome: audit.OutcomeFailure},
+	}
+	for _, test := range tests {
+		status := s.call(t, s.login(t, test.username), "POST", "/container/action?ip=10.1.1.1&containerID=web&action="+test.action, nil, &response)
+		if status != test.status {
+			t.Fatalf("expected %d for %s of %s, got %d", test.status, test.action, test.username, status)
+		}
+		if event := s.lastEvent(t); event.Outcome != test.outcome {
+			t.Fatalf("expected the %s of %s to be audited as %s, got %+v", test.action, test.username, test.outcome, event)
+		}
+	}
+}
+
+func TestCreateContainer(t *testing.T) {
+	transport := core.NewOnlineFakeHost().
+		On(fmt.Sprintf(`docker inspect '%s' --format "{{ index .RepoTags 0 }}"`, core.FakeImageID), "nginx:1.25\n", nil).
+		On("docker run -d '--name' 'api' 'nginx:1.25'", "c0ffee\n", nil)
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), transport))
+	client := s.login(t, "admin")
+	var response CreateContainerResponse
+	status := s.call(t, client, "POST", "/container/create", &CreateContainerPayload{Ip: "10.1.1.1", Image: "nginx:1.25", Args: "--name api"}, &response)
+	if status != 200 || response.Msg != "c0ffee" {
+		t.Fatalf("expected the id of the container, got %d %+v", status, response)
+	}
+	if event := s.lastEvent(t); event.Action != "container.create" || event.Command != "run --name api nginx:1.25" {
+		t.Fatalf("expected the create to be audited, got %+v", event)
+	}
+	status = s.call(t, client, "POST", "/container/create", &CreateContainerPayload{Ip: "10.1.1.1", Image: "nginx:1.25", Args: "--name api; reboot"}, &response)
+	if status != 400 {
+		t.Fatalf("expected 400 for an unknown option, got %d", status)
+	}
+	for _, network := range []string{"host", "container:" + core.FakeContainerID} {
+		status = s.call(t, client, "POST", "/container/create", &CreateContainerPayload{Ip: "10.1.1.1", Image: "nginx:1.25", Args: "--network " + network}, &response)
+		if status != 400 {
+			t.Fatalf("expected 400 for the %s network, got %d", network, status)
+		}
+	}
+	status = s.call(t, s.login(t, "bob"), "POST", "/container/create", &CreateContainerPayload{Ip: "10.1.1.1", Image: "nginx:1.25"}, &response)
+	if status != 403 {
+		t.Fatalf("expected 403 for a viewer, got %d", status)
+	}
+}
+
+func TestExecIntoContainer(t *testing.T) {
+	transport := core.NewOnlineFakeHost().On(fmt.Sprintf("docker exec -it '%s' sh", core.FakeContainerID), "/ # ", nil)
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), transport))
+	conn := s.dial(t, s.login(t, "admin"), "/container/exec?ip=10.1.1.1&containerID=web&cols=120&rows=40")
+	if out := readAll(conn); !strings.Contains(out, "/ # ") {
+		t.Fatalf("expected the prompt of the shell, got %q", out)
+	}
+	terminals := transport.Terminals()
+	if len(terminals) != 1 {
+		t.Fatalf("expected a terminal, got %d", len(terminals))
+	}
+	if size := terminals[0].Sizes()[0]; size.Cols != 120 || size.Rows != 40 {
+		t.Fatalf("expected the terminal to be opened with 120x40, got %+v", size)
+	}
+	if event := s.waitEvent(t, "container.exec"); event.User != "admin" || event.Outcome != audit.OutcomeSuccess {
+		t.Fatalf("expected the session to be audited, got %+v", event)
+	}
+}
+
+func TestExecIntoContainerFailure(t *testing.T) {
+	// the host does not answer the exec, the terminal can not be opened
+	s := newTestServer(t, testExecutor(t, hostConfig("10.1.1.1"), core.NewOnlineFakeHost()))
+	readAll(s.dial(t, s.login(t, "admin"), "/container/exec?ip=10.1.1.1&containerID=web"))
+	// gin only saw the upgrade, the outcome is the one of the session
+	event := s.waitEvent(t, "container.exec")
+	if event.Outcome != audit.OutcomeFailure || event.Status != 101 || !strings.Contains(event.Error, "docker exec") {
+		t.Fatalf("expected the failed session to be audited, got %+v", event)
+	}
+}
+
+func TestExecWithCancelledApproval(t *testing.T) {
+	config := "approval:\n  rules:\n    - operations: [container.exec]\n" + hostConfig("10.1.1.1")
+	s := newTestServer(t, testExecutor(t, config, core.NewOnlineFakeHost()))
+	admin := s.login(t, "admin")
+	conn := s.dial(t, admin, "/container/exec?ip=10.1.1.1&containerID=web")
+	if _, msg, err := conn.ReadMessage(); err != nil || !strings.Contains(string(msg), "waiting until") {
+		t.Fatalf("expected the session to wait for the approval, got %q %v", msg, err)
+	}
+	var list struct{ Approvals []struct{ ID string } }
+	if status := s.call(t, admin, "GET", "/approvals?status=pending", nil, &list); status != 200 || len(list.Approvals) != 1 {
+		t.Fatalf("expected the pending request, got %d %+v", status, list)
+	}
+	if status := s.call(t, admin, "POST", "/approvals/"+list.Approvals[0].ID+"/reject", nil, nil); status != 200 {
+		t.Fatalf("expected the requester to cancel the request, got %d", status)
+	}
+	if out := readAll(conn); !strings.Contains(out, "was cancelled") {
+		t.Fatalf("expected the session to end, got %q", out)
+	}
+	event := s.waitEvent(t, "container.exec")
+	if event.Outcome != audit.OutcomeDenied || event.Status != 101 || event.Approval != list.Approvals[0].ID {
+		t.Fatalf("expected the session to be denied, got %+v", event)
+	}
+}
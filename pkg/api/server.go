@@ -1,9 +1,16 @@
 package api
 
 import (
+	"context"
+	"crazydocker/pkg/approval"
+	"crazydocker/pkg/audit"
+	"crazydocker/pkg/auth"
 	"crazydocker/pkg/core"
+	"crazydocker/pkg/rbac"
+	"crazydocker/pkg/recording"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"time"
 
@@ -16,33 +23,183 @@ func Run() error {
 	if err != nil {
 		log.Fatal(err)
 	}
+	router, err := NewRouter(executor)
+	if err != nil {
+		return err
+	}
+	// the cleanup stops with the server
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cleanupRecordingsEvery(ctx, recordingCleanupInterval, executor, recordings)
+	addr := fmt.Sprintf(":%s", os.Getenv("API_SERVER_PORT"))
+	settings, err := TLSSettingsFromEnv()
+	if err != nil {
+		return err
+	}
+	if settings == nil {
+		return router.Run(addr)
+	}
+	tlsConfig, err := settings.TLSConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: addr, Handler: router, TLSConfig: tlsConfig}
+	log.Printf("serving https on %s\n", addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+// Option changes the defaults of the router
+type Option func(*routerOptions)
+
+type routerOptions struct {
+	users      *auth.Users
+	sessionTTL time.Duration
+	auditLog   *audit.Log
+	recordings *recording.Store
+	tokens     *auth.Tokens
+}
+
+// WithUsers uses the given users instead of the users file in the config
+// folder
+func WithUsers(u *auth.Users) Option {
+	return func(o *routerOptions) {
+		o.users = u
+	}
+}
+
+// WithAuditLog uses the given audit log instead of audit.log in the config
+// folder
+func WithAuditLog(l *audit.Log) Option {
+	return func(o *routerOptions) {
+		o.auditLog = l
+	}
+}
+
+// WithRecordings stores the session recordings in the given store instead of
+// the recordings folder in the config folder
+func WithRecordings(s *recording.Store) Option {
+	return func(o *routerOptions) {
+		o.recordings = s
+	}
+}
+
+// WithTokens uses the given api tokens instead of tokens.json in the config
+// folder
+func WithTokens(t *auth.Tokens) Option {
+	return func(o *routerOptions) {
+		o.tokens = t
+	}
+}
+
+// WithSessionTTL changes how long a login is valid
+func WithSessionTTL(ttl time.Duration) Option {
+	return func(o *routerOptions) {
+		o.sessionTTL = ttl
+	}
+}
+
+// NewRouter returns the api routes serving the executor
+func NewRouter(executor *core.CommandExecutor, opts ...Option) (*gin.Engine, error) {
+	options := &routerOptions{sessionTTL: auth.DefaultSessionTTL}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.users == nil {
+		u, err := auth.NewUsers(fmt.Sprintf("%s/users", os.Getenv("CONFIG_FOLDER")))
+		if err != nil {
+			return nil, err
+		}
+		options.users = u
+	}
+	if options.auditLog == nil {
+		l, err := audit.NewLog(fmt.Sprintf("%s/audit.log", os.Getenv("CONFIG_FOLDER")), audit.DefaultMaxSize, audit.DefaultMaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		options.auditLog = l
+	}
+	if options.recordings == nil {
+		s, err := recording.NewStore(fmt.Sprintf("%s/recordings", os.Getenv("CONFIG_FOLDER")))
+		if err != nil {
+			return nil, err
+		}
+		options.recordings = s
+	}
+	if options.tokens == nil {
+		t, err := auth.NewTokens(fmt.Sprintf("%s/tokens.json", os.Getenv("CONFIG_FOLDER")))
+		if err != nil {
+			return nil, err
+		}
+		options.tokens = t
+	}
 	ce = executor
+	loadEnvOrigins()
+	users = options.users
+	sessions = auth.NewSessions(options.sessionTTL)
+	auditLog = options.auditLog
+	recordings = options.recordings
+	// Run deletes them every hour from then on
+	cleanupRecordings(executor, recordings)
+	tokens = options.tokens
+	tickets = auth.NewTickets(auth.DefaultTicketTTL)
+	approvals = approval.NewStore()
 	router := gin.Default()
+	// the audit log records the address of the peer, forwarded headers are
+	// not trusted
+	router.SetTrustedProxies(nil)
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:  []string{"*"},
-		AllowMethods:  []string{"*"},
-		AllowHeaders:  []string{"Origin", "Content-Type"},
-		ExposeHeaders: []string{"Content-Length"},
-		AllowOriginFunc: func(origin string) bool {
-			return true
-		},
-		MaxAge: 12 * time.Hour,
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", csrfHeader},
+		ExposeHeaders:    []string{"Content-Length"},
+		AllowCredentials: true,
+		// requests of other origins are rejected with 403
+		AllowOriginFunc: originAllowed,
+		MaxAge:          12 * time.Hour,
 	}))
-	router.GET("/machines", listMachines)
-	router.GET("/containers", listContainers)
-	router.GET("/images", listImages)
-	router.GET("/container/action", performActionOnContainer)
-	router.GET("/container/stream", streamContainer)
-	router.GET("/image/stream", streamImage)
-	router.POST("/container/create", createContainer)
 	router.GET("/health", func(ctx *gin.Context) {
 		ctx.JSON(200, map[string]string{"status": "ok"})
 	})
-	router.GET("/machine/exec", execIntoMachine)
-	router.GET("/container/exec", execIntoContainer)
-	router.GET("/container/log", streamContainerLogs)
-	router.GET("/config", getConfig)
-	router.POST("/config/reload", reloadConfig)
-	router.POST("/config/update", updateConfig)
-	return router.Run(fmt.Sprintf(":%s", os.Getenv("API_SERVER_PORT")))
+	router.POST("/login", audited("login"), login)
+	router.GET("/login/options", loginOptions)
+	router.GET("/oidc/login", oidcLogin)
+	router.GET("/oidc/callback", audited("login.oidc"), oidcCallback)
+	// everything else requires a session or an api token, and the csrf token
+	// of the session for the requests changing something
+	authorized := router.Group("/", requireSession, requireCSRFToken)
+	authorized.POST("/logout", audited("logout"), logout)
+	authorized.GET("/me", me)
+	authorized.POST("/tickets", createTicket)
+	authorized.GET("/tokens", listTokens)
+	authorized.POST("/tokens", audited("token.create"), createToken)
+	authorized.DELETE("/tokens/:id", audited("token.revoke"), revokeToken)
+	authorized.GET("/machines", listMachines)
+	authorized.GET("/containers", requireHostRole(rbac.RoleViewer), listContainers)
+	authorized.GET("/images", requireHostRole(rbac.RoleViewer), listImages)
+	authorized.POST("/container/action", audited("container.action"), requireHostRole(rbac.RoleOperator), performActionOnContainer)
+	authorized.GET("/container/stream", requireHostRole(rbac.RoleViewer), streamContainer)
+	authorized.GET("/image/stream", requireHostRole(rbac.RoleViewer), streamImage)
+	// the host is part of the payload, the role is checked by the handler
+	authorized.POST("/container/create", audited("container.create"), createContainer)
+	authorized.GET("/machine/exec", audited("machine.exec"), requireHostRole(rbac.RoleAdmin), execIntoMachine)
+	authorized.GET("/container/exec", audited("container.exec"), requireHostRole(rbac.RoleOperator), execIntoContainer)
+	authorized.GET("/container/log", requireHostRole(rbac.RoleViewer), streamContainerLogs)
+	authorized.GET("/config", requireServerRole(rbac.RoleAdmin), getConfig)
+	authorized.POST("/config/reload", audited("config.reload"), requireServerRole(rbac.RoleAdmin), reloadConfig)
+	authorized.POST("/config/update", audited("config.update"), requireServerRole(rbac.RoleAdmin), updateConfig)
+	authorized.PUT("/config", audited("config.update"), requireServerRole(rbac.RoleAdmin), updateConfig)
+	authorized.PATCH("/config", audited("config.patch"), requireServerRole(rbac.RoleAdmin), patchConfig)
+	authorized.GET("/hostkeys", requireServerRole(rbac.RoleAdmin), listHostKeys)
+	authorized.POST("/hostkeys/approve", audited("hostkey.approve"), requireServerRole(rbac.RoleAdmin), approveHostKey)
+	authorized.POST("/hostkeys/revoke", audited("hostkey.revoke"), requireServerRole(rbac.RoleAdmin), revokeHostKey)
+	authorized.GET("/audit", requireServerRole(rbac.RoleAdmin), listAuditEvents)
+	// approval requests are listed to their requester and to the users who
+	// can decide them
+	authorized.GET("/approvals", listApprovals)
+	authorized.GET("/approvals/:id", getApproval)
+	authorized.POST("/approvals/:id/approve", audited("approval.approve"), approveRequest)
+	authorized.POST("/approvals/:id/reject", audited("approval.reject"), rejectRequest)
+	// recordings are filtered by the role on their host
+	authorized.GET("/recordings", listRecordings)
+	authorized.GET("/recordings/:id", audited("recording.play"), playRecording)
+	return router, nil
 }
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"crazydocker/pkg/core"
+	"crazydocker/pkg/sshtest"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// sshHost starts a fake docker host and an api server for it, the host is
+// reached over ssh with the password of the deploy user
+func sshHost(t *testing.T, c sshtest.Config, privilegeEscalation string) (*sshtest.Server, *testServer) {
+	t.Helper()
+	c.User, c.Password = "deploy", "secret"
+	host, err := sshtest.NewServer(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { host.Close() })
+	yaml := fmt.Sprintf("%sconfigList:\n  - sshConfig:\n      passwordAuth:\n        username: deploy\n        password: secret\n%s      hosts:\n        - address: %s\n          port: %d\n",
+		accessConfig, privilegeEscalation, host.Host(), host.Port())
+	return host, newTestServer(t, testExecutor(t, yaml, nil))
+}
+
+// ran tells whether the host ran the command
+func ran(host *sshtest.Server, cmd string) bool {
+	for _, c := range host.Commands() {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSSHList(t *testing.T) {
+	host, s := sshHost(t, sshtest.Config{}, "")
+	client := s.login(t, "bob")
+	var machines MachineListResponse
+	s.call(t, client, "GET", "/machines", nil, &machines)
+	if len(machines.Machines) != 1 {
+		t.Fatalf("expected the host, got %+v", machines.Machines)
+	}
+	if m := machines.Machines[0]; m.Ip != host.Addr() || m.Status != core.MachineOnline || m.Shell != "/bin/bash" {
+		t.Fatalf("expected %s to be online, got %+v", host.Addr(), m)
+	}
+	var containers ContainerListResponse
+	if status := s.call(t, client, "GET", "/containers?ip="+host.Addr(), nil, &containers); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, containers.Error)
+	}
+	if len(containers.Containers) != 2 || containers.Containers[0].ID != sshtest.WebContainerID {
+		t.Fatalf("expected the web and cache containers, got %+v", containers.Containers)
+	}
+	var images ImageListResponse
+	if status := s.call(t, client, "GET", "/images?ip="+host.Addr(), nil, &images); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, images.Error)
+	}
+	if len(images.Images) != 2 || images.Images[0].ID != sshtest.NginxImageID {
+		t.Fatalf("expected the nginx and redis images, got %+v", images.Images)
+	}
+}
+
+func TestSSHContainerAction(t *testing.T) {
+	host, s := sshHost(t, sshtest.Config{}, "")
+	client := s.login(t, "admin")
+	var response Response
+	if status := s.call(t, client, "POST", "/container/action?ip="+host.Addr()+"&containerID=web&action=restart", nil, &response); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, response.Error)
+	}
+	if restart := fmt.Sprintf("docker 'restart' '%s'", sshtest.WebContainerID); !ran(host, restart) {
+		t.Fatalf("expected %q to run, got %v", restart, host.Commands())
+	}
+	if status := s.call(t, client, "POST", "/container/action?ip="+host.Addr()+"&containerID=db&action=stop", nil, &response); status != 400 {
+		t.Fatalf("expected 400 for an unknown container, got %d", status)
+	}
+}
+
+func TestSSHCreateContainer(t *testing.T) {
+	host, s := sshHost(t, sshtest.Config{}, "")
+	var response CreateContainerResponse
+	status := s.call(t, s.login(t, "admin"), "POST", "/container/create", &CreateContainerPayload{Ip: host.Addr(), Image: "nginx:1.25", Args: "--name api -p 8080:80 -e MODE=prod"}, &response)
+	if status != 200 || response.Msg != sshtest.CreatedContainerID {
+		t.Fatalf("expected the id of the container, got %d %+v", status, response)
+	}
+	if run := "docker run -d '--name' 'api' '-p' '8080:80' '-e' 'MODE=prod' 'nginx:1.25'"; !ran(host, run) {
+		t.Fatalf("expected %q to run, got %v", run, host.Commands())
+	}
+}
+
+func TestSSHExec(t *testing.T) {
+	host, s := sshHost(t, sshtest.Config{}, "")
+	conn := s.dial(t, s.login(t, "admin"), "/container/exec?ip="+host.Addr()+"&containerID=web&cols=100&rows=30")
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ls\rexit\r")); err != nil {
+		t.Fatal(err)
+	}
+	out := readAll(conn)
+	if !strings.Contains(out, "$ ls\r\nls\r\n") {
+		t.Fatalf("expected the shell to echo ls, got %q", out)
+	}
+	s.waitEvent(t, "container.exec")
+	if resizes := host.Resizes(); len(resizes) != 0 {
+		t.Fatalf("expected the terminal to keep its size, got %v", resizes)
+	}
+}
+
+const sudoConfig = "      privilegeEscalation:\n        sudo: true\n        sudoPassword: env:TEST_SUDO_PASSWORD\n"
+
+func TestSSHSudo(t *testing.T) {
+	t.Setenv("TEST_SUDO_PASSWORD", "sudo-secret")
+	host, s := sshHost(t, sshtest.Config{SudoPassword: "sudo-secret"}, sudoConfig)
+	client := s.login(t, "admin")
+	var containers ContainerListResponse
+	if status := s.call(t, client, "GET", "/containers?ip="+host.Addr(), nil, &containers); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, containers.Error)
+	}
+	if len(containers.Containers) != 2 {
+		t.Fatalf("expected the containers listed through sudo, got %+v", containers.Containers)
+	}
+	var response Response
+	if status := s.call(t, client, "POST", "/container/action?ip="+host.Addr()+"&containerID=cache&action=stop", nil, &response); status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, response.Error)
+	}
+	for _, cmd := range host.Commands() {
+		if strings.HasPrefix(cmd, "docker") {
+			t.Fatalf("expected docker to run through sudo, got %q", cmd)
+		}
+	}
+	// the prompt of sudo must not end up in the output
+	if stop := fmt.Sprintf("sudo -S -p '' docker 'stop' '%s'", sshtest.CacheContainerID); !ran(host, stop) {
+		t.Fatalf("expected %q to run, got %v", stop, host.Commands())
+	}
+}
+
+func TestSSHSudoWrongPassword(t *testing.T) {
+	t.Setenv("TEST_SUDO_PASSWORD", "wrong")
+	host, s := sshHost(t, sshtest.Config{SudoPassword: "sudo-secret"}, sudoConfig)
+	var containers ContainerListResponse
+	status := s.call(t, s.login(t, "admin"), "GET", "/containers?ip="+host.Addr(), nil, &containers)
+	if status != 500 || containers.Error == "" || len(containers.Containers) != 0 {
+		t.Fatalf("expected sudo to refuse the password, got %d %+v", status, containers)
+	}
+}
+
+func TestSSHSudoExec(t *testing.T) {
+	t.Setenv("TEST_SUDO_PASSWORD", "sudo-secret")
+	host, s := sshHost(t, sshtest.Config{SudoPassword: "sudo-secret"}, sudoConfig)
+	conn := s.dial(t, s.login(t, "admin"), "/container/exec?ip="+host.Addr()+"&containerID=web")
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("id\rexit\r")); err != nil {
+		t.Fatal(err)
+	}
+	out := readAll(conn)
+	if !strings.Contains(out, "$ id\r\nid\r\n") {
+		t.Fatalf("expected the shell of the container, got %q", out)
+	}
+	// sudo gets the password from the askpass helper, not from the pty
+	if strings.Contains(out, "sudo-secret") {
+		t.Fatalf("expected the password to stay out of the terminal, got %q", out)
+	}
+	s.waitEvent(t, "container.exec")
+	exec := fmt.Sprintf("sudo -A docker exec -it '%s' sh", sshtest.WebContainerID)
+	found := false
+	for _, cmd := range host.Commands() {
+		found = found || (strings.HasPrefix(cmd, "SUDO_ASKPASS=") && strings.HasSuffix(cmd, exec))
+	}
+	if !found {
+		t.Fatalf("expected the exec to use the askpass helper, got %v", host.Commands())
+	}
+	if helpers := host.AskpassHelpers(); len(helpers) != 0 {
+		t.Fatalf("expected the askpass helper to be removed, got %v", helpers)
+	}
+}
+
+func TestSSHSudoExecWithoutPassword(t *testing.T) {
+	// sudo does not need a password, the helper is removed after the session
+	t.Setenv("TEST_SUDO_PASSWORD", "unused")
+	host, s := sshHost(t, sshtest.Config{}, sudoConfig)
+	conn := s.dial(t, s.login(t, "admin"), "/container/exec?ip="+host.Addr()+"&containerID=web")
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("exit\r")); err != nil {
+		t.Fatal(err)
+	}
+	readAll(conn)
+	s.waitEvent(t, "container.exec")
+	if helpers := host.AskpassHelpers(); len(helpers) != 0 {
+		t.Fatalf("expected the unused askpass helper to be removed, got %v", helpers)
+	}
+}
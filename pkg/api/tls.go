@@ -0,0 +1,247 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the files are checked for changes at most this often
+const tlsReloadInterval = 10 * time.Second
+
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// TLSSettings configure https, they are read from the environment by
+// TLSSettingsFromEnv
+type TLSSettings struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile enables client certificates signed by the CA
+	ClientCAFile string
+	// ClientCertOptional accepts clients without a certificate, they have to
+	// log in
+	ClientCertOptional bool
+	// SelfSigned generates a certificate when CertFile does not exist
+	SelfSigned bool
+}
+
+// configPath returns the path relative to the config folder
+func configPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(os.Getenv("CONFIG_FOLDER"), path)
+}
+
+// TLSSettingsFromEnv reads the TLS_* variables, nil is returned when https is
+// not enabled
+func TLSSettingsFromEnv() (*TLSSettings, error) {
+	s := &TLSSettings{
+		CertFile:     configPath(os.Getenv("TLS_CERT_FILE")),
+		KeyFile:      configPath(os.Getenv("TLS_KEY_FILE")),
+		ClientCAFile: configPath(os.Getenv("TLS_CLIENT_CA_FILE")),
+		SelfSigned:   os.Getenv("TLS_SELF_SIGNED") == "true",
+	}
+	switch os.Getenv("TLS_CLIENT_AUTH") {
+	case "", "require":
+	case "optional":
+		s.ClientCertOptional = true
+	default:
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH has to be require or optional, got %q", os.Getenv("TLS_CLIENT_AUTH"))
+	}
+	if s.SelfSigned && s.CertFile == "" && s.KeyFile == "" {
+		s.CertFile = configPath("tls/server.crt")
+		s.KeyFile = configPath("tls/server.key")
+	}
+	if s.CertFile == "" && s.KeyFile == "" {
+		if s.ClientCAFile != "" {
+			return nil, errors.New("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE or TLS_SELF_SIGNED")
+		}
+		return nil, nil
+	}
+	if s.CertFile == "" || s.KeyFile == "" {
+		return nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE have to be set together")
+	}
+	return s, nil
+}
+
+// TLSConfig returns the server config, the certificate and the client CA are
+// reloaded once their files change
+func (s *TLSSettings) TLSConfig() (*tls.Config, error) {
+	if s.SelfSigned {
+		if _, err := os.Stat(s.CertFile); errors.Is(err, os.ErrNotExist) {
+			if err := generateSelfSigned(s.CertFile, s.KeyFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+	r := &tlsReloader{settings: s}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, clientCAs := r.get()
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.Certificates = []tls.Certificate{*cert}
+		if clientCAs != nil {
+			c.ClientCAs = clientCAs
+			c.ClientAuth = tls.RequireAndVerifyClientCert
+			if s.ClientCertOptional {
+				c.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+		}
+		return c, nil
+	}
+	return config, nil
+}
+
+// tlsReloader keeps the certificate and the client CA of the files, they
+// are loaded again once the files change
+type tlsReloader struct {
+	settings  *TLSSettings
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTime   time.Time
+	checked   time.Time
+}
+
+// filesModTime returns the time of the last change of the files
+func (r *tlsReloader) filesModTime() (time.Time, error) {
+	latest := time.Time{}
+	for _, path := range []string{r.settings.CertFile, r.settings.KeyFile, r.settings.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the files, the caller must hold the lock unless the reloader
+// is not shared yet
+func (r *tlsReloader) load() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.settings.CertFile, r.settings.KeyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if r.settings.ClientCAFile != "" {
+		data, err := os.ReadFile(r.settings.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in %s", r.settings.ClientCAFile)
+		}
+	}
+	r.cert, r.clientCAs, r.modTime, r.checked = &cert, clientCAs, modTime, time.Now()
+	return nil
+}
+
+// get returns the current certificate and client CA, files changed since
+// they were loaded are loaded again. Files which can not be loaded, for
+// example while they are being replaced, keep the previous ones in use.
+func (r *tlsReloader) get() (*tls.Certificate, *x509.CertPool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.checked) >= tlsReloadInterval {
+		r.checked = time.Now()
+		if modTime, err := r.filesModTime(); err == nil && modTime.After(r.modTime) {
+			if err := r.load(); err != nil {
+				log.Printf("unable to reload the tls certificate :%s\n", err)
+			} else {
+				log.Println("reloaded the tls certificate")
+			}
+		}
+	}
+	return r.cert, r.clientCAs
+}
+
+// generateSelfSigned writes a self signed certificate for the names of this
+// host, it is meant for the first setup until a real certificate is in place
+func generateSelfSigned(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1], Organization: []string{"docker frenzy self signed"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certFile), 0700); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+	fingerprint := sha256.Sum256(der)
+	log.Printf("generated a self signed certificate for %s in %s, sha256 fingerprint %s\n",
+		strings.Join(names, ", "), certFile, formatFingerprint(fingerprint[:]))
+	return nil
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := []string{}
+	for _, b := range sum {
+		parts = append(parts, fmt.Sprintf("%02X", b))
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"crazydocker/pkg/auth"
+	"crazydocker/pkg/core"
+	"crazydocker/pkg/rbac"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenKey is set to the api token of the requests made with one
+const tokenKey = "token"
+
+// actions api tokens can be limited to, on top of the container actions
+const (
+	tokenActionRead   = "read"
+	tokenActionCreate = "create"
+	tokenActionExec   = "exec"
+)
+
+var tokens *auth.Tokens
+var tickets *auth.Tickets
+
+// tokenScopes are the routes api tokens can use and the action the token
+// has to allow for them, an empty action is allowed to every token. The
+// other routes, managing the server and the tokens themselves, are for
+// people only.
+var tokenScopes = map[string]func(c *gin.Context) string{
+	"GET /me":                tokenAction(""),
+	"POST /tickets":          tokenAction(""),
+	"GET /approvals":         tokenAction(""),
+	"GET /approvals/:id":     tokenAction(""),
+	"GET /machines":          tokenAction(tokenActionRead),
+	"GET /containers":        tokenAction(tokenActionRead),
+	"GET /images":            tokenAction(tokenActionRead),
+	"GET /container/stream":  tokenAction(tokenActionRead),
+	"GET /image/stream":      tokenAction(tokenActionRead),
+	"GET /container/log":     tokenAction(tokenActionRead),
+	"POST /container/create": tokenAction(tokenActionCreate),
+	"GET /container/exec":    tokenAction(tokenActionExec),
+	"POST /container/action": func(c *gin.Context) string {
+		return c.Request.URL.Query().Get("action")
+	},
+}
+
+func tokenAction(action string) func(c *gin.Context) string {
+	return func(c *gin.Context) string {
+		return action
+	}
+}
+
+// validTokenAction tells whether tokens can be limited to the action
+func validTokenAction(action string) bool {
+	switch action {
+	case tokenActionRead, tokenActionCreate, tokenActionExec:
+		return true
+	}
+	_, err := core.ParseContainerAction(action)
+	return err == nil
+}
+
+// bearerToken returns the api token of the Authorization header, ok is false
+// when the header is not set
+func bearerToken(c *gin.Context) (value string, ok bool) {
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		return "", false
+	}
+	value, _ = strings.CutPrefix(header, "Bearer ")
+	return value, true
+}
+
+// useToken authenticates the request as the user of the api token when the
+// token allows the route
+func useToken(c *gin.Context, token *auth.APIToken) {
+	c.Set(userKey, token.Owner())
+	c.Set(tokenKey, token)
+	scope, ok := tokenScopes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		c.AbortWithStatusJSON(403, &Response{Error: fmt.Sprintf("api tokens can not use %s", c.FullPath())})
+		return
+	}
+	if action := scope(c); action != "" && !token.AllowsAction(action) {
+		c.AbortWithStatusJSON(403, &Response{Error: fmt.Sprintf("the api token does not allow %s", action)})
+		return
+	}
+	c.Next()
+}
+
+// requestToken returns the api token of the request, it is nil for sessions
+func requestToken(c *gin.Context) *auth.APIToken {
+	token, ok := c.Get(tokenKey)
+	if !ok {
+		return nil
+	}
+	return token.(*auth.APIToken)
+}
+
+// role returns the role of the user of the request on the host, or on the
+// server when host is empty. Api tokens have no role on the server and none
+// on the hosts they are not for.
+func role(c *gin.Context, host string) rbac.Role {
+	user := currentUser(c)
+	if token := requestToken(c); token != nil {
+		if host == "" || !token.AllowsHost(host) {
+			return rbac.RoleNone
+		}
+	}
+	if host == "" {
+		return ce.GlobalRole(user.Username, user.Groups...)
+	}
+	return ce.Role(user.Username, host, user.Groups...)
+}
+
+func createToken(c *gin.Context) {
+	var payload *TokenPayload
+	if err := c.ShouldBindJSON(&payload); err != nil {
+		c.JSON(400, &TokenResponse{Response: Response{Error: err.Error()}})
+		return
+	}
+	user := currentUser(c)
+	token := auth.APIToken{
+		Name:    payload.Name,
+		User:    user.Username,
+		Groups:  user.Groups,
+		OIDC:    user.OIDC,
+		Hosts:   payload.Hosts,
+		Actions: payload.Actions,
+	}
+	if err := validateToken(&token, user, payload.ExpiresIn); err != nil {
+		c.Error(err)
+		c.JSON(400, &TokenResponse{Response: Response{Error: err.Error()}})
+		return
+	}
+	secret, token, err := tokens.Create(token)
+	if err != nil {
+		c.Error(err)
+		c.JSON(500, &TokenResponse{Response: Response{Error: err.Error()}})
+		return
+	}
+	if event := auditEvent(c); event != nil {
+		event.Token = token.ID
+	}
+	c.JSON(200, &TokenResponse{Token: &token, Secret: secret})
+}
+
+// validateToken checks the hosts and actions of a new token, tokens are only
+// given out for hosts the user has a role on
+func validateToken(token *auth.APIToken, user auth.User, expiresIn string) error {
+	if len(token.Hosts) == 0 {
+		return errors.New("the token needs at least one host")
+	}
+	for _, host := range token.Hosts {
+		if err := ce.CheckHost(host); err != nil {
+			return err
+		}
+		if !ce.Role(user.Username, host, user.Groups...).Allows(rbac.RoleViewer) {
+			return fmt.Errorf("you have no role on %s", host)
+		}
+	}
+	if len(token.Actions) == 0 {
+		return errors.New("the token needs at least one action")
+	}
+	for _, action := range token.Actions {
+		if !validTokenAction(action) {
+			return fmt.Errorf("unknown action %q, expected read, create, exec or a container action", action)
+		}
+	}
+	if expiresIn != "" {
+		ttl, err := time.ParseDuration(expiresIn)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("expiresIn has to be a positive duration like 720h, got %q", expiresIn)
+		}
+		token.Expires = time.Now().Add(ttl)
+	}
+	if user.OIDC {
+		// the token would keep the user around after the identity provider
+		// stopped vouching for it
+		if token.Expires.IsZero() {
+			token.Expires = user.Expires
+		}
+		if token.Expires.After(user.Expires) {
+			return fmt.Errorf("the token can not outlive your sign in, it ends at %s", user.Expires.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// listTokens returns the tokens of the user, server admins get every token
+func listTokens(c *gin.Context) {
+	username := currentUser(c).Username
+	if role(c, "").Allows(rbac.RoleAdmin) {
+		username = ""
+	}
+	c.JSON(200, &TokenListResponse{Tokens: tokens.List(username)})
+}
+
+// revokeToken deletes a token of the user, server admins can revoke every
+// token
+func revokeToken(c *gin.Context) {
+	id := c.Param("id")
+	if event := auditEvent(c); event != nil {
+		event.Token = id
+	}
+	token, err := tokens.Get(id)
+	if err != nil {
+		c.Error(err)
+		c.JSON(404, &Response{Error: err.Error()})
+		return
+	}
+	username := currentUser(c).Username
+	if token.User != username && !authorize(c, "", rbac.RoleAdmin) {
+		return
+	}
+	if err := tokens.Delete(id); err != nil {
+		c.Error(err)
+		if errors.Is(err, auth.ErrTokenNotFound) {
+			c.JSON(404, &Response{Error: err.Error()})
+			return
+		}
+		c.JSON(500, &Response{Error: err.Error()})
+		return
+	}
+	c.JSON(200, &Response{Error: ""})
+}
+
+// createTicket returns a ticket for a websocket, it is passed as the ticket
+// query param since browsers can not set headers on websockets
+func createTicket(c *gin.Context) {
+	ticket, expires, err := tickets.Create(currentUser(c), requestToken(c))
+	if err != nil {
+		c.JSON(500, &TicketResponse{Response: Response{Error: err.Error()}})
+		return
+	}
+	c.JSON(200, &TicketResponse{Ticket: ticket, Expires: expires})
+}
+
+// redeemTicket authenticates a websocket upgrade with its ticket, tickets of
+// api tokens are only valid as long as the token
+func redeemTicket(c *gin.Context, value string) {
+	user, token, ok := tickets.Redeem(value)
+	if ok && token != nil {
+		current, err := tokens.Get(token.ID)
+		ok = err == nil && !current.Expired()
+		token = &current
+	}
+	if !ok || !userActive(user) {
+		c.AbortWithStatusJSON(401, &Response{Error: "invalid or expired ticket"})
+		return
+	}
+	if token != nil {
+		useToken(c, token)
+		return
+	}
+	c.Set(userKey, user)
+	c.Next()
+}
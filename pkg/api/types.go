@@ -1,9 +1,16 @@
 package api
 
 import (
+	"crazydocker/pkg/approval"
+	"crazydocker/pkg/audit"
+	"crazydocker/pkg/auth"
 	"crazydocker/pkg/core"
+	"crazydocker/pkg/rbac"
+	"crazydocker/pkg/recording"
+	"time"
 
-	"docker.io/go-docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
 )
 
 type Response struct {
@@ -27,12 +34,12 @@ type ImageListResponse struct {
 
 type ContainerResponse struct {
 	Response
-	Container *types.ContainerJSON
+	Container *container.InspectResponse
 }
 
 type ImageResponse struct {
 	Response
-	Image *types.ImageInspect
+	Image *image.InspectResponse
 }
 
 type ConfigResponse struct {
@@ -50,3 +57,89 @@ type CreateContainerResponse struct {
 	Response
 	Msg string
 }
+
+type HostKeyListResponse struct {
+	Response
+	HostKeys []core.HostKey
+}
+
+type LoginPayload struct {
+	Username string
+	Password string
+}
+
+// LoginOptionsResponse tells the login page how users can sign in
+type LoginOptionsResponse struct {
+	Response
+	OIDC bool
+}
+
+type UserResponse struct {
+	Response
+	User *auth.User
+	// Role is the role of the user on every host and on the server
+	Role rbac.Role
+	// CSRFToken has to be sent as X-CSRF-Token with the requests changing
+	// something
+	CSRFToken string
+}
+
+// ForbiddenResponse is returned with 403 when the role of the user does not
+// allow the request, Host is empty for the routes managing the server
+type ForbiddenResponse struct {
+	Response
+	Required rbac.Role
+	Role     rbac.Role
+	Host     string
+}
+
+type AuditResponse struct {
+	Response
+	Events []audit.Event
+}
+
+type RecordingListResponse struct {
+	Response
+	Recordings []recording.Meta
+}
+
+type TokenPayload struct {
+	Name    string
+	Hosts   []string
+	Actions []string
+	// ExpiresIn is a duration like 720h, tokens without it do not expire.
+	// Tokens of users signed in with OIDC expire with the sign in.
+	ExpiresIn string
+}
+
+type TokenResponse struct {
+	Response
+	Token *auth.APIToken
+	// Secret is the token itself, it is only returned when the token is
+	// created
+	Secret string
+}
+
+type TokenListResponse struct {
+	Response
+	Tokens []auth.APIToken
+}
+
+type TicketResponse struct {
+	Response
+	Ticket  string
+	Expires time.Time
+}
+
+// ApprovalResponse is returned with 202 when an operation waits for an
+// approval, Msg is the output of an approved container create
+type ApprovalResponse struct {
+	Response
+	Approval *approval.Request
+	Msg      string
+}
+
+type ApprovalListResponse struct {
+	Response
+	Approvals []approval.Request
+}
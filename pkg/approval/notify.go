@@ -0,0 +1,50 @@
+package approval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// notification is posted to the webhook, text is what chat webhooks show
+type notification struct {
+	Text     string  `json:"text"`
+	Approval Request `json:"approval"`
+}
+
+// Summary describes the request in a sentence
+func (r Request) Summary() string {
+	target := r.Host
+	if r.Container != "" {
+		target = fmt.Sprintf("%s on %s", r.Container, r.Host)
+	}
+	if r.Image != "" {
+		target = fmt.Sprintf("%s on %s", r.Image, r.Host)
+	}
+	return fmt.Sprintf("%s asks to run %s for %s, request %s needs the approval of a user with the %s role before %s",
+		r.Requester, r.Name, target, r.ID, r.ApproverRole, r.Expires.Format("15:04:05 MST"))
+}
+
+// Notify posts the request to the webhook as JSON
+func Notify(ctx context.Context, webhook string, r Request) error {
+	data, err := json.Marshal(&notification{Text: r.Summary(), Approval: r})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the webhook returned %s", resp.Status)
+	}
+	return nil
+}
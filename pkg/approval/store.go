@@ -0,0 +1,222 @@
+// Package approval keeps the operations which wait until a second user
+// approves them.
+package approval
+
+import (
+	"context"
+	"crazydocker/pkg/auth"
+	"crazydocker/pkg/rbac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// decided requests are kept this long so that their outcome can be looked up
+const keepDecided = 24 * time.Hour
+
+var ErrNotFound = errors.New("approval request not found")
+var ErrNotPending = errors.New("the approval request was already decided or expired")
+var ErrSelfApproval = errors.New("approval requests have to be approved by another user")
+
+type Status string
+
+const (
+	StatusPending  Status = "pending"
+	StatusApproved Status = "approved"
+	StatusRejected Status = "rejected"
+	// StatusCancelled is set when the requester gave up the request
+	StatusCancelled Status = "cancelled"
+	StatusExpired   Status = "expired"
+)
+
+// Operation is what waits for the approval
+type Operation struct {
+	// Name is container.<action>, container.create, container.exec or
+	// machine.exec
+	Name      string
+	Host      string
+	Container string `json:",omitempty"`
+	// Image and Args are the docker run of container.create
+	Image string `json:",omitempty"`
+	Args  string `json:",omitempty"`
+}
+
+// Request is an operation waiting for, or done waiting for, an approval
+type Request struct {
+	ID string
+	Operation
+	Requester string
+	// Owner is the requester with its groups and sign in when the request
+	// was made, its role is checked again before the operation runs
+	Owner auth.User `json:"-"`
+	// Token is the id of the api token the operation was asked with
+	Token string `json:",omitempty"`
+	// ApproverRole is the role the approver needs on the host
+	ApproverRole rbac.Role
+	Status       Status
+	Created      time.Time
+	Expires      time.Time
+	// Approver is who approved or rejected the request
+	Approver string     `json:",omitempty"`
+	Decided  *time.Time `json:",omitempty"`
+	// Error is set when the operation failed once approved
+	Error string `json:",omitempty"`
+}
+
+type entry struct {
+	Request
+	// done is closed once the request is no longer pending
+	done  chan struct{}
+	timer *time.Timer
+}
+
+// Store keeps the requests in memory, pending operations do not survive a
+// restart
+type Store struct {
+	lock     sync.Mutex
+	requests map[string]*entry
+}
+
+func NewStore() *Store {
+	return &Store{requests: map[string]*entry{}}
+}
+
+// Create parks the operation until it is decided or ttl passes
+func (s *Store) Create(op Operation, requester auth.User, token string, approverRole rbac.Role, ttl time.Duration) (Request, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Request{}, err
+	}
+	now := time.Now()
+	e := &entry{
+		Request: Request{
+			ID:           hex.EncodeToString(id),
+			Operation:    op,
+			Requester:    requester.Username,
+			Owner:        requester,
+			Token:        token,
+			ApproverRole: approverRole,
+			Status:       StatusPending,
+			Created:      now,
+			Expires:      now.Add(ttl),
+		},
+		done: make(chan struct{}),
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key, old := range s.requests {
+		if old.Decided != nil && now.Sub(*old.Decided) > keepDecided {
+			delete(s.requests, key)
+		}
+	}
+	s.requests[e.ID] = e
+	e.timer = time.AfterFunc(ttl, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.decide(e, StatusExpired, "")
+	})
+	return e.Request, nil
+}
+
+// decide ends a pending request, the caller must hold the lock
+func (s *Store) decide(e *entry, status Status, user string) {
+	if e.Status != StatusPending {
+		return
+	}
+	now := time.Now()
+	e.Status = status
+	e.Approver = user
+	e.Decided = &now
+	e.timer.Stop()
+	close(e.done)
+}
+
+// Get returns the request with the id
+func (s *Store) Get(id string) (Request, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.requests[id]
+	if !ok {
+		return Request{}, ErrNotFound
+	}
+	return e.Request, nil
+}
+
+// List returns every request, the newest first
+func (s *Store) List() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	found := []Request{}
+	for _, e := range s.requests {
+		found = append(found, e.Request)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Created.After(found[j].Created) })
+	return found
+}
+
+// Approve lets the operation of the request run, the requester can not
+// approve its own requests
+func (s *Store) Approve(id string, approver string) (Request, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.requests[id]
+	if !ok {
+		return Request{}, ErrNotFound
+	}
+	if e.Requester == approver {
+		return e.Request, ErrSelfApproval
+	}
+	if e.Status != StatusPending {
+		return e.Request, ErrNotPending
+	}
+	s.decide(e, StatusApproved, approver)
+	return e.Request, nil
+}
+
+// Reject drops the request, it is cancelled when the requester rejects it
+func (s *Store) Reject(id string, user string) (Request, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.requests[id]
+	if !ok {
+		return Request{}, ErrNotFound
+	}
+	if e.Status != StatusPending {
+		return e.Request, ErrNotPending
+	}
+	status := StatusRejected
+	if e.Requester == user {
+		status = StatusCancelled
+	}
+	s.decide(e, status, user)
+	return e.Request, nil
+}
+
+// SetError records that the approved operation failed
+func (s *Store) SetError(id string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if e, ok := s.requests[id]; ok {
+		e.Error = err.Error()
+	}
+}
+
+// Wait blocks until the request is no longer pending, the error of the
+// context is returned when it ends first
+func (s *Store) Wait(ctx context.Context, id string) (Request, error) {
+	s.lock.Lock()
+	e, ok := s.requests[id]
+	s.lock.Unlock()
+	if !ok {
+		return Request{}, ErrNotFound
+	}
+	select {
+	case <-e.done:
+		return s.Get(id)
+	case <-ctx.Done():
+		return Request{}, ctx.Err()
+	}
+}
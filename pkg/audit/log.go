@@ -0,0 +1,238 @@
+// Package audit records who did what on which host in an append only JSON
+// lines file.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultMaxSize = 10 * 1024 * 1024
+const DefaultMaxFiles = 5
+
+// outcomes of an event
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeDenied is recorded when the user was not allowed to do it
+	OutcomeDenied = "denied"
+	// OutcomePending is recorded when the operation waits for an approval
+	OutcomePending = "pending"
+)
+
+// Event is a line of the audit log
+type Event struct {
+	Time     time.Time
+	Duration time.Duration
+	User     string
+	ClientIP string
+	// Action is what was done, for example container.action or machine.exec
+	Action    string
+	Host      string `json:",omitempty"`
+	Container string `json:",omitempty"`
+	Command   string `json:",omitempty"`
+	Outcome   string
+	Status    int
+	Error     string `json:",omitempty"`
+	// Recording is the id of the recording of an exec session
+	Recording string `json:",omitempty"`
+	// Token is the id of the api token the request was made with, or of the
+	// token created or revoked
+	Token string `json:",omitempty"`
+	// Approval is the id of the approval request the operation waited for,
+	// Approver is who approved or rejected it
+	Approval string `json:",omitempty"`
+	Approver string `json:",omitempty"`
+}
+
+// Filter selects events, empty fields match everything
+type Filter struct {
+	Host  string
+	User  string
+	Since time.Time
+	Until time.Time
+	// Limit is the number of events returned, the newest first
+	Limit int
+}
+
+func (f Filter) match(e *Event) bool {
+	if f.Host != "" && e.Host != f.Host {
+		return false
+	}
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// Log appends events to a file and rotates it once it grows over maxSize,
+// the rotated files are kept as path.1 (the newest) up to path.maxFiles
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+func NewLog(path string, maxSize int64, maxFiles int) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file for appending, the caller must hold the lock
+// unless the log is not shared yet
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file to path.1, shifting the older ones and
+// dropping the oldest, the caller must hold the lock
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(l.rotated(l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// Record appends the event to the log
+func (l *Log) Record(e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// Query returns the events matching the filter, the newest first. The files
+// are opened under the lock and read without it, a long query does not hold
+// back the events being recorded and rotations do not move the files it reads.
+func (l *Log) Query(f Filter) ([]Event, error) {
+	sections, files, err := l.snapshot()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+	events := []Event{}
+	for _, section := range sections {
+		scanner := bufio.NewScanner(section)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e Event
+			// lines cut short by a crash are skipped
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue
+			}
+			if f.match(&e) {
+				events = append(events, e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if f.Limit > 0 && len(events) > f.Limit {
+		events = events[:f.Limit]
+	}
+	return events, nil
+}
+
+// snapshot opens the current and the rotated files, the current one is only
+// read up to the events written so far
+func (l *Log) snapshot() ([]*io.SectionReader, []*os.File, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	sections := []*io.SectionReader{}
+	files := []*os.File{}
+	paths := []string{l.path}
+	for i := 1; i <= l.maxFiles; i++ {
+		paths = append(paths, l.rotated(i))
+	}
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, files, err
+		}
+		files = append(files, file)
+		size := l.size
+		if i > 0 {
+			info, err := file.Stat()
+			if err != nil {
+				return nil, files, err
+			}
+			size = info.Size()
+		}
+		sections = append(sections, io.NewSectionReader(file, 0, size))
+	}
+	return sections, files, nil
+}
+
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
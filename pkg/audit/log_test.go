@@ -0,0 +1,67 @@
+package audit
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueryWhileRecording(t *testing.T) {
+	// a few events per file, the log rotates while it is queried
+	l, err := NewLog(filepath.Join(t.TempDir(), "audit.log"), 1024, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	start := time.Now()
+	const count = 200
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			if err := l.Record(Event{Time: start.Add(time.Duration(i)), User: fmt.Sprintf("user-%d", i), Action: "container.action"}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for done := false; !done; {
+		done = waitTimeout(&wg, time.Millisecond)
+		events, err := l.Query(Filter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the events written so far, each once and the newest first
+		seen := map[string]bool{}
+		for i, e := range events {
+			if seen[e.User] {
+				t.Fatalf("expected %s once, got it twice", e.User)
+			}
+			seen[e.User] = true
+			if i > 0 && e.Time.After(events[i-1].Time) {
+				t.Fatal("expected the newest event first")
+			}
+		}
+		if done && len(events) != count {
+			t.Fatalf("expected %d events, got %d", count, len(events))
+		}
+	}
+}
+
+// waitTimeout tells whether the wait group is done within the timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
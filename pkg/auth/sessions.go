@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const DefaultSessionTTL = 12 * time.Hour
+
+type session struct {
+	user    User
+	expires time.Time
+}
+
+// Sessions keeps the sessions of logged in users in memory, restarting the
+// server logs everybody out. Only hashes of the tokens are kept.
+type Sessions struct {
+	ttl      time.Duration
+	lock     sync.Mutex
+	sessions map[string]*session
+}
+
+func NewSessions(ttl time.Duration) *Sessions {
+	return &Sessions{ttl: ttl, sessions: map[string]*session{}}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Create starts a session for the user and returns its token
+func (s *Sessions) Create(user User) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(s.ttl)
+	if !user.Expires.IsZero() && user.Expires.Before(expires) {
+		// the session ends with the sign in of the identity provider
+		expires = user.Expires
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.purge()
+	s.sessions[hashToken(token)] = &session{user: user, expires: expires}
+	return token, expires, nil
+}
+
+// Get returns the user of the session, ok is false for unknown or expired
+// tokens
+func (s *Sessions) Get(token string) (User, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session, ok := s.sessions[hashToken(token)]
+	if !ok {
+		return User{}, false
+	}
+	if time.Now().After(session.expires) {
+		delete(s.sessions, hashToken(token))
+		return User{}, false
+	}
+	return session.user, true
+}
+
+// CSRFToken returns the token which has to be sent along the session token
+// with the requests changing something. It is derived from the session token
+// which it does not give away.
+func CSRFToken(token string) string {
+	return hashToken("csrf:" + token)
+}
+
+// Delete ends the session
+func (s *Sessions) Delete(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, hashToken(token))
+}
+
+// purge drops the expired sessions, the caller must hold the lock
+func (s *Sessions) purge() {
+	now := time.Now()
+	for key, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, key)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const DefaultTicketTTL = 30 * time.Second
+
+type ticket struct {
+	user User
+	// token is the api token the ticket was asked with, nil for sessions
+	token   *APIToken
+	expires time.Time
+}
+
+// Tickets are short lived single use tokens for websockets, browsers can not
+// set headers on them. Like sessions they are kept in memory and only by
+// their hash.
+type Tickets struct {
+	ttl     time.Duration
+	lock    sync.Mutex
+	tickets map[string]*ticket
+}
+
+func NewTickets(ttl time.Duration) *Tickets {
+	return &Tickets{ttl: ttl, tickets: map[string]*ticket{}}
+}
+
+// Create returns a ticket for the user, requests using it are limited like
+// the api token when one is given
+func (t *Tickets) Create(user User, token *APIToken) (string, time.Time, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	value := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(t.ttl)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	for key, ticket := range t.tickets {
+		if now.After(ticket.expires) {
+			delete(t.tickets, key)
+		}
+	}
+	t.tickets[hashToken(value)] = &ticket{user: user, token: token, expires: expires}
+	return value, expires, nil
+}
+
+// Redeem returns the user and the api token of the ticket, a ticket can only
+// be redeemed once
+func (t *Tickets) Redeem(value string) (User, *APIToken, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := hashToken(value)
+	ticket, ok := t.tickets[key]
+	if !ok {
+		return User{}, nil, false
+	}
+	delete(t.tickets, key)
+	if time.Now().After(ticket.expires) {
+		return User{}, nil, false
+	}
+	return ticket.user, ticket.token, true
+}
@@ -0,0 +1,212 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenPrefix starts every api token so that leaked ones are easy to find
+const tokenPrefix = "dft_"
+
+var ErrTokenNotFound = errors.New("token not found")
+
+// APIToken lets automation use the api on behalf of a user, limited to some
+// hosts and actions. The user still needs a role allowing the request.
+type APIToken struct {
+	ID   string
+	Name string
+	User string
+	// Groups and OIDC are those of the user when the token was created,
+	// tokens of users signed in with OIDC keep their groups and expire with
+	// the sign in they were created in
+	Groups []string `json:",omitempty"`
+	OIDC   bool     `json:",omitempty"`
+	// Hosts are the hosts the token can be used on
+	Hosts []string
+	// Actions are what the token can do on the hosts
+	Actions []string
+	Created time.Time
+	// Expires is zero for tokens which do not expire
+	Expires time.Time
+}
+
+// Owner returns the user the token acts as
+func (t *APIToken) Owner() User {
+	owner := User{Username: t.User, Groups: t.Groups, OIDC: t.OIDC}
+	if t.OIDC {
+		// the sign in of the owner ends with the token at the latest
+		owner.Expires = t.Expires
+	}
+	return owner
+}
+
+// Expired tells whether the token can not be used anymore
+func (t *APIToken) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// AllowsHost tells whether the token can be used on the host
+func (t *APIToken) AllowsHost(host string) bool {
+	for _, h := range t.Hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsAction tells whether the token can do the action
+func (t *APIToken) AllowsAction(action string) bool {
+	for _, a := range t.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// storedToken is a token as it is kept in the file, only the hash of its
+// secret is kept
+type storedToken struct {
+	APIToken
+	Hash string
+}
+
+// Tokens is a store of api tokens backed by a JSON file
+type Tokens struct {
+	path   string
+	lock   sync.Mutex
+	tokens []*storedToken
+}
+
+func NewTokens(path string) (*Tokens, error) {
+	t := &Tokens{path: path, tokens: []*storedToken{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &t.tokens); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// save writes the tokens, the caller must hold the lock
+func (t *Tokens) save() error {
+	data, err := json.MarshalIndent(t.tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), filepath.Base(t.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// Create stores the token and returns its secret, the secret can not be
+// recovered later
+func (t *Tokens) Create(token APIToken) (string, APIToken, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", APIToken{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIToken{}, err
+	}
+	token.ID = hex.EncodeToString(id)
+	token.Created = time.Now()
+	value := tokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.tokens = append(t.tokens, &storedToken{APIToken: token, Hash: hashToken(value)})
+	if err := t.save(); err != nil {
+		t.tokens = t.tokens[:len(t.tokens)-1]
+		return "", APIToken{}, err
+	}
+	return value, token, nil
+}
+
+// Authenticate returns the token of the secret, ok is false for unknown and
+// expired tokens
+func (t *Tokens) Authenticate(value string) (APIToken, bool) {
+	if !strings.HasPrefix(value, tokenPrefix) {
+		return APIToken{}, false
+	}
+	hash := hashToken(value)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, token := range t.tokens {
+		if token.Hash == hash && !token.Expired() {
+			return token.APIToken, true
+		}
+	}
+	return APIToken{}, false
+}
+
+// List returns the tokens of the user, or every token when user is empty,
+// the newest first
+func (t *Tokens) List(user string) []APIToken {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	found := []APIToken{}
+	for _, token := range t.tokens {
+		if user == "" || token.User == user {
+			found = append(found, token.APIToken)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Created.After(found[j].Created) })
+	return found
+}
+
+// Get returns the token with the id
+func (t *Tokens) Get(id string) (APIToken, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, token := range t.tokens {
+		if token.ID == id {
+			return token.APIToken, nil
+		}
+	}
+	return APIToken{}, ErrTokenNotFound
+}
+
+// Delete revokes the token with the id
+func (t *Tokens) Delete(id string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for i, token := range t.tokens {
+		if token.ID == id {
+			tokens := append(append([]*storedToken{}, t.tokens[:i]...), t.tokens[i+1:]...)
+			previous := t.tokens
+			t.tokens = tokens
+			if err := t.save(); err != nil {
+				t.tokens = previous
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
@@ -0,0 +1,144 @@
+// Package auth holds the local users allowed to log into the api server and
+// their sessions.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// User is a logged in user
+type User struct {
+	Username string
+	// Groups are the groups the identity provider put the user in
+	Groups []string `json:",omitempty"`
+	// OIDC is set for users signed in with the identity provider, they are
+	// not in the users file
+	OIDC bool `json:",omitempty"`
+	// Expires is when the id token of a user signed in with OIDC expires,
+	// the user has to sign in again then
+	Expires time.Time `json:",omitzero"`
+}
+
+// OIDCPrefix starts the usernames of users signed in with OIDC, usernames of
+// the users file can not hold a colon so the two never collide
+const OIDCPrefix = "oidc:"
+
+// Users is a store of local users backed by a file in the htpasswd format
+// with bcrypt hashes, one username:hash per line. The file is read again when
+// it changes so users can be added without a restart.
+type Users struct {
+	path    string
+	lock    sync.Mutex
+	hashes  map[string][]byte
+	modTime time.Time
+}
+
+// dummyHash is compared against for unknown users so that the response time
+// does not tell which users exist
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func NewUsers(path string) (*Users, error) {
+	u := &Users{path: path, hashes: map[string][]byte{}}
+	if err := u.load(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// load reads the file when it changed since the last read, the caller must
+// hold the lock unless the store is not shared yet
+func (u *Users) load() error {
+	info, err := os.Stat(u.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// nobody can log in until the file is created
+		u.hashes = map[string][]byte{}
+		u.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(u.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+	hashes := map[string][]byte{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(text, ":")
+		if !ok || username == "" {
+			return fmt.Errorf("unable to parse %s: line %d is not username:hash", u.path, line)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("unable to parse %s: hash of %s is not a bcrypt hash", u.path, username)
+		}
+		hashes[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	u.hashes = hashes
+	u.modTime = info.ModTime()
+	return nil
+}
+
+// Authenticate returns the user when the password matches its hash
+func (u *Users) Authenticate(username string, password string) (*User, error) {
+	u.lock.Lock()
+	if err := u.load(); err != nil {
+		u.lock.Unlock()
+		return nil, err
+	}
+	hash, ok := u.hashes[username]
+	u.lock.Unlock()
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &User{Username: username}, nil
+}
+
+// Exists tells if the user is still in the file, sessions of removed users
+// are not valid anymore
+func (u *Users) Exists(username string) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.load(); err != nil {
+		return false
+	}
+	_, ok := u.hashes[username]
+	return ok
+}
+
+// HashPassword returns the line of the users file for the user
+func HashPassword(username string, password string) (string, error) {
+	if username == "" || strings.Contains(username, ":") {
+		return "", errors.New("username must not be empty or contain :")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", username, hash), nil
+}
@@ -1,11 +1,17 @@
 package config
 
 import (
+	"bytes"
+	"crazydocker/pkg/rbac"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
@@ -17,21 +23,331 @@ type PasswordAuth struct {
 type SSHAuth struct {
 	Username       string `yaml:"username"`
 	PrivateKeyFile string `yaml:"privateKeyFile"`
+	// Passphrase of the private key, see ResolveSecret for references
+	Passphrase      string `yaml:"passphrase"`
+	CertificateFile string `yaml:"certificateFile"`
+	// UseAgent authenticates with the keys of the ssh-agent listening on
+	// AgentSocket, SSH_AUTH_SOCK is used when no socket is set
+	UseAgent    bool   `yaml:"useAgent"`
+	AgentSocket string `yaml:"agentSocket"`
+}
+
+const DefaultSSHPort = 22
+
+// PrivilegeEscalation changes how docker is run on hosts where the ssh user
+// can not use the docker socket
+type PrivilegeEscalation struct {
+	// Sudo runs docker through sudo, SudoPassword is sent to sudo when set,
+	// see ResolveSecret for references
+	Sudo         bool   `yaml:"sudo"`
+	SudoPassword string `yaml:"sudoPassword"`
+	// DockerHost is passed to docker as DOCKER_HOST
+	DockerHost string `yaml:"dockerHost"`
+	// DockerBinary is the path of the docker cli, docker by default
+	DockerBinary string `yaml:"dockerBinary"`
+}
+
+// RoleBinding gives the user, or every member of the group, a role, see
+// rbac.Role for what each role allows
+type RoleBinding struct {
+	User string `yaml:"user"`
+	// Group matches the groups of users signed in with OIDC
+	Group string `yaml:"group"`
+	Role  string `yaml:"role"`
+}
+
+// NormalizeOrigin checks that the origin is a scheme and a host like
+// browsers send it and returns it in lower case
+func NormalizeOrigin(origin string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(origin, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("invalid origin %q, expected scheme://host[:port]", origin)
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host), nil
+}
+
+// validateAccess makes sure every binding names a user or a group and a
+// known role
+func validateAccess(bindings []RoleBinding) error {
+	for _, b := range bindings {
+		if (b.User == "") == (b.Group == "") {
+			return errors.New("every access entry requires either a user or a group")
+		}
+		if _, err := rbac.ParseRole(b.Role); err != nil {
+			return fmt.Errorf("access of %s%s: %w", b.User, b.Group, err)
+		}
+	}
+	return nil
+}
+
+// HostConfig holds the settings of a single host, empty values fall back to
+// the settings of the group
+type HostConfig struct {
+	Address        string        `yaml:"address"`
+	Port           int           `yaml:"port"`
+	User           string        `yaml:"user"`
+	Name           string        `yaml:"name"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	// PrivilegeEscalation overrides the setting of the group
+	PrivilegeEscalation *PrivilegeEscalation `yaml:"privilegeEscalation"`
+	// Access adds to the bindings of the group
+	Access []RoleBinding `yaml:"access"`
+}
+
+// JumpHost is a bastion the connections of a group are tunneled through, it
+// can itself be reached through another jump host
+type JumpHost struct {
+	Address        string `yaml:"address"`
+	Port           int    `yaml:"port"`
+	User           string `yaml:"user"`
+	PasswordAuth   `yaml:"passwordAuth"`
+	SSHAuth        `yaml:"sshAuth"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	JumpHost       *JumpHost     `yaml:"jumpHost"`
+}
+
+// Chain returns the jump hosts in the order they have to be dialed, the
+// most deeply nested jump host is dialed first
+func (j *JumpHost) Chain() []*JumpHost {
+	chain := []*JumpHost{}
+	for hop := j; hop != nil; hop = hop.JumpHost {
+		chain = append([]*JumpHost{hop}, chain...)
+	}
+	return chain
 }
 
 type SSHConfig struct {
 	PasswordAuth `yaml:"passwordAuth"`
 	SSHAuth      `yaml:"sshAuth"`
-	Ips          []string `yaml:"ips"`
+	Ips          []string     `yaml:"ips"`
+	Hosts        []HostConfig `yaml:"hosts"`
+	JumpHost     *JumpHost    `yaml:"jumpHost"`
+	// PrivilegeEscalation is used by the hosts without a setting of their own
+	PrivilegeEscalation *PrivilegeEscalation `yaml:"privilegeEscalation"`
+	// Access binds users to roles on every host of the group
+	Access []RoleBinding `yaml:"access"`
+}
+
+// HostList returns every host of the group, entries of the ips list are
+// converted to hosts with the default settings
+func (s *SSHConfig) HostList() []HostConfig {
+	hosts := []HostConfig{}
+	for _, ip := range s.Ips {
+		hosts = append(hosts, HostConfig{Address: ip, Port: DefaultSSHPort, PrivilegeEscalation: s.PrivilegeEscalation, Access: s.Access})
+	}
+	for _, h := range s.Hosts {
+		if h.Port == 0 {
+			h.Port = DefaultSSHPort
+		}
+		if h.PrivilegeEscalation == nil {
+			h.PrivilegeEscalation = s.PrivilegeEscalation
+		}
+		h.Access = append(append([]RoleBinding{}, s.Access...), h.Access...)
+		hosts = append(hosts, h)
+	}
+	return hosts
+}
+
+// DockerTLS holds the files used to connect to a docker daemon with mutual
+// tls, paths are relative to the config folder
+type DockerTLS struct {
+	CAFile   string `yaml:"caFile"`
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// DockerEndpoint is a docker daemon reached without ssh, either through a
+// local socket (unix://) or over tcp (tcp://)
+type DockerEndpoint struct {
+	Host string     `yaml:"host"`
+	Name string     `yaml:"name"`
+	TLS  *DockerTLS `yaml:"tls"`
+	// Access adds to the bindings of the group
+	Access []RoleBinding `yaml:"access"`
+}
+
+type DockerConfig struct {
+	// TLS is used by the tcp endpoints without tls settings of their own
+	TLS       *DockerTLS       `yaml:"tls"`
+	Endpoints []DockerEndpoint `yaml:"endpoints"`
+	// Access binds users to roles on every endpoint of the group
+	Access []RoleBinding `yaml:"access"`
+}
+
+// EndpointList returns every endpoint of the group with the tls settings of
+// the group applied
+func (d *DockerConfig) EndpointList() []DockerEndpoint {
+	endpoints := []DockerEndpoint{}
+	for _, e := range d.Endpoints {
+		if e.TLS == nil && strings.HasPrefix(e.Host, "tcp://") {
+			e.TLS = d.TLS
+		}
+		e.Access = append(append([]RoleBinding{}, d.Access...), e.Access...)
+		endpoints = append(endpoints, e)
+	}
+	return endpoints
+}
+
+// Timeouts limit how long the docker operations may run, zero values use
+// the defaults
+type Timeouts struct {
+	List    time.Duration `yaml:"list"`
+	Inspect time.Duration `yaml:"inspect"`
+	Action  time.Duration `yaml:"action"`
+	Create  time.Duration `yaml:"create"`
+	// Probe limits the commands run while the hosts are loaded
+	Probe time.Duration `yaml:"probe"`
+}
+
+// Recording enables the recording of exec sessions
+type Recording struct {
+	Enabled bool `yaml:"enabled"`
+	// Retention is how long recordings are kept, forever when not set
+	Retention time.Duration `yaml:"retention"`
+}
+
+// OIDC signs users in with an OpenID Connect provider
+type OIDC struct {
+	// Issuer is the url of the provider, OIDC is disabled when it is not set
+	Issuer   string `yaml:"issuer"`
+	ClientID string `yaml:"clientID"`
+	// ClientSecret is not needed for public clients, see ResolveSecret for
+	// references
+	ClientSecret string `yaml:"clientSecret"`
+	// RedirectURL is the /oidc/callback route of the api server as browsers
+	// reach it
+	RedirectURL string `yaml:"redirectURL"`
+	// Scopes are asked for on top of openid, profile and email
+	Scopes []string `yaml:"scopes"`
+	// UsernameClaim is the claim of the id token used as the username, sub
+	// by default. Claims like preferred_username can be changed by the users
+	// at the provider, they could take the name and the roles of another.
+	UsernameClaim string `yaml:"usernameClaim"`
+	// GroupsClaim is the claim of the id token listing the groups of the
+	// user, groups by default
+	GroupsClaim string `yaml:"groupsClaim"`
+}
+
+// Enabled tells whether users can sign in with OIDC
+func (o OIDC) Enabled() bool {
+	return o.Issuer != ""
+}
+
+func (o OIDC) validate() error {
+	if !o.Enabled() {
+		return nil
+	}
+	for name, value := range map[string]string{"issuer": o.Issuer, "redirectURL": o.RedirectURL} {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("oidc %s has to be an http or https url, got %q", name, value)
+		}
+	}
+	if o.ClientID == "" {
+		return errors.New("oidc requires a clientID")
+	}
+	return nil
+}
+
+// DefaultApprovalTTL is how long approval requests wait when no ttl is set
+const DefaultApprovalTTL = time.Hour
+
+// approvalOperations are the operations rules can hold back, container
+// actions are named container.<action>
+var approvalOperations = map[string]bool{
+	"container.start":   true,
+	"container.stop":    true,
+	"container.restart": true,
+	"container.kill":    true,
+	"container.pause":   true,
+	"container.unpause": true,
+	"container.rm":      true,
+	"container.create":  true,
+	"container.exec":    true,
+	"machine.exec":      true,
+}
+
+// Approval makes operations wait until a second user approves them
+type Approval struct {
+	// TTL is how long a request waits for an approver, an hour by default
+	TTL time.Duration `yaml:"ttl"`
+	// Webhook is an url the new requests are posted to as JSON, see
+	// ResolveSecret for references
+	Webhook string         `yaml:"webhook"`
+	Rules   []ApprovalRule `yaml:"rules"`
+}
+
+// ApprovalRule holds the operations back on some hosts
+type ApprovalRule struct {
+	// Hosts are the ids or names of the hosts, the rule applies to every
+	// host when empty
+	Hosts []string `yaml:"hosts"`
+	// Operations like container.rm, container.kill, container.create and
+	// machine.exec
+	Operations []string `yaml:"operations"`
+	// ApproverRole is the role the approver needs on the host, admin by
+	// default
+	ApproverRole string `yaml:"approverRole"`
+}
+
+func (a Approval) validate() error {
+	if a.TTL < 0 {
+		return fmt.Errorf("invalid approval ttl %s", a.TTL)
+	}
+	for _, r := range a.Rules {
+		if len(r.Operations) == 0 {
+			return errors.New("every approval rule requires operations")
+		}
+		for _, op := range r.Operations {
+			if !approvalOperations[op] {
+				return fmt.Errorf("unknown approval operation %q, expected container.<action>, container.create, container.exec or machine.exec", op)
+			}
+		}
+		if r.ApproverRole != "" {
+			if _, err := rbac.ParseRole(r.ApproverRole); err != nil {
+				return fmt.Errorf("approval approverRole: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// settings are the validated contents of a config file
+type settings struct {
+	config    []*SSHConfig
+	docker    []*DockerConfig
+	timeouts  Timeouts
+	access    []RoleBinding
+	recording Recording
+	origins   []string
+	oidc      OIDC
+	approval  Approval
 }
 
 type Config struct {
-	config []*SSHConfig
-	lock   sync.Mutex
+	settings
+	lock sync.Mutex
+	// write serializes the changes of the file
+	write sync.Mutex
+	v     *viper.Viper
 }
 
+// NewConfig loads the config.yaml of the config folder
 func NewConfig() (*Config, error) {
-	config := &Config{config: []*SSHConfig{}}
+	return newConfig(viper.GetViper())
+}
+
+// NewConfigFromFile loads the config from the given file instead of the
+// config folder
+func NewConfigFromFile(path string) (*Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	return newConfig(v)
+}
+
+func newConfig(v *viper.Viper) (*Config, error) {
+	config := &Config{settings: settings{config: []*SSHConfig{}, docker: []*DockerConfig{}}, v: v}
 	err := config.load()
 	return config, err
 }
@@ -48,37 +364,277 @@ func (c *Config) Get() []*SSHConfig {
 	return configList
 }
 
+// Endpoints returns a copy of every configured docker endpoint
+func (c *Config) Endpoints() []DockerEndpoint {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	endpoints := []DockerEndpoint{}
+	for _, d := range c.docker {
+		endpoints = append(endpoints, d.EndpointList()...)
+	}
+	return endpoints
+}
+
+// Access returns the bindings which apply to every host and to the server
+// itself
+func (c *Config) Access() []RoleBinding {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]RoleBinding{}, c.access...)
+}
+
+// Timeouts returns the configured operation timeouts
+func (c *Config) Timeouts() Timeouts {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.timeouts
+}
+
+// AllowedOrigins returns the origins of the web pages allowed to use the api
+func (c *Config) AllowedOrigins() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.origins...)
+}
+
+// Recording returns the session recording settings
+func (c *Config) Recording() Recording {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.recording
+}
+
+// OIDC returns the single sign-on settings with the defaults applied
+func (c *Config) OIDC() OIDC {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	o := c.oidc
+	o.Scopes = append([]string{}, o.Scopes...)
+	if o.UsernameClaim == "" {
+		o.UsernameClaim = "sub"
+	}
+	if o.GroupsClaim == "" {
+		o.GroupsClaim = "groups"
+	}
+	return o
+}
+
+// Approval returns the approval policy with the defaults applied
+func (c *Config) Approval() Approval {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	a := c.approval
+	a.Rules = append([]ApprovalRule{}, a.Rules...)
+	if a.TTL == 0 {
+		a.TTL = DefaultApprovalTTL
+	}
+	return a
+}
+
 func (c *Config) load() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	err := viper.ReadInConfig()
+	err := c.v.ReadInConfig()
 	if err != nil {
 		return err
 	}
+	s, err := parse(c.v)
+	if err != nil {
+		return err
+	}
+	c.settings = *s
+	return nil
+}
+
+// parse decodes and validates the config read by v
+func parse(v *viper.Viper) (*settings, error) {
 	var ConfigData struct {
 		ConfigList []struct {
-			SshConfig *SSHConfig `yaml:"sshConfig"`
+			SshConfig    *SSHConfig    `yaml:"sshConfig"`
+			DockerConfig *DockerConfig `yaml:"dockerConfig"`
 		} `yaml:"configList"`
+		Timeouts  Timeouts      `yaml:"timeouts"`
+		Access    []RoleBinding `yaml:"access"`
+		Recording Recording     `yaml:"recording"`
+		OIDC      OIDC          `yaml:"oidc"`
+		Approval  Approval      `yaml:"approval"`
+		// AllowedOrigins are the origins of the web pages allowed to use
+		// the api, like https://docker.example.com
+		AllowedOrigins []string `yaml:"allowedOrigins"`
 	}
-	err = viper.UnmarshalExact(&ConfigData)
+	key, err := LoadMasterKey()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// encrypted secrets are decrypted while decoding, the rest of the code
+	// only sees plaintext
+	err = v.UnmarshalExact(&ConfigData, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		decryptHook(key),
+	)))
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range []time.Duration{ConfigData.Timeouts.List, ConfigData.Timeouts.Inspect, ConfigData.Timeouts.Action, ConfigData.Timeouts.Create, ConfigData.Timeouts.Probe} {
+		if t < 0 {
+			return nil, fmt.Errorf("invalid timeout %s", t)
+		}
+	}
+	if ConfigData.Recording.Retention < 0 {
+		return nil, fmt.Errorf("invalid recording retention %s", ConfigData.Recording.Retention)
+	}
+	if err := validateAccess(ConfigData.Access); err != nil {
+		return nil, err
+	}
+	if err := ConfigData.OIDC.validate(); err != nil {
+		return nil, err
+	}
+	if err := ConfigData.Approval.validate(); err != nil {
+		return nil, err
+	}
+	origins := []string{}
+	for _, o := range ConfigData.AllowedOrigins {
+		origin, err := NormalizeOrigin(o)
+		if err != nil {
+			return nil, err
+		}
+		origins = append(origins, origin)
 	}
 	configList := []*SSHConfig{}
+	dockerList := []*DockerConfig{}
 	for _, t := range ConfigData.ConfigList {
+		if t.DockerConfig != nil {
+			for _, e := range t.DockerConfig.EndpointList() {
+				if err := validateAccess(e.Access); err != nil {
+					return nil, err
+				}
+				switch {
+				case strings.HasPrefix(e.Host, "unix://"):
+					if e.TLS != nil {
+						return nil, fmt.Errorf("tls is not supported for socket endpoint %s", e.Host)
+					}
+				case strings.HasPrefix(e.Host, "tcp://"):
+				default:
+					return nil, fmt.Errorf("docker endpoint %q has to start with unix:// or tcp://", e.Host)
+				}
+			}
+			dockerList = append(dockerList, t.DockerConfig)
+		}
+		if t.SshConfig == nil {
+			continue
+		}
+		for _, h := range t.SshConfig.Hosts {
+			if h.Address == "" {
+				return nil, errors.New("every entry of hosts requires an address")
+			}
+			if h.Port < 0 || h.Port > 65535 {
+				return nil, fmt.Errorf("invalid port %d for host %s", h.Port, h.Address)
+			}
+		}
+		for _, h := range t.SshConfig.HostList() {
+			if p := h.PrivilegeEscalation; p != nil && p.SudoPassword != "" && !p.Sudo {
+				return nil, fmt.Errorf("sudoPassword is set for host %s but sudo is not enabled", h.Address)
+			}
+			if err := validateAccess(h.Access); err != nil {
+				return nil, err
+			}
+		}
+		for _, j := range t.SshConfig.JumpHost.Chain() {
+			if j.Address == "" {
+				return nil, errors.New("every jump host requires an address")
+			}
+			if j.Port < 0 || j.Port > 65535 {
+				return nil, fmt.Errorf("invalid port %d for jump host %s", j.Port, j.Address)
+			}
+		}
 		configList = append(configList, t.SshConfig)
 	}
-	c.config = configList
-	return nil
+	return &settings{
+		config:    configList,
+		docker:    dockerList,
+		timeouts:  ConfigData.Timeouts,
+		access:    ConfigData.Access,
+		recording: ConfigData.Recording,
+		origins:   origins,
+		oidc:      ConfigData.OIDC,
+		approval:  ConfigData.Approval,
+	}, nil
 }
 
 func (c *Config) Reload() error {
 	return c.load()
 }
 
+// Raw returns the content of the config file
+func (c *Config) Raw() ([]byte, error) {
+	return os.ReadFile(c.v.ConfigFileUsed())
+}
+
+// Redacted returns the content of the config file with the secrets replaced
+// by placeholders
+func (c *Config) Redacted() ([]byte, error) {
+	data, err := c.Raw()
+	if err != nil {
+		return nil, err
+	}
+	return Redact(data)
+}
+
+// Update replaces the config file. Placeholders of the redacted config are
+// replaced with the secrets they stand for, plaintext secrets are encrypted
+// when a master key is set.
 func (c *Config) Update(data []byte) error {
-	// write the data to the file
-	if err := os.WriteFile(fmt.Sprintf("%s/config.yaml", os.Getenv("CONFIG_FOLDER")), data, 0600); err != nil {
+	c.write.Lock()
+	defer c.write.Unlock()
+	return c.update(data)
+}
+
+// Patch merges the patch into the config file, see mergePatch, and updates
+// it like Update
+func (c *Config) Patch(patch []byte) error {
+	c.write.Lock()
+	defer c.write.Unlock()
+	current, err := c.Raw()
+	if err != nil {
+		return err
+	}
+	data, err := mergePatch(current, patch)
+	if err != nil {
+		return err
+	}
+	return c.update(data)
+}
+
+// update writes the config file, the caller must hold the write lock
+func (c *Config) update(data []byte) error {
+	current, err := c.Raw()
+	if err != nil {
+		return err
+	}
+	if data, err = restoreRedacted(data, current); err != nil {
+		return err
+	}
+	key, err := LoadMasterKey()
+	if err != nil {
+		return err
+	}
+	if key != nil {
+		if data, err = EncryptSecrets(data, key); err != nil {
+			return err
+		}
+	}
+	// the config is checked before it replaces the file, the api would
+	// keep running on the old one and fail on the next reload otherwise
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if _, err := parse(v); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.v.ConfigFileUsed(), data); err != nil {
 		return err
 	}
 	return c.load()
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testConfig = "configList:\n  - sshConfig:\n      passwordAuth:\n        username: deploy\n        password: secret\n      ips:\n        - 10.1.1.1\n"
+
+func testConfigFile(t *testing.T, content string) (*Config, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewConfigFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, path
+}
+
+func TestUpdateKeepsFileOfInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{name: "unknown key", config: testConfig + "unknown: true\n"},
+		{name: "invalid port", config: "configList:\n  - sshConfig:\n      hosts:\n        - address: 10.1.1.2\n          port: 70000\n"},
+		{name: "invalid role", config: testConfig + "access:\n  - user: bob\n    role: root\n"},
+		{name: "invalid yaml", config: "configList: [\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, path := testConfigFile(t, testConfig)
+			if err := c.Update([]byte(test.config)); err == nil {
+				t.Fatal("expected the update to be rejected")
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != testConfig {
+				t.Fatalf("expected the file to be kept, got %q", data)
+			}
+			// only the config file is left in the folder
+			entries, err := os.ReadDir(filepath.Dir(path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("expected no temporary file, got %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestUpdateReplacesFile(t *testing.T) {
+	c, path := testConfigFile(t, testConfig)
+	updated := strings.Replace(testConfig, "10.1.1.1", "10.1.1.2", 1)
+	if err := c.Update([]byte(updated)); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the file to stay private, got %s", info.Mode())
+	}
+	if hosts := c.Get()[0].HostList(); len(hosts) != 1 || hosts[0].Address != "10.1.1.2" {
+		t.Fatalf("expected the new host to be loaded, got %+v", hosts)
+	}
+}
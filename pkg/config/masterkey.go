@@ -0,0 +1,269 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v3"
+)
+
+const secretEncryptedPrefix = "enc:"
+
+// the master key is read from MASTER_KEY, base64 encoded, or from the file
+// named by MASTER_KEY_FILE
+const masterKeyEnv = "MASTER_KEY"
+const masterKeyFileEnv = "MASTER_KEY_FILE"
+
+const masterKeySize = 32
+
+// secretKeys are the settings holding secrets, viper matches keys case
+// insensitively so they are compared in lower case
+var secretKeys = map[string]bool{
+	"password":     true,
+	"passphrase":   true,
+	"sudopassword": true,
+	"clientsecret": true,
+	"webhook":      true,
+}
+
+var ErrNoMasterKey = fmt.Errorf("the config holds encrypted secrets but no master key is set, set %s or %s", masterKeyEnv, masterKeyFileEnv)
+
+// MasterKey encrypts the secrets of the config with AES-256-GCM
+type MasterKey struct {
+	aead cipher.AEAD
+}
+
+// NewMasterKey returns the master key of the base64 encoded key
+func NewMasterKey(encoded string) (*MasterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %w", err)
+	}
+	if len(key) != masterKeySize {
+		return nil, fmt.Errorf("master key has to be %d bytes long, got %d", masterKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &MasterKey{aead: aead}, nil
+}
+
+// GenerateMasterKey returns a new random key, base64 encoded
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ReadMasterKeyFile reads a file holding a base64 encoded key
+func ReadMasterKeyFile(path string) (*MasterKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMasterKey(string(data))
+}
+
+// LoadMasterKey returns the master key set in the environment, it is nil
+// when none is set
+func LoadMasterKey() (*MasterKey, error) {
+	if encoded, ok := os.LookupEnv(masterKeyEnv); ok {
+		return NewMasterKey(encoded)
+	}
+	if path, ok := os.LookupEnv(masterKeyFileEnv); ok {
+		return ReadMasterKeyFile(path)
+	}
+	return nil, nil
+}
+
+// Encrypt returns the value as enc:<base64 of the nonce and the ciphertext>
+func (k *MasterKey) Encrypt(value string) (string, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(value), nil)
+	return secretEncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns the plaintext of a value written by Encrypt
+func (k *MasterKey) Decrypt(value string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, secretEncryptedPrefix))
+	if err != nil || len(sealed) < k.aead.NonceSize() {
+		return "", errors.New("encrypted secret is malformed")
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("unable to decrypt secret, the master key does not match")
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted tells whether the value was written by Encrypt
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, secretEncryptedPrefix)
+}
+
+// isPlainSecret tells whether the secret holds the value itself rather than
+// a reference or an encrypted value
+func isPlainSecret(value string) bool {
+	return value != "" && !IsEncrypted(value) &&
+		!strings.HasPrefix(value, secretEnvPrefix) && !strings.HasPrefix(value, secretFilePrefix)
+}
+
+// decryptHook decrypts the encrypted strings while the config is decoded
+func decryptHook(key *MasterKey) mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		value, ok := data.(string)
+		if !ok || to.Kind() != reflect.String || !IsEncrypted(value) {
+			return data, nil
+		}
+		if key == nil {
+			return nil, ErrNoMasterKey
+		}
+		return key.Decrypt(value)
+	}
+}
+
+// transformSecrets calls transform with every secret of the yaml document
+// and returns the document with the results, data is returned as it is when
+// nothing changed. path is where the secret is, like
+// configlist.0.sshconfig.passwordauth.password, keys are lower case.
+func transformSecrets(data []byte, transform func(path string, value string) (string, error)) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	changed := false
+	var walk func(n *yaml.Node, path string) error
+	walk = func(n *yaml.Node, path string) error {
+		if n.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				name, value := n.Content[i], n.Content[i+1]
+				key := strings.TrimPrefix(path+"."+strings.ToLower(name.Value), ".")
+				if value.Kind == yaml.ScalarNode && secretKeys[strings.ToLower(name.Value)] {
+					transformed, err := transform(key, value.Value)
+					if err != nil {
+						return fmt.Errorf("line %d: %w", value.Line, err)
+					}
+					if transformed != value.Value {
+						value.Value = transformed
+						value.Tag = "!!str"
+						value.Style = 0
+						changed = true
+					}
+					continue
+				}
+				if err := walk(value, key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for i, child := range n.Content {
+			childPath := path
+			if n.Kind == yaml.SequenceNode {
+				childPath = strings.TrimPrefix(path+"."+strconv.Itoa(i), ".")
+			}
+			if err := walk(child, childPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(&doc, ""); err != nil {
+		return nil, err
+	}
+	if !changed {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
+
+// EncryptSecrets encrypts the plaintext secrets of the yaml document,
+// references and secrets already encrypted are kept
+func EncryptSecrets(data []byte, key *MasterKey) ([]byte, error) {
+	return transformSecrets(data, func(_ string, value string) (string, error) {
+		if !isPlainSecret(value) {
+			return value, nil
+		}
+		return key.Encrypt(value)
+	})
+}
+
+// RotateMasterKey encrypts every secret of the config file with the new key,
+// secrets encrypted with the old key are decrypted first. The file is
+// replaced once everything is encrypted.
+func RotateMasterKey(path string, oldKey *MasterKey, newKey *MasterKey) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rotated, err := transformSecrets(data, func(_ string, value string) (string, error) {
+		if IsEncrypted(value) {
+			if oldKey == nil {
+				return "", ErrNoMasterKey
+			}
+			plaintext, err := oldKey.Decrypt(value)
+			if err != nil {
+				return "", err
+			}
+			return newKey.Encrypt(plaintext)
+		}
+		if !isPlainSecret(value) {
+			return value, nil
+		}
+		return newKey.Encrypt(value)
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, rotated)
+}
+
+// writeFileAtomic replaces the file so that a crash does not leave it half
+// written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretRedactedPrefix starts the placeholders of the secrets in the
+// redacted config, the rest of the placeholder identifies the secret
+const secretRedactedPrefix = "redacted:"
+
+// redactionKey ties the placeholders to this process, placeholders handed
+// out before a restart are not accepted anymore
+var redactionKey = func() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}()
+
+// placeholder returns the placeholder of the secret at the path, it only
+// stands for the secret at that path so that it can not be moved to a
+// setting which would send it elsewhere
+func placeholder(path string, value string) string {
+	mac := hmac.New(sha256.New, redactionKey)
+	mac.Write([]byte(path))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return secretRedactedPrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Redact replaces the secrets of the yaml document with placeholders,
+// references to environment variables and files are kept
+func Redact(data []byte) ([]byte, error) {
+	return transformSecrets(data, func(path string, value string) (string, error) {
+		if value == "" || strings.HasPrefix(value, secretEnvPrefix) || strings.HasPrefix(value, secretFilePrefix) {
+			return value, nil
+		}
+		return placeholder(path, value), nil
+	})
+}
+
+// redactedSecret is a secret of the current document and where it is
+type redactedSecret struct {
+	path  string
+	value string
+}
+
+// restoreRedacted replaces the placeholders of the yaml document with the
+// secrets of the current document they were made from, placeholders have to
+// stay where they were
+func restoreRedacted(data []byte, current []byte) ([]byte, error) {
+	secrets := map[string]redactedSecret{}
+	// a current document which does not parse has no secrets to restore, it
+	// can still be replaced
+	transformSecrets(current, func(path string, value string) (string, error) {
+		secrets[placeholder(path, value)] = redactedSecret{path: path, value: value}
+		return value, nil
+	})
+	return transformSecrets(data, func(path string, value string) (string, error) {
+		if !strings.HasPrefix(value, secretRedactedPrefix) {
+			return value, nil
+		}
+		secret, ok := secrets[value]
+		if !ok {
+			return "", errors.New("unknown redacted secret, it was changed since the config was read or the server restarted")
+		}
+		if secret.path != path {
+			return "", fmt.Errorf("the redacted secret of %s can not be used for %s, enter the secret again", secret.path, path)
+		}
+		return secret.value, nil
+	})
+}
+
+// mergePatch applies the patch to the current yaml document like a JSON
+// merge patch (RFC 7386): mappings are merged, null removes a setting and
+// anything else, lists included, replaces the current value
+func mergePatch(current []byte, patch []byte) ([]byte, error) {
+	var doc, p yaml.Node
+	if err := yaml.Unmarshal(current, &doc); err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(patch, &p); err != nil {
+		return nil, err
+	}
+	if len(p.Content) == 0 {
+		return current, nil
+	}
+	if p.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("the patch has to be a mapping")
+	}
+	if len(doc.Content) == 0 {
+		doc = p
+	} else {
+		mergeNode(doc.Content[0], p.Content[0])
+	}
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
+
+func mergeNode(dst *yaml.Node, src *yaml.Node) {
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		*dst = *src
+		return
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		// keys are matched like viper does, ignoring the case
+		j := -1
+		for k := 0; k+1 < len(dst.Content); k += 2 {
+			if strings.EqualFold(dst.Content[k].Value, key.Value) {
+				j = k
+				break
+			}
+		}
+		switch {
+		case value.Tag == "!!null":
+			if j >= 0 {
+				dst.Content = append(dst.Content[:j], dst.Content[j+2:]...)
+			}
+		case j < 0:
+			dst.Content = append(dst.Content, key, value)
+		default:
+			mergeNode(dst.Content[j+1], value)
+		}
+	}
+}
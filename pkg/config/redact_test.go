@@ -0,0 +1,114 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const twoHostsConfig = `configList:
+  - sshConfig:
+      passwordAuth:
+        username: deploy
+        password: prod-secret
+      ips:
+        - 10.1.1.1
+  - sshConfig:
+      passwordAuth:
+        username: deploy
+        password: test-secret
+      ips:
+        - 10.2.2.2
+`
+
+// placeholders returns the placeholders of the redacted config in order
+func placeholders(t *testing.T, redacted []byte) []string {
+	t.Helper()
+	found := []string{}
+	for _, line := range strings.Split(string(redacted), "\n") {
+		if i := strings.Index(line, secretRedactedPrefix); i >= 0 {
+			found = append(found, line[i:])
+		}
+	}
+	return found
+}
+
+func TestRedactedConfigRoundTrip(t *testing.T) {
+	redacted, err := Redact([]byte(twoHostsConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(redacted), "secret") {
+		t.Fatalf("expected the passwords to be redacted, got %s", redacted)
+	}
+	// the same password at two places gets two placeholders
+	same := strings.Replace(twoHostsConfig, "test-secret", "prod-secret", 1)
+	sameRedacted, err := Redact([]byte(same))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := placeholders(t, sameRedacted); len(p) != 2 || p[0] == p[1] {
+		t.Fatalf("expected a placeholder per setting, got %v", p)
+	}
+	restored, err := restoreRedacted(redacted, []byte(twoHostsConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(restored), "password: prod-secret") || !strings.Contains(string(restored), "password: test-secret") {
+		t.Fatalf("expected the passwords to be restored, got %s", restored)
+	}
+}
+
+func TestRestoreRejectsMovedPlaceholders(t *testing.T) {
+	redacted, err := Redact([]byte(twoHostsConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := placeholders(t, redacted)
+	if len(p) != 2 {
+		t.Fatalf("expected two placeholders, got %v", p)
+	}
+	tests := []struct {
+		name   string
+		config string
+	}{
+		// the password of the first host would be sent to the second
+		{name: "other host", config: strings.Replace(string(redacted), p[1], p[0], 1)},
+		{name: "swapped hosts", config: strings.Replace(strings.Replace(string(redacted), p[0], "first", 1), p[1], p[0], 1)},
+		{name: "other setting", config: string(redacted) + "approval:\n  webhook: " + p[0] + "\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := restoreRedacted([]byte(test.config), []byte(twoHostsConfig))
+			if err == nil || !strings.Contains(err.Error(), "can not be used for") {
+				t.Fatalf("expected the moved placeholder to be rejected, got %v", err)
+			}
+		})
+	}
+}
+
+func TestUpdateRejectsMovedPlaceholder(t *testing.T) {
+	c, path := testConfigFile(t, twoHostsConfig)
+	redacted, err := c.Redacted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := placeholders(t, redacted)
+	if err := c.Update([]byte(strings.Replace(string(redacted), p[1], p[0], 1))); err == nil {
+		t.Fatal("expected the update to be rejected")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != twoHostsConfig {
+		t.Fatalf("expected the file to be kept, got %s", data)
+	}
+	// placeholders left where they are keep their secret
+	if err := c.Update([]byte(strings.Replace(string(redacted), "10.2.2.2", "10.3.3.3", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := c.Get()[1].HostList(); hosts[0].Address != "10.3.3.3" || c.Get()[1].PasswordAuth.Password != "test-secret" {
+		t.Fatalf("expected the second host to keep its password, got %+v", c.Get()[1])
+	}
+}
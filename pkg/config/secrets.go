@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const secretEnvPrefix = "env:"
+const secretFilePrefix = "file:"
+
+// ResolveSecret returns the value of a secret setting. Secrets can reference
+// an environment variable with env:NAME or a file relative to the config
+// folder with file:path, anything else is used as is.
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s referenced by secret is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		data, err := readConfigFolderFile(strings.TrimPrefix(value, secretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return value, nil
+}
+
+// readConfigFolderFile reads a file of the config folder, paths leaving the
+// folder, through .. or a symlink, are refused
+func readConfigFolderFile(name string) ([]byte, error) {
+	if !filepath.IsLocal(name) {
+		return nil, fmt.Errorf("secret file %q is not in the config folder", name)
+	}
+	folder := os.Getenv("CONFIG_FOLDER")
+	if folder == "" {
+		folder = "."
+	}
+	root, err := os.OpenRoot(folder)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.ReadFile(name)
+}
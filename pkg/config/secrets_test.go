@@ -0,0 +1,34 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecretFile(t *testing.T) {
+	dir := t.TempDir()
+	folder := filepath.Join(dir, "config")
+	if err := os.MkdirAll(filepath.Join(folder, "secrets"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "secrets", "password"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "outside"), []byte("outside"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join(folder, "link")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FOLDER", folder)
+	secret, err := ResolveSecret("file:secrets/password")
+	if err != nil || secret != "s3cret" {
+		t.Fatalf("expected the secret of the file, got %q %v", secret, err)
+	}
+	for _, value := range []string{"file:../outside", "file:secrets/../../outside", "file:" + filepath.Join(dir, "outside"), "file:link"} {
+		if secret, err := ResolveSecret(value); err == nil {
+			t.Fatalf("expected %s to be refused, got %q", value, secret)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"crazydocker/pkg/config"
+	"crazydocker/pkg/rbac"
+	"slices"
+)
+
+// highestRole returns the highest role the bindings give the user or one of
+// its groups, the bindings are validated when the config is loaded
+func highestRole(user string, groups []string, bindings []config.RoleBinding) rbac.Role {
+	role := rbac.RoleNone
+	for _, b := range bindings {
+		if b.User != "" && b.User != user {
+			continue
+		}
+		if b.Group != "" && !slices.Contains(groups, b.Group) {
+			continue
+		}
+		if r, err := rbac.ParseRole(b.Role); err == nil && r > role {
+			role = r
+		}
+	}
+	return role
+}
+
+// GlobalRole returns the role of the user on every host and on the server
+// itself, groups are the groups the identity provider put the user in
+func (ce *CommandExecutor) GlobalRole(user string, groups ...string) rbac.Role {
+	return highestRole(user, groups, ce.config.Access())
+}
+
+// Role returns the role of the user on the machine, the highest of the
+// global bindings and the bindings of the host and its group
+func (ce *CommandExecutor) Role(user string, ip string, groups ...string) rbac.Role {
+	role := ce.GlobalRole(user, groups...)
+	if m := ce.getMachine(ip); m != nil {
+		if r := highestRole(user, groups, m.access); r > role {
+			role = r
+		}
+	}
+	return role
+}
+
+// ApprovalRequired tells whether the operation on the machine has to be
+// approved by a second user, approverRole is the highest role the matching
+// rules ask the approver for
+func (ce *CommandExecutor) ApprovalRequired(ip string, operation string) (required bool, approverRole rbac.Role) {
+	name := ""
+	if m := ce.getMachine(ip); m != nil {
+		name = m.Name
+	}
+	for _, rule := range ce.config.Approval().Rules {
+		if !slices.Contains(rule.Operations, operation) {
+			continue
+		}
+		if len(rule.Hosts) > 0 && !slices.Contains(rule.Hosts, ip) && (name == "" || !slices.Contains(rule.Hosts, name)) {
+			continue
+		}
+		role := rbac.RoleAdmin
+		if rule.ApproverRole != "" {
+			role, _ = rbac.ParseRole(rule.ApproverRole)
+		}
+		if !required || role > approverRole {
+			approverRole = role
+		}
+		required = true
+	}
+	return required, approverRole
+}
@@ -1,31 +1,101 @@
 package core
 
 import (
+	"context"
 	"crazydocker/pkg/config"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strings"
 	"sync"
 
 	"github.com/gorilla/websocket"
 )
 
-func NewCommandExecutor() (*CommandExecutor, error) {
-	config, err := config.NewConfig()
-	if err != nil {
-		return nil, err
+// Option changes the defaults of the command executor
+type Option func(*CommandExecutor)
+
+// WithConfig uses the given config instead of the config folder
+func WithConfig(c *config.Config) Option {
+	return func(ce *CommandExecutor) {
+		ce.config = c
+	}
+}
+
+// WithKnownHosts uses the given known hosts instead of the file in the config
+// folder
+func WithKnownHosts(k *KnownHosts) Option {
+	return func(ce *CommandExecutor) {
+		ce.knownHosts = k
+	}
+}
+
+// WithTransport replaces the ssh transport of the hosts, for example with a
+// FakeTransport
+func WithTransport(factory TransportFactory) Option {
+	return func(ce *CommandExecutor) {
+		ce.newTransport = factory
+	}
+}
+
+func NewCommandExecutor(opts ...Option) (*CommandExecutor, error) {
+	ce := &CommandExecutor{machines: make(Machines), newTransport: newSSHTransport}
+	for _, opt := range opts {
+		opt(ce)
+	}
+	if ce.config == nil {
+		config, err := config.NewConfig()
+		if err != nil {
+			return nil, err
+		}
+		ce.config = config
+	}
+	if ce.knownHosts == nil {
+		knownHosts, err := NewKnownHosts(fmt.Sprintf("%s/known_hosts", os.Getenv("CONFIG_FOLDER")))
+		if err != nil {
+			return nil, err
+		}
+		ce.knownHosts = knownHosts
 	}
-	ce := &CommandExecutor{machines: make(Machines), config: config}
 	ce.loadMachines()
 	return ce, nil
 }
 
 type CommandExecutor struct {
-	machines Machines
-	lock     sync.RWMutex
-	config   *config.Config
+	machines     Machines
+	lock         sync.RWMutex
+	config       *config.Config
+	knownHosts   *KnownHosts
+	newTransport TransportFactory
+}
+
+// GetConfig returns the content of the config file, secrets are replaced by
+// placeholders which UpdateConfig and PatchConfig turn back into the secrets
+func (ce *CommandExecutor) GetConfig() ([]byte, error) {
+	return ce.config.Redacted()
+}
+
+// AllowedOrigins returns the origins of the web pages allowed to use the api
+// set in the config
+func (ce *CommandExecutor) AllowedOrigins() []string {
+	return ce.config.AllowedOrigins()
+}
+
+// Recording returns whether and how long exec sessions are recorded
+func (ce *CommandExecutor) Recording() config.Recording {
+	return ce.config.Recording()
+}
+
+// OIDC returns the single sign-on settings
+func (ce *CommandExecutor) OIDC() config.OIDC {
+	return ce.config.OIDC()
+}
+
+// Approval returns the approval policy
+func (ce *CommandExecutor) Approval() config.Approval {
+	return ce.config.Approval()
 }
 
 func (ce *CommandExecutor) ReloadConfig() error {
@@ -44,42 +114,62 @@ func (ce *CommandExecutor) UpdateConfig(data []byte) error {
 	return nil
 }
 
+// PatchConfig merges the patch into the config file
+func (ce *CommandExecutor) PatchConfig(patch []byte) error {
+	if err := ce.config.Patch(patch); err != nil {
+		return err
+	}
+	ce.loadMachines()
+	return nil
+}
+
 func (ce *CommandExecutor) loadMachines() {
 	var wg sync.WaitGroup
 	maxWorkers := make(chan int, 10)
 	ce.clearMachines()
 	for _, c := range ce.config.Get() {
 		{
-			for _, ip := range c.Ips {
+			for _, host := range c.HostList() {
 				maxWorkers <- 1
 				wg.Add(1)
-				go func(ip string) {
+				go func(host config.HostConfig) {
 					defer wg.Done()
-					parsedIp := net.ParseIP(ip)
-					m := &Machine{Ip: ip, Status: MachineOnline, parsedIp: parsedIp, SSHConfig: &MachineSSHConfig{
+					defer func() { <-maxWorkers }()
+					parsedIp := net.ParseIP(host.Address)
+					sshAuth := c.SSHAuth
+					m := newMachine(host, parsedIp, &MachineSSHConfig{
 						PasswordAuth: &config.PasswordAuth{
 							Username: c.PasswordAuth.Username,
 							Password: c.Password,
 						},
-						SSHAuth: &config.SSHAuth{Username: c.SSHAuth.Username, PrivateKeyFile: c.PrivateKeyFile},
-					}}
-					ce.addMachine(ip, m)
+						SSHAuth:             &sshAuth,
+						User:                host.User,
+						ConnectTimeout:      host.ConnectTimeout,
+						JumpHost:            c.JumpHost,
+						PrivilegeEscalation: host.PrivilegeEscalation,
+					}, ce.knownHosts, ce.newTransport)
+					ce.addMachine(m.Ip, m)
 					if parsedIp == nil {
 						// see if its valid host
-						ips, _ := net.LookupIP(ip)
+						ips, _ := net.LookupIP(host.Address)
 						if len(ips) > 0 {
 							m.parsedIp = ips[0]
 						} else {
-							m.Status = MachineOffline
-							m.Error = fmt.Sprintf("unable to parse %s as valid ip", ip)
+							m.update(func() {
+								m.Status = MachineOffline
+								m.Error = fmt.Sprintf("unable to parse %s as valid ip", host.Address)
+							})
 							log.Println(m.Error)
 							return
 						}
 					}
-					data, err := ce.GetHostNameAndOs(m.Ip)
-					if err != nil {
-						m.Error = err.Error()
-					} else {
+					ctx := context.Background()
+					data, err := ce.GetHostNameAndOs(ctx, m.Ip)
+					m.update(func() {
+						if err != nil {
+							m.Error = err.Error()
+							return
+						}
 						splitData := strings.Split(data, "\n")
 						if len(splitData) != 2 {
 							m.Error = fmt.Sprintf("unable to determine os or hostname from %s", data)
@@ -87,20 +177,54 @@ func (ce *CommandExecutor) loadMachines() {
 							m.HostName = strings.TrimSpace(splitData[0])
 							m.Os = strings.TrimSpace(splitData[1])
 						}
-					}
-					data, err = ce.GetShell(m.Ip)
-					if err != nil {
-						// combine error
-						m.Error = fmt.Sprintf("%s\n%s", err.Error(), m.Error)
-					} else {
-						m.Shell = strings.TrimSpace(data)
-					}
-					<-maxWorkers
-				}(ip)
+					})
+					data, err = ce.GetShell(ctx, m.Ip)
+					m.update(func() {
+						if err != nil {
+							// combine error
+							m.Error = fmt.Sprintf("%s\n%s", err.Error(), m.Error)
+						} else {
+							m.Shell = strings.TrimSpace(data)
+						}
+					})
+					// probe how docker can be reached
+					ce.withTimeout(ctx, OperationProbe, func(ctx context.Context) error {
+						_, err := m.dockerBackend(ctx)
+						return err
+					})
+				}(host)
 			}
 		}
 		wg.Wait()
 	}
+	for _, endpoint := range ce.config.Endpoints() {
+		maxWorkers <- 1
+		wg.Add(1)
+		go func(endpoint config.DockerEndpoint) {
+			defer wg.Done()
+			defer func() { <-maxWorkers }()
+			m := newEndpointMachine(endpoint)
+			ce.addMachine(m.Ip, m)
+			var hostName, operatingSystem string
+			err := ce.withTimeout(context.Background(), OperationProbe, func(ctx context.Context) error {
+				backend, err := m.dockerBackend(ctx)
+				if err != nil {
+					return err
+				}
+				hostName, operatingSystem, err = backend.(*engineBackend).hostInfo(ctx)
+				return err
+			})
+			m.update(func() {
+				if err != nil {
+					m.Error = err.Error()
+					return
+				}
+				m.HostName = hostName
+				m.Os = operatingSystem
+			})
+		}(endpoint)
+	}
+	wg.Wait()
 }
 
 func (ce *CommandExecutor) getMachines() []*Machine {
@@ -108,8 +232,7 @@ func (ce *CommandExecutor) getMachines() []*Machine {
 	defer ce.lock.RUnlock()
 	machines := []*Machine{}
 	for _, m := range ce.machines {
-		data := *m
-		machines = append(machines, &data)
+		machines = append(machines, m.snapshot())
 	}
 	return machines
 }
@@ -130,6 +253,10 @@ func (ce *CommandExecutor) addMachine(ip string, m *Machine) {
 func (ce *CommandExecutor) clearMachines() {
 	ce.lock.Lock()
 	defer ce.lock.Unlock()
+	// drop the pooled connections of the old machines
+	for _, m := range ce.machines {
+		m.Close()
+	}
 	ce.machines = make(Machines)
 }
 
@@ -149,56 +276,189 @@ func marshalOut[T Container | Image](out string) []*T {
 	return dataList
 }
 
-func (ce *CommandExecutor) StreamContainer(conn *websocket.Conn, ip, containerID string) error {
-	return ce.getMachine(ip).StreamCommand(conn, fmt.Sprintf("docker container inspect %s", containerID))
+// backend returns the docker backend of the host
+func (ce *CommandExecutor) backend(ctx context.Context, ip string) (dockerBackend, error) {
+	m, err := ce.machine(ip)
+	if err != nil {
+		return nil, err
+	}
+	return m.dockerBackend(ctx)
 }
 
-func (ce *CommandExecutor) StreamImage(conn *websocket.Conn, ip string, imageId string) error {
-	return ce.getMachine(ip).StreamCommand(conn, fmt.Sprintf("docker image inspect %s", imageId))
+// streamBackend returns the docker backend of the host for a websocket
+// stream, errors are written to the websocket. The reference is expected to
+// come from ResolveContainer or ResolveImage.
+func (ce *CommandExecutor) streamBackend(ctx context.Context, conn *websocket.Conn, ip string, kind string, reference string) (dockerBackend, error) {
+	err := validReference(kind, reference)
+	var backend dockerBackend
+	if err == nil {
+		backend, err = ce.backend(ctx, ip)
+	}
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		conn.Close()
+		return nil, err
+	}
+	return backend, nil
 }
 
-func (ce *CommandExecutor) ListImages(ip string) (Images, error) {
-	machine := ce.getMachine(ip)
-	out, err := machine.RunCommand(`docker image ls --all --format "{{json . }}" --no-trunc`)
+func (ce *CommandExecutor) StreamContainer(ctx context.Context, conn *websocket.Conn, ip, containerID string) error {
+	backend, err := ce.streamBackend(ctx, conn, ip, "container", containerID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return marshalOut[Image](out), nil
+	go pollStream(ctx, conn, func(ctx context.Context) (output []byte, err error) {
+		err = ce.withTimeout(ctx, OperationInspect, func(ctx context.Context) error {
+			output, err = backend.InspectContainer(ctx, containerID)
+			return err
+		})
+		return output, err
+	})
+	return nil
 }
 
-func (ce *CommandExecutor) ListContainers(ip string) (Containers, error) {
-	machine := ce.getMachine(ip)
-	out, err := machine.RunCommand(`docker container ls --all --format "{{json . }}" --no-trunc`)
+func (ce *CommandExecutor) StreamImage(ctx context.Context, conn *websocket.Conn, ip string, imageId string) error {
+	backend, err := ce.streamBackend(ctx, conn, ip, "image", imageId)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	go pollStream(ctx, conn, func(ctx context.Context) (output []byte, err error) {
+		err = ce.withTimeout(ctx, OperationInspect, func(ctx context.Context) error {
+			output, err = backend.InspectImage(ctx, imageId)
+			return err
+		})
+		return output, err
+	})
+	return nil
+}
+
+func (ce *CommandExecutor) ListImages(ctx context.Context, ip string) (images Images, err error) {
+	err = ce.withTimeout(ctx, OperationList, func(ctx context.Context) error {
+		backend, err := ce.backend(ctx, ip)
+		if err != nil {
+			return err
+		}
+		images, err = backend.ListImages(ctx)
+		return err
+	})
+	return images, err
+}
+
+func (ce *CommandExecutor) ListContainers(ctx context.Context, ip string) (containers Containers, err error) {
+	err = ce.withTimeout(ctx, OperationList, func(ctx context.Context) error {
+		backend, err := ce.backend(ctx, ip)
+		if err != nil {
+			return err
+		}
+		containers, err = backend.ListContainers(ctx)
+		return err
+	})
+	return containers, err
+}
+
+func (ce *CommandExecutor) GetHostNameAndOs(ctx context.Context, ip string) (out string, err error) {
+	err = ce.withTimeout(ctx, OperationProbe, func(ctx context.Context) error {
+		out, err = ce.getMachine(ip).RunCommand(ctx, `hostnamectl | grep -Ei "Static hostname|Operating System" | cut -f2 -d ":"`)
+		return err
+	})
+	return out, err
+}
+
+func (ce *CommandExecutor) GetShell(ctx context.Context, ip string) (out string, err error) {
+	err = ce.withTimeout(ctx, OperationProbe, func(ctx context.Context) error {
+		out, err = ce.getMachine(ip).RunCommand(ctx, "echo $SHELL")
+		return err
+	})
+	return out, err
+}
+
+// PerformAction runs one of the container actions on a container of the
+// host, see ParseContainerAction
+func (ce *CommandExecutor) PerformAction(ctx context.Context, ip string, containerID string, action string) (out string, err error) {
+	parsed, err := ParseContainerAction(action)
+	if err != nil {
+		return "", err
+	}
+	containerID, err = ce.ResolveContainer(ctx, ip, containerID)
+	if err != nil {
+		return "", err
 	}
-	return marshalOut[Container](out), nil
+	err = ce.withTimeout(ctx, OperationAction, func(ctx context.Context) error {
+		backend, err := ce.backend(ctx, ip)
+		if err != nil {
+			return err
+		}
+		out, err = backend.PerformAction(ctx, containerID, parsed)
+		return err
+	})
+	return out, err
 }
 
-func (ce *CommandExecutor) GetHostNameAndOs(ip string) (string, error) {
-	return ce.getMachine(ip).RunCommand(`hostnamectl | grep -Ei "Static hostname|Operating System" | cut -f2 -d ":"`)
+// CheckCreate checks a container create without running it, the options
+// and the image have to be valid
+func (ce *CommandExecutor) CheckCreate(ctx context.Context, ip string, image string, args string) error {
+	if _, err := parseRunArgs(args); err != nil {
+		return &InvalidRequestError{Reason: err.Error()}
+	}
+	_, err := ce.ResolveImage(ctx, ip, image)
+	return err
 }
 
-func (ce *CommandExecutor) GetShell(ip string) (string, error) {
-	return ce.getMachine(ip).RunCommand("echo $SHELL")
+// CreateContainer runs a container of an image of the host, only the
+// docker run options known by parseRunArgs are accepted
+func (ce *CommandExecutor) CreateContainer(ctx context.Context, ip string, image string, args string) (out string, err error) {
+	if _, err := parseRunArgs(args); err != nil {
+		return "", &InvalidRequestError{Reason: err.Error()}
+	}
+	image, err = ce.ResolveImage(ctx, ip, image)
+	if err != nil {
+		return "", err
+	}
+	err = ce.withTimeout(ctx, OperationCreate, func(ctx context.Context) error {
+		backend, err := ce.backend(ctx, ip)
+		if err != nil {
+			return err
+		}
+		out, err = backend.CreateContainer(ctx, image, args)
+		return err
+	})
+	return out, err
 }
 
-func (ce *CommandExecutor) PerformAction(ip string, containerID string, action string) (string, error) {
-	return ce.getMachine(ip).RunCommand(fmt.Sprintf("docker %s %s", action, containerID))
+func (ce *CommandExecutor) ExecIntoMachine(ctx context.Context, conn *websocket.Conn, ip string, size TerminalSize) error {
+	m, err := ce.machine(ip)
+	if err != nil {
+		conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		conn.Close()
+		return err
+	}
+	return m.GetShell(ctx, conn, size)
 }
 
-func (ce *CommandExecutor) CreateContainer(ip string, image string, args string) (string, error) {
-	return ce.getMachine(ip).RunCommand(fmt.Sprintf(`docker run -d %s $(docker inspect %s --format "{{ index .RepoTags 0 }}")`, args, image))
+func (ce *CommandExecutor) ExecIntoContainer(ctx context.Context, conn *websocket.Conn, ip string, containerID string, size TerminalSize) error {
+	backend, err := ce.streamBackend(ctx, conn, ip, "container", containerID)
+	if err != nil {
+		return err
+	}
+	return backend.ExecContainer(ctx, conn, containerID, size)
+}
+
+func (ce *CommandExecutor) StreamContainerLogs(ctx context.Context, conn *websocket.Conn, ip string, containerID string, size TerminalSize) error {
+	backend, err := ce.streamBackend(ctx, conn, ip, "container", containerID)
+	if err != nil {
+		return err
+	}
+	return backend.StreamLogs(ctx, conn, containerID, size)
 }
 
-func (ce *CommandExecutor) ExecIntoMachine(conn *websocket.Conn, ip string) error {
-	return ce.getMachine(ip).GetShell(conn)
+func (ce *CommandExecutor) ListHostKeys() []HostKey {
+	return ce.knownHosts.List()
 }
 
-func (ce *CommandExecutor) ExecIntoContainer(conn *websocket.Conn, ip string, containerID string) error {
-	return ce.getMachine(ip).ExecCommand(conn, fmt.Sprintf("docker exec -it %s sh", containerID))
+func (ce *CommandExecutor) ApproveHostKey(host string, fingerprint string) error {
+	return ce.knownHosts.Approve(host, fingerprint)
 }
 
-func (ce *CommandExecutor) StreamContainerLogs(conn *websocket.Conn, ip string, containerID string) error {
-	return ce.getMachine(ip).ExecCommand(conn, fmt.Sprintf("docker logs --follow %s", containerID))
+func (ce *CommandExecutor) RevokeHostKey(host string) error {
+	return ce.knownHosts.Revoke(host)
 }
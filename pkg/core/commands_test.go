@@ -0,0 +1,124 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMachines(t *testing.T) {
+	ce := testExecutor(t, FakeHostConfig("10.1.1.1"), NewOnlineFakeHost())
+	machines := ce.ListMachines()
+	if len(machines) != 1 {
+		t.Fatalf("expected a single machine, got %d", len(machines))
+	}
+	m := machines[0]
+	if m.Ip != "10.1.1.1" || m.Status != MachineOnline {
+		t.Fatalf("expected 10.1.1.1 to be online, got %+v", m)
+	}
+	if m.HostName != "web-1" || m.Os != "Ubuntu 22.04.4 LTS" || m.Shell != "/bin/bash" {
+		t.Fatalf("expected the probed host details, got %+v", m)
+	}
+	// the fake can not dial the docker socket
+	if m.DockerAccess != DockerAccessCLI {
+		t.Fatalf("expected docker to be reached through the cli, got %q", m.DockerAccess)
+	}
+}
+
+func TestLoadMachinesOffline(t *testing.T) {
+	transport := NewFakeTransport()
+	transport.Err = errors.New("connection refused")
+	ce := testExecutor(t, FakeHostConfig("10.1.1.1"), transport)
+	m := ce.ListMachines()[0]
+	if m.Status != MachineOffline || !strings.Contains(m.Error, "connection refused") {
+		t.Fatalf("expected 10.1.1.1 to be offline with the connection error, got %+v", m)
+	}
+}
+
+func TestListContainers(t *testing.T) {
+	transport := NewOnlineFakeHost()
+	ce := testExecutor(t, FakeHostConfig("10.1.1.1"), transport)
+	containers, err := ce.ListContainers(context.Background(), "10.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != FakeContainerID || containers[0].Names != "web" {
+		t.Fatalf("expected the web container, got %+v", containers)
+	}
+	images, err := ce.ListImages(context.Background(), "10.1.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].ID != FakeImageID {
+		t.Fatalf("expected the nginx image, got %+v", images)
+	}
+	var invalid *InvalidRequestError
+	if _, err := ce.ListContainers(context.Background(), "10.9.9.9"); !errors.As(err, &invalid) {
+		t.Fatalf("expected an unknown host to be rejected, got %v", err)
+	}
+}
+
+func TestListContainersTimeout(t *testing.T) {
+	transport := NewOnlineFakeHost().Delay(FakeListContainersCmd, time.Second)
+	ce := testExecutor(t, "timeouts:\n  list: 50ms\n"+FakeHostConfig("10.1.1.1"), transport)
+	start := time.Now()
+	_, err := ce.ListContainers(context.Background(), "10.1.1.1")
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("expected the list to give up after 50ms, took %s", time.Since(start))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ce.ListContainers(ctx, "10.1.1.1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancelled request to fail, got %v", err)
+	}
+}
+
+func TestPerformAction(t *testing.T) {
+	stop := fmt.Sprintf("docker 'stop' '%s'", FakeContainerID)
+	transport := NewOnlineFakeHost().On(stop, FakeContainerID+"\n", nil)
+	ce := testExecutor(t, FakeHostConfig("10.1.1.1"), transport)
+	// containers can be named by one of their names
+	if _, err := ce.PerformAction(context.Background(), "10.1.1.1", "web", "stop"); err != nil {
+		t.Fatal(err)
+	}
+	commands := transport.Commands()
+	if commands[len(commands)-1] != stop {
+		t.Fatalf("expected %q to run, got %v", stop, commands)
+	}
+	var invalid *InvalidRequestError
+	for _, test := range []struct{ container, action string }{
+		{container: "web", action: "rm -f"},
+		{container: "db", action: "stop"},
+		{container: "web; reboot", action: "stop"},
+	} {
+		if _, err := ce.PerformAction(context.Background(), "10.1.1.1", test.container, test.action); !errors.As(err, &invalid) {
+			t.Fatalf("expected %s of %q to be rejected, got %v", test.action, test.container, err)
+		}
+	}
+}
+
+func TestCreateContainer(t *testing.T) {
+	run := "docker run -d '--name' 'api' '-p' '8080:80' 'nginx:1.25'"
+	transport := NewOnlineFakeHost().
+		On(fmt.Sprintf(`docker inspect '%s' --format "{{ index .RepoTags 0 }}"`, FakeImageID), "nginx:1.25\n", nil).
+		On(run, "c0ffee\n", nil)
+	ce := testExecutor(t, FakeHostConfig("10.1.1.1"), transport)
+	out, err := ce.CreateContainer(context.Background(), "10.1.1.1", "nginx:1.25", "--name api -p 8080:80")
+	if err != nil {
+		t.Fatalf("%v, ran %v", err, transport.Commands())
+	}
+	if out != "c0ffee" {
+		t.Fatalf("expected the id of the container, got %q", out)
+	}
+	var invalid *InvalidRequestError
+	if _, err := ce.CreateContainer(context.Background(), "10.1.1.1", "redis:7", ""); !errors.As(err, &invalid) {
+		t.Fatalf("expected an image which is not on the host to be rejected, got %v", err)
+	}
+}
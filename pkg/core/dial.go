@@ -0,0 +1,307 @@
+package core
+
+import (
+	"context"
+	"crazydocker/pkg/config"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// hop is a single ssh connection on the way to a machine
+type hop struct {
+	address string
+	config  *ssh.ClientConfig
+	// release frees the resources used for authentication once dialed
+	release func()
+}
+
+// newClientConfig builds the client config used to authenticate against the
+// address, user overrides the username of the auth settings. Every configured
+// auth method is offered, public keys first and the password last.
+func newClientConfig(passwordAuth *config.PasswordAuth, sshAuth *config.SSHAuth, user string, timeout time.Duration, address string, knownHosts *KnownHosts) (*ssh.ClientConfig, func(), error) {
+	clientConfig := &ssh.ClientConfig{
+		User:              passwordAuth.Username,
+		HostKeyCallback:   knownHosts.HostKeyCallback(),
+		HostKeyAlgorithms: knownHosts.HostKeyAlgorithms(address),
+		Timeout:           defaultConnectTimeout,
+	}
+	if timeout > 0 {
+		clientConfig.Timeout = timeout
+	}
+	release := func() {}
+	// methods which can not be set up are skipped as long as another one is
+	// available, their errors are reported when nothing is left
+	errs := []error{}
+	signers := []ssh.Signer{}
+	var agentClient agent.ExtendedAgent
+	if sshAuth.UseAgent {
+		conn, err := dialAgent(sshAuth.AgentSocket)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			agentClient = agent.NewClient(conn)
+			release = func() { conn.Close() }
+		}
+	}
+	if sshAuth.PrivateKeyFile != "" {
+		keySigners, err := loadKeySigners(sshAuth)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			signers = keySigners
+		}
+	}
+	if len(signers) > 0 || agentClient != nil {
+		if sshAuth.Username != "" {
+			clientConfig.User = sshAuth.Username
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			// the ssh client only tries a method once, so the agent keys and
+			// the key file have to be offered by the same method
+			if agentClient == nil {
+				return signers, nil
+			}
+			agentSigners, err := agentClient.Signers()
+			if err != nil {
+				log.Printf("unable to list ssh-agent keys :%s\n", err)
+				return signers, nil
+			}
+			return append(agentSigners, signers...), nil
+		}))
+	}
+	if passwordAuth.Password != "" {
+		password, err := config.ResolveSecret(passwordAuth.Password)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("password: %w", err))
+		} else {
+			clientConfig.Auth = append(clientConfig.Auth, ssh.Password(password), ssh.KeyboardInteractive(passwordChallenge(password)))
+		}
+	}
+	if len(clientConfig.Auth) == 0 {
+		release()
+		if len(errs) > 0 {
+			return nil, nil, errors.Join(errs...)
+		}
+		return nil, nil, errors.New("no auth method configured")
+	}
+	for _, err := range errs {
+		log.Printf("skipping auth method for %s :%s\n", address, err)
+	}
+	if user != "" {
+		clientConfig.User = user
+	}
+	return clientConfig, release, nil
+}
+
+func dialAgent(socket string) (net.Conn, error) {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if socket == "" {
+		return nil, errors.New("ssh-agent requested but neither agentSocket nor SSH_AUTH_SOCK is set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ssh-agent: %w", err)
+	}
+	return conn, nil
+}
+
+// loadKeySigners parses the private key, decrypting it with the passphrase
+// when set, a certificate is offered before the bare key
+func loadKeySigners(sshAuth *config.SSHAuth) ([]ssh.Signer, error) {
+	pemByes, err := os.ReadFile(fmt.Sprintf("%s/%s", os.Getenv("CONFIG_FOLDER"), sshAuth.PrivateKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if sshAuth.Passphrase != "" {
+		passphrase, err := config.ResolveSecret(sshAuth.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("passphrase: %w", err)
+		}
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemByes, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decrypt %s: %w", sshAuth.PrivateKeyFile, err)
+		}
+	} else {
+		signer, err = ssh.ParsePrivateKey(pemByes)
+		var missingErr *ssh.PassphraseMissingError
+		if errors.As(err, &missingErr) {
+			return nil, fmt.Errorf("private key %s is encrypted, set a passphrase", sshAuth.PrivateKeyFile)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sshAuth.CertificateFile == "" {
+		return []ssh.Signer{signer}, nil
+	}
+	certBytes, err := os.ReadFile(fmt.Sprintf("%s/%s", os.Getenv("CONFIG_FOLDER"), sshAuth.CertificateFile))
+	if err != nil {
+		return nil, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate %s: %w", sshAuth.CertificateFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", sshAuth.CertificateFile)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// passwordChallenge answers every keyboard-interactive question with the
+// password, servers often only allow passwords through this method
+func passwordChallenge(password string) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = password
+		}
+		return answers, nil
+	}
+}
+
+// jumpHops returns the hops of the jump hosts in the order they are dialed
+func jumpHops(jumpHost *config.JumpHost, knownHosts *KnownHosts) ([]*hop, error) {
+	hops := []*hop{}
+	for _, j := range jumpHost.Chain() {
+		port := j.Port
+		if port == 0 {
+			port = config.DefaultSSHPort
+		}
+		address := net.JoinHostPort(j.Address, strconv.Itoa(port))
+		clientConfig, release, err := newClientConfig(&j.PasswordAuth, &j.SSHAuth, j.User, j.ConnectTimeout, address, knownHosts)
+		if err != nil {
+			releaseHops(hops)
+			return nil, fmt.Errorf("jump host %s: %w", address, err)
+		}
+		hops = append(hops, &hop{address: address, config: clientConfig, release: release})
+	}
+	return hops, nil
+}
+
+func releaseHops(hops []*hop) {
+	for _, h := range hops {
+		h.release()
+	}
+}
+
+// dialHops connects to the last hop tunneling through every hop before it,
+// closing the returned client closes the whole chain
+func dialHops(ctx context.Context, hops []*hop) (*ssh.Client, error) {
+	defer releaseHops(hops)
+	clients := []*ssh.Client{}
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	for i, h := range hops {
+		var client *ssh.Client
+		var err error
+		if i == 0 {
+			client, err = dialDirect(ctx, h.address, h.config)
+		} else {
+			client, err = dialThrough(ctx, clients[i-1], h.address, h.config)
+		}
+		if err != nil {
+			closeAll()
+			if len(hops) == 1 {
+				return nil, err
+			}
+			if i == len(hops)-1 {
+				return nil, fmt.Errorf("%s through jump host %s: %w", h.address, hops[i-1].address, err)
+			}
+			return nil, fmt.Errorf("jump host %s (hop %d of %d): %w", h.address, i+1, len(hops)-1, err)
+		}
+		clients = append(clients, client)
+	}
+	target := clients[len(clients)-1]
+	if len(clients) > 1 {
+		go func() {
+			target.Wait()
+			closeAll()
+		}()
+	}
+	return target, nil
+}
+
+// dialDirect opens an ssh connection to the address, unlike ssh.Dial the
+// timeout also covers the handshake so a host which accepts the connection
+// but never answers can not hang the pool
+func dialDirect(ctx context.Context, address string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := &net.Dialer{Timeout: clientConfig.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if clientConfig.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(clientConfig.Timeout))
+	}
+	c, chans, reqs, err := handshake(ctx, conn, address, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// dialThrough opens an ssh connection to the address over a tunnel of the
+// given client
+func dialThrough(ctx context.Context, via *ssh.Client, address string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// the tunnel does not support deadlines so close it if the handshake
+	// takes longer than the timeout
+	timer := time.AfterFunc(clientConfig.Timeout, func() {
+		conn.Close()
+	})
+	c, chans, reqs, err := handshake(ctx, conn, address, clientConfig)
+	if !timer.Stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, fmt.Errorf("handshake timed out after %s", clientConfig.Timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// handshake runs the ssh handshake on the connection, the connection is
+// closed when ctx is done before the handshake finished
+func handshake(ctx context.Context, conn net.Conn, address string, clientConfig *ssh.ClientConfig) (ssh.Conn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, clientConfig)
+	if !stop() {
+		if err == nil {
+			c.Close()
+		}
+		return nil, nil, nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return c, chans, reqs, nil
+}
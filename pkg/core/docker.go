@@ -0,0 +1,270 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const DockerAccessEngineAPI = "engine api"
+const DockerAccessCLI = "cli"
+
+const streamInterval = 5 * time.Second
+
+// dockerBackend runs docker operations on a machine, the operations are
+// stopped once their context is done
+type dockerBackend interface {
+	ListContainers(ctx context.Context) (Containers, error)
+	ListImages(ctx context.Context) (Images, error)
+	// InspectContainer and InspectImage return the inspect output as a
+	// JSON array, the same shape as the docker cli prints
+	InspectContainer(ctx context.Context, containerID string) ([]byte, error)
+	InspectImage(ctx context.Context, imageID string) ([]byte, error)
+	PerformAction(ctx context.Context, containerID string, action ContainerAction) (string, error)
+	// CreateContainer runs a detached container of the image with the
+	// docker run arguments and returns its id, the arguments are checked by
+	// parseRunArgs
+	CreateContainer(ctx context.Context, imageID string, args string) (string, error)
+	StreamLogs(ctx context.Context, writeConn *websocket.Conn, containerID string, size TerminalSize) error
+	ExecContainer(ctx context.Context, writeConn *websocket.Conn, containerID string, size TerminalSize) error
+}
+
+// dockerAccess picks and caches the backend used to reach docker on a machine
+type dockerAccess struct {
+	lock    sync.Mutex
+	backend dockerBackend
+}
+
+// close releases the connections of the engine api client
+func (d *dockerAccess) close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if engine, ok := d.backend.(*engineBackend); ok {
+		engine.client.Close()
+	}
+}
+
+// dockerBackend returns the engine api backend when the docker socket can be
+// reached through the ssh connection and falls back to the cli otherwise,
+// docker endpoints always use the engine api
+func (m *Machine) dockerBackend(ctx context.Context) (dockerBackend, error) {
+	m.docker.lock.Lock()
+	defer m.docker.lock.Unlock()
+	if m.docker.backend != nil {
+		return m.docker.backend, nil
+	}
+	if m.endpoint != nil {
+		// endpoints have no cli to fall back to, the connection is retried
+		// on the next call
+		engine, err := newEndpointEngineBackend(ctx, m.endpoint)
+		if err != nil {
+			m.setStatus(MachineOffline)
+			return nil, err
+		}
+		m.docker.backend = engine
+		m.update(func() {
+			m.DockerAccess = DockerAccessEngineAPI
+			m.Status = MachineOnline
+		})
+		return engine, nil
+	}
+	if err := m.transport.Connect(ctx); err != nil {
+		// without a connection there is nothing to probe, the cli reports
+		// the connection error and the probe is retried on the next call
+		return &cliBackend{m: m}, nil
+	}
+	network, address, ok := (&cliBackend{m: m}).command().socket()
+	if !ok {
+		// docker is only usable through the cli, for example with sudo
+		m.docker.backend = &cliBackend{m: m}
+		m.update(func() { m.DockerAccess = DockerAccessCLI })
+		return m.docker.backend, nil
+	}
+	engine, err := newSSHEngineBackend(ctx, m, network, address)
+	if err != nil {
+		log.Printf("docker engine api not reachable on %s, falling back to cli :%s\n", m.Ip, err)
+		m.docker.backend = &cliBackend{m: m}
+		m.update(func() { m.DockerAccess = DockerAccessCLI })
+	} else {
+		m.docker.backend = engine
+		m.update(func() { m.DockerAccess = DockerAccessEngineAPI })
+	}
+	return m.docker.backend, nil
+}
+
+// cliBackend runs the docker cli over ssh and parses its output
+type cliBackend struct {
+	m *Machine
+}
+
+func (b *cliBackend) command() dockerCommand {
+	if b.m.SSHConfig == nil {
+		return dockerCommand{}
+	}
+	return dockerCommand{escalation: b.m.SSHConfig.PrivilegeEscalation}
+}
+
+// run runs docker with the arguments
+func (b *cliBackend) run(ctx context.Context, args string) (string, error) {
+	docker := b.command()
+	stdin, err := docker.stdin()
+	if err != nil {
+		return "", err
+	}
+	return b.m.runCommand(ctx, docker.build(args), stdin)
+}
+
+func (b *cliBackend) ListContainers(ctx context.Context) (Containers, error) {
+	out, err := b.run(ctx, `container ls --all --format "{{json . }}" --no-trunc`)
+	if err != nil {
+		return nil, err
+	}
+	return marshalOut[Container](out), nil
+}
+
+func (b *cliBackend) ListImages(ctx context.Context) (Images, error) {
+	out, err := b.run(ctx, `image ls --all --format "{{json . }}" --no-trunc`)
+	if err != nil {
+		return nil, err
+	}
+	return marshalOut[Image](out), nil
+}
+
+func (b *cliBackend) InspectContainer(ctx context.Context, containerID string) ([]byte, error) {
+	out, err := b.run(ctx, fmt.Sprintf("container inspect %s", shellQuote(containerID)))
+	return []byte(out), err
+}
+
+func (b *cliBackend) InspectImage(ctx context.Context, imageID string) ([]byte, error) {
+	out, err := b.run(ctx, fmt.Sprintf("image inspect %s", shellQuote(imageID)))
+	return []byte(out), err
+}
+
+func (b *cliBackend) PerformAction(ctx context.Context, containerID string, action ContainerAction) (string, error) {
+	return b.run(ctx, fmt.Sprintf("%s %s", shellQuote(string(action)), shellQuote(containerID)))
+}
+
+func (b *cliBackend) CreateContainer(ctx context.Context, imageID string, args string) (string, error) {
+	words, err := splitArgs(args)
+	if err != nil {
+		return "", err
+	}
+	// the tag is looked up first so that sudo is only asked once per command
+	image, err := b.run(ctx, fmt.Sprintf(`inspect %s --format "{{ index .RepoTags 0 }}"`, shellQuote(imageID)))
+	if err != nil {
+		return image, err
+	}
+	// every argument is passed as a single word, whatever the shell would
+	// make of it
+	quoted := []string{}
+	for _, word := range words {
+		quoted = append(quoted, shellQuote(word))
+	}
+	return b.run(ctx, fmt.Sprintf("run -d %s %s", strings.Join(quoted, " "), shellQuote(strings.TrimSpace(image))))
+}
+
+func (b *cliBackend) StreamLogs(ctx context.Context, writeConn *websocket.Conn, containerID string, size TerminalSize) error {
+	docker := b.command()
+	stdin, err := docker.stdin()
+	if err != nil {
+		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		writeConn.Close()
+		return err
+	}
+	return b.m.streamCommand(ctx, writeConn, docker.build(fmt.Sprintf("logs --follow %s", shellQuote(containerID))), stdin)
+}
+
+func (b *cliBackend) ExecContainer(ctx context.Context, writeConn *websocket.Conn, containerID string, size TerminalSize) error {
+	docker := b.command()
+	askpass, err := b.askpass(ctx, docker)
+	if err != nil {
+		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		writeConn.Close()
+		return err
+	}
+	defer b.removeAskpass(ctx, askpass)
+	return b.m.execCommand(ctx, writeConn, docker.buildTerminal(fmt.Sprintf("exec -it %s sh", shellQuote(containerID)), askpass), size)
+}
+
+// askpass creates the askpass helper of a terminal session on the host and
+// returns its path, it is empty when sudo needs no password. The password
+// is never written to the pty where it would end up in the session.
+func (b *cliBackend) askpass(ctx context.Context, docker dockerCommand) (string, error) {
+	password, err := docker.password()
+	if password == "" || err != nil {
+		return "", err
+	}
+	path, err := b.m.runCommand(ctx, askpassCommand, askpassScript(password))
+	if err != nil {
+		return "", fmt.Errorf("unable to create the sudo askpass helper: %w", err)
+	}
+	return path, nil
+}
+
+// removeAskpass removes the helper in case sudo did not ask for the
+// password, the helper removes itself otherwise
+func (b *cliBackend) removeAskpass(ctx context.Context, askpass string) {
+	if askpass == "" {
+		return
+	}
+	// the session may have ended because the request was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), defaultConnectTimeout)
+	defer cancel()
+	if _, err := b.m.runCommand(ctx, "rm -f "+shellQuote(askpass), ""); err != nil {
+		log.Printf("unable to remove the sudo askpass helper %s on %s :%s\n", askpass, b.m.Ip, err)
+	}
+}
+
+// pollStream writes the output of fetch to the websocket every few seconds
+// until the client goes away, fetch is cancelled once that happens
+func pollStream(ctx context.Context, writeConn *websocket.Conn, fetch func(ctx context.Context) ([]byte, error)) {
+	defer writeConn.Close()
+	// the request is done once the handler returns, only the client going
+	// away stops the stream
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	closed := readUntilClosed(writeConn)
+	go func() {
+		<-closed
+		cancel()
+	}()
+	ticker := time.NewTicker(streamInterval)
+	defer ticker.Stop()
+	for {
+		err := writeConn.WriteMessage(websocket.PingMessage, []byte(""))
+		if err != nil {
+			return
+		}
+		output, err := fetch(ctx)
+		if err != nil {
+			writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		} else {
+			writeConn.WriteMessage(websocket.TextMessage, output)
+		}
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+	}
+}
+
+// readUntilClosed discards the messages of a write only websocket, the
+// returned channel is closed once the client goes away
+func readUntilClosed(conn *websocket.Conn) <-chan struct{} {
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	return closed
+}
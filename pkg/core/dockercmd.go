@@ -0,0 +1,108 @@
+package core
+
+import (
+	"crazydocker/pkg/config"
+	"fmt"
+	"strings"
+)
+
+// dockerCommand builds the docker cli commands of a host, applying its
+// privilege escalation
+type dockerCommand struct {
+	escalation *config.PrivilegeEscalation
+}
+
+// build returns the command running docker with the arguments, sudo reads
+// the password from stdin
+func (d dockerCommand) build(args string) string {
+	// -S reads the password from stdin, the empty prompt keeps it out of the
+	// output
+	return d.escalate(args, "sudo -S -p ''")
+}
+
+// buildTerminal returns the command running docker with the arguments on a
+// pty, sudo asks the askpass helper for the password instead of reading it
+// from the terminal. Without a helper sudo prompts in the terminal when it
+// needs a password.
+func (d dockerCommand) buildTerminal(args string, askpass string) string {
+	if askpass == "" {
+		return d.escalate(args, "sudo")
+	}
+	return d.escalate(args, fmt.Sprintf("SUDO_ASKPASS=%s sudo -A", shellQuote(askpass)))
+}
+
+func (d dockerCommand) escalate(args string, sudo string) string {
+	binary := "docker"
+	if d.escalation == nil {
+		return fmt.Sprintf("%s %s", binary, args)
+	}
+	if d.escalation.DockerBinary != "" {
+		binary = shellQuote(d.escalation.DockerBinary)
+	}
+	cmd := fmt.Sprintf("%s %s", binary, args)
+	if d.escalation.DockerHost != "" {
+		// env sets the variable after sudo reset the environment, sudo
+		// itself only accepts variables the sudoers policy allows
+		cmd = fmt.Sprintf("env DOCKER_HOST=%s %s", shellQuote(d.escalation.DockerHost), cmd)
+	}
+	if d.escalation.Sudo {
+		cmd = fmt.Sprintf("%s %s", sudo, cmd)
+	}
+	return cmd
+}
+
+// password returns the sudo password, it is empty when sudo is not used or
+// does not need one
+func (d dockerCommand) password() (string, error) {
+	if d.escalation == nil || !d.escalation.Sudo || d.escalation.SudoPassword == "" {
+		return "", nil
+	}
+	password, err := config.ResolveSecret(d.escalation.SudoPassword)
+	if err != nil {
+		return "", fmt.Errorf("sudo password: %w", err)
+	}
+	return password, nil
+}
+
+// stdin returns what has to be written to the command before anything else,
+// the sudo password when one is set
+func (d dockerCommand) stdin() (string, error) {
+	password, err := d.password()
+	if password == "" || err != nil {
+		return "", err
+	}
+	return password + "\n", nil
+}
+
+// askpassCommand creates the askpass helper from its stdin and prints its
+// path, the helper is only readable by the ssh user
+const askpassCommand = `umask 077 && f=$(mktemp) && cat > "$f" && chmod 700 "$f" && echo "$f"`
+
+// askpassScript prints the password once for sudo -A and removes itself
+func askpassScript(password string) string {
+	return fmt.Sprintf("#!/bin/sh\nrm -f \"$0\"\nprintf '%%s\\n' %s\n", shellQuote(password))
+}
+
+// socket returns the network and address of the docker daemon as seen from
+// the host, ok is false when the engine api can not be used directly
+func (d dockerCommand) socket() (network string, address string, ok bool) {
+	if d.escalation == nil || d.escalation.DockerHost == "" {
+		if d.escalation != nil && d.escalation.Sudo {
+			// the user needs sudo so the socket is not accessible
+			return "", "", false
+		}
+		return "unix", dockerSocket, true
+	}
+	switch {
+	case strings.HasPrefix(d.escalation.DockerHost, "unix://"):
+		return "unix", strings.TrimPrefix(d.escalation.DockerHost, "unix://"), !d.escalation.Sudo
+	case strings.HasPrefix(d.escalation.DockerHost, "tcp://"):
+		return "tcp", strings.TrimPrefix(d.escalation.DockerHost, "tcp://"), true
+	}
+	return "", "", false
+}
+
+// shellQuote quotes the value for a posix shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
@@ -0,0 +1,66 @@
+package core
+
+import (
+	"crazydocker/pkg/config"
+	"strings"
+	"testing"
+)
+
+func TestDockerCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		escalation *config.PrivilegeEscalation
+		command    string
+		terminal   string
+	}{
+		{
+			name:     "without escalation",
+			command:  "docker ps",
+			terminal: "docker ps",
+		},
+		{
+			name:       "sudo",
+			escalation: &config.PrivilegeEscalation{Sudo: true, SudoPassword: "secret"},
+			command:    "sudo -S -p '' docker ps",
+			terminal:   "SUDO_ASKPASS='/tmp/askpass' sudo -A docker ps",
+		},
+		{
+			name:       "sudo with a docker host and binary",
+			escalation: &config.PrivilegeEscalation{Sudo: true, DockerHost: "unix:///run/docker.sock", DockerBinary: "/opt/docker"},
+			command:    "sudo -S -p '' env DOCKER_HOST='unix:///run/docker.sock' '/opt/docker' ps",
+			terminal:   "SUDO_ASKPASS='/tmp/askpass' sudo -A env DOCKER_HOST='unix:///run/docker.sock' '/opt/docker' ps",
+		},
+		{
+			name:       "docker host without sudo",
+			escalation: &config.PrivilegeEscalation{DockerHost: "tcp://10.0.0.1:2375"},
+			command:    "env DOCKER_HOST='tcp://10.0.0.1:2375' docker ps",
+			terminal:   "env DOCKER_HOST='tcp://10.0.0.1:2375' docker ps",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			docker := dockerCommand{escalation: test.escalation}
+			if command := docker.build("ps"); command != test.command {
+				t.Fatalf("expected %q, got %q", test.command, command)
+			}
+			if terminal := docker.buildTerminal("ps", "/tmp/askpass"); terminal != test.terminal {
+				t.Fatalf("expected %q, got %q", test.terminal, terminal)
+			}
+		})
+	}
+	// without a password sudo prompts in the terminal
+	docker := dockerCommand{escalation: &config.PrivilegeEscalation{Sudo: true}}
+	if terminal := docker.buildTerminal("ps", ""); terminal != "sudo docker ps" {
+		t.Fatalf("expected plain sudo, got %q", terminal)
+	}
+}
+
+func TestAskpassScript(t *testing.T) {
+	script := askpassScript("it's secret")
+	if !strings.HasPrefix(script, "#!/bin/sh\nrm -f \"$0\"\n") {
+		t.Fatalf("expected the helper to remove itself first, got %q", script)
+	}
+	if !strings.Contains(script, `printf '%s\n' 'it'"'"'s secret'`) {
+		t.Fatalf("expected the quoted password, got %q", script)
+	}
+}
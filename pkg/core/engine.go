@@ -0,0 +1,434 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crazydocker/pkg/config"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+	units "github.com/docker/go-units"
+	"github.com/gorilla/websocket"
+)
+
+const dockerSocket = "/var/run/docker.sock"
+const engineProbeTimeout = 5 * time.Second
+
+// engineBackend talks to the docker engine api
+type engineBackend struct {
+	client *docker.Client
+	// cli runs what the engine api can not do through an ssh tunnel, it is
+	// nil for docker endpoints
+	cli *cliBackend
+}
+
+// newSSHEngineBackend returns a backend reaching the docker daemon listening
+// on the address of the machine through its transport
+func newSSHEngineBackend(ctx context.Context, m *Machine, network string, address string) (*engineBackend, error) {
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return m.transport.Dial(ctx, network, address)
+			},
+		},
+	}
+	engine, err := newEngineBackend(ctx, fmt.Sprintf("unix://%s", dockerSocket), httpClient)
+	if err != nil {
+		return nil, err
+	}
+	engine.cli = &cliBackend{m: m}
+	return engine, nil
+}
+
+// newEndpointEngineBackend returns a backend talking to the daemon of a
+// docker endpoint directly
+func newEndpointEngineBackend(ctx context.Context, endpoint *config.DockerEndpoint) (*engineBackend, error) {
+	if endpoint.TLS == nil {
+		// the client sets up the socket or tcp transport itself
+		return newEngineBackend(ctx, endpoint.Host, nil)
+	}
+	tlsConfig, err := tlsconfig.Client(tlsconfig.Options{
+		CAFile:   configFile(endpoint.TLS.CAFile),
+		CertFile: configFile(endpoint.TLS.CertFile),
+		KeyFile:  configFile(endpoint.TLS.KeyFile),
+	})
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	return newEngineBackend(ctx, endpoint.Host, httpClient)
+}
+
+// configFile returns the path of a file in the config folder, empty names
+// stay empty
+func configFile(name string) string {
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", os.Getenv("CONFIG_FOLDER"), name)
+}
+
+func newEngineBackend(ctx context.Context, host string, httpClient *http.Client) (*engineBackend, error) {
+	opts := []docker.Opt{docker.WithHost(host), docker.WithAPIVersionNegotiation()}
+	if httpClient != nil {
+		opts = append(opts, docker.WithHTTPClient(httpClient))
+	}
+	client, err := docker.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, engineProbeTimeout)
+	defer cancel()
+	if _, err := client.Ping(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	client.NegotiateAPIVersion(ctx)
+	return &engineBackend{client: client}, nil
+}
+
+func (b *engineBackend) ListContainers(ctx context.Context) (Containers, error) {
+	list, err := b.client.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	containers := Containers{}
+	for _, c := range list {
+		containers = append(containers, containerFromAPI(c))
+	}
+	return containers, nil
+}
+
+func (b *engineBackend) ListImages(ctx context.Context) (Images, error) {
+	list, err := b.client.ImageList(ctx, image.ListOptions{All: true})
+	if err != nil {
+		return nil, err
+	}
+	images := Images{}
+	for _, i := range list {
+		images = append(images, imagesFromAPI(i)...)
+	}
+	return images, nil
+}
+
+func (b *engineBackend) InspectContainer(ctx context.Context, containerID string) ([]byte, error) {
+	_, raw, err := b.client.ContainerInspectWithRaw(ctx, containerID, false)
+	if err != nil {
+		return nil, err
+	}
+	return inspectArray(raw), nil
+}
+
+func (b *engineBackend) InspectImage(ctx context.Context, imageID string) ([]byte, error) {
+	_, raw, err := b.client.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		return nil, err
+	}
+	return inspectArray(raw), nil
+}
+
+// hostInfo returns the host name and operating system reported by the daemon
+func (b *engineBackend) hostInfo(ctx context.Context) (string, string, error) {
+	info, err := b.client.Info(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return info.Name, info.OperatingSystem, nil
+}
+
+func (b *engineBackend) PerformAction(ctx context.Context, containerID string, action ContainerAction) (string, error) {
+	var err error
+	switch action {
+	case ActionStart:
+		err = b.client.ContainerStart(ctx, containerID, container.StartOptions{})
+	case ActionStop:
+		err = b.client.ContainerStop(ctx, containerID, container.StopOptions{})
+	case ActionRestart:
+		err = b.client.ContainerRestart(ctx, containerID, container.StopOptions{})
+	case ActionKill:
+		err = b.client.ContainerKill(ctx, containerID, "KILL")
+	case ActionPause:
+		err = b.client.ContainerPause(ctx, containerID)
+	case ActionUnpause:
+		err = b.client.ContainerUnpause(ctx, containerID)
+	case ActionRemove:
+		err = b.client.ContainerRemove(ctx, containerID, container.RemoveOptions{})
+	default:
+		return "", fmt.Errorf("action %s is not supported by the engine api", action)
+	}
+	if err != nil {
+		return "", err
+	}
+	return containerID, nil
+}
+
+func (b *engineBackend) StreamLogs(ctx context.Context, writeConn *websocket.Conn, containerID string, size TerminalSize) error {
+	defer writeConn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	info, err := b.client.ContainerInspect(ctx, containerID)
+	if err != nil {
+		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		return err
+	}
+	logs, err := b.client.ContainerLogs(ctx, containerID, container.LogsOptions{ShowStdout: true, ShowStderr: true, Follow: true})
+	if err != nil {
+		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		return err
+	}
+	defer logs.Close()
+	// stop following the logs once the client goes away
+	go func() {
+		<-readUntilClosed(writeConn)
+		cancel()
+	}()
+	var reader io.Reader = logs
+	if info.Config == nil || !info.Config.Tty {
+		// logs of containers without a tty are multiplexed and use bare new
+		// lines which the browser terminal does not return the cursor on
+		reader = &terminalNewlines{r: &logDemuxer{r: logs}}
+	}
+	buf := make([]byte, 1024)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if err := writeConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				return nil
+			}
+		}
+		if err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (b *engineBackend) CreateContainer(ctx context.Context, imageID string, args string) (string, error) {
+	opts, err := parseRunArgs(args)
+	if err != nil {
+		return "", err
+	}
+	inspected, _, err := b.client.ImageInspectWithRaw(ctx, imageID)
+	if err != nil {
+		return "", err
+	}
+	opts.config.Image = inspected.ID
+	if len(inspected.RepoTags) > 0 {
+		opts.config.Image = inspected.RepoTags[0]
+	}
+	created, err := b.client.ContainerCreate(ctx, opts.config, opts.hostConfig, nil, nil, opts.name)
+	if err != nil {
+		return "", err
+	}
+	if err := b.client.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (b *engineBackend) ExecContainer(ctx context.Context, writeConn *websocket.Conn, containerID string, size TerminalSize) error {
+	if b.cli != nil {
+		// hijacked connections dial the daemon address directly and can not
+		// go through the ssh tunnel
+		return b.cli.ExecContainer(ctx, writeConn, containerID, size)
+	}
+	defer writeConn.Close()
+	exec, err := b.client.ContainerExecCreate(ctx, containerID, container.ExecOptions{Tty: true, AttachStdin: true, AttachStdout: true, AttachStderr: true, Cmd: []string{"sh"}})
+	if err != nil {
+		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		return err
+	}
+	resp, err := b.client.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{Tty: true})
+	if err != nil {
+		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
+		return err
+	}
+	defer resp.Close()
+	resize := func(size TerminalSize) error {
+		return b.client.ContainerExecResize(ctx, exec.ID, container.ResizeOptions{Height: uint(size.Rows), Width: uint(size.Cols)})
+	}
+	if err := resize(size.withDefaults()); err != nil {
+		log.Printf("resize err :%s\n", err)
+	}
+	stdout, resize := recordTerminal(ctx, size, resp.Reader, resize)
+	go func() {
+		// closing the connection ends the shell once the client is gone
+		defer resp.Close()
+		readTerminalInput(writeConn, resp.Conn, resize)
+	}()
+	writeTerminalOutput(writeConn, stdout)
+	return nil
+}
+
+// inspectArray wraps the raw inspect output in an array like the cli does
+func inspectArray(raw []byte) []byte {
+	return []byte(fmt.Sprintf("[%s]", raw))
+}
+
+// logDemuxer strips the stream headers of multiplexed container logs, every
+// frame starts with an 8 byte header holding the stream and the frame size
+type logDemuxer struct {
+	r         io.Reader
+	remaining uint32
+}
+
+func (d *logDemuxer) Read(p []byte) (int, error) {
+	for d.remaining == 0 {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return 0, err
+		}
+		d.remaining = binary.BigEndian.Uint32(header[4:])
+	}
+	if uint32(len(p)) > d.remaining {
+		p = p[:d.remaining]
+	}
+	n, err := d.r.Read(p)
+	d.remaining -= uint32(n)
+	return n, err
+}
+
+// terminalNewlines turns \n into \r\n
+type terminalNewlines struct {
+	r io.Reader
+	// pending holds the converted bytes which did not fit into the last
+	// read, err is returned once they are consumed
+	pending bytes.Buffer
+	err     error
+}
+
+func (t *terminalNewlines) Read(p []byte) (int, error) {
+	if t.pending.Len() == 0 && t.err == nil {
+		buf := make([]byte, len(p))
+		n, err := t.r.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				t.pending.WriteByte('\r')
+			}
+			t.pending.WriteByte(b)
+		}
+		t.err = err
+	}
+	n, _ := t.pending.Read(p)
+	if t.pending.Len() > 0 {
+		return n, nil
+	}
+	err := t.err
+	t.err = nil
+	return n, err
+}
+
+// containerFromAPI converts the api type to the format printed by
+// docker container ls --format "{{json . }}"
+func containerFromAPI(c container.Summary) *Container {
+	created := time.Unix(c.Created, 0)
+	names := []string{}
+	for _, name := range c.Names {
+		names = append(names, strings.TrimPrefix(name, "/"))
+	}
+	labels := []string{}
+	for k, v := range c.Labels {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(labels)
+	mounts := []string{}
+	localVolumes := 0
+	for _, mount := range c.Mounts {
+		if mount.Name != "" {
+			mounts = append(mounts, mount.Name)
+		} else {
+			mounts = append(mounts, mount.Source)
+		}
+		if mount.Type == "volume" && mount.Driver == "local" {
+			localVolumes++
+		}
+	}
+	networks := []string{}
+	if c.NetworkSettings != nil {
+		for name := range c.NetworkSettings.Networks {
+			networks = append(networks, name)
+		}
+	}
+	sort.Strings(networks)
+	ports := []string{}
+	for _, p := range c.Ports {
+		if p.PublicPort != 0 {
+			ports = append(ports, fmt.Sprintf("%s:%d->%d/%s", p.IP, p.PublicPort, p.PrivatePort, p.Type))
+		} else {
+			ports = append(ports, fmt.Sprintf("%d/%s", p.PrivatePort, p.Type))
+		}
+	}
+	return &Container{
+		Command:      fmt.Sprintf("\"%s\"", c.Command),
+		CreatedAt:    created.Format("2006-01-02 15:04:05 -0700 MST"),
+		ID:           c.ID,
+		Image:        c.Image,
+		Labels:       strings.Join(labels, ","),
+		LocalVolumes: strconv.Itoa(localVolumes),
+		Mounts:       strings.Join(mounts, ","),
+		Names:        strings.Join(names, ","),
+		Networks:     strings.Join(networks, ","),
+		Ports:        strings.Join(ports, ", "),
+		RunningFor:   fmt.Sprintf("%s ago", units.HumanDuration(time.Since(created))),
+		State:        c.State,
+		Status:       c.Status,
+	}
+}
+
+// imagesFromAPI converts the api type to the format printed by
+// docker image ls --format "{{json . }}", with a row per tag
+func imagesFromAPI(i image.Summary) []*Image {
+	created := time.Unix(i.Created, 0)
+	digest := "<none>"
+	if len(i.RepoDigests) > 0 {
+		if idx := strings.LastIndex(i.RepoDigests[0], "@"); idx != -1 {
+			digest = i.RepoDigests[0][idx+1:]
+		}
+	}
+	containers := "N/A"
+	if i.Containers >= 0 {
+		containers = strconv.FormatInt(i.Containers, 10)
+	}
+	repoTags := i.RepoTags
+	if len(repoTags) == 0 {
+		repoTags = []string{"<none>:<none>"}
+	}
+	images := []*Image{}
+	for _, repoTag := range repoTags {
+		repository, tag := repoTag, "<none>"
+		if idx := strings.LastIndex(repoTag, ":"); idx != -1 && !strings.Contains(repoTag[idx:], "/") {
+			repository, tag = repoTag[:idx], repoTag[idx+1:]
+		}
+		images = append(images, &Image{
+			Containers:   containers,
+			CreatedAt:    created.Format("2006-01-02 15:04:05 -0700 MST"),
+			CreatedSince: fmt.Sprintf("%s ago", units.HumanDuration(time.Since(created))),
+			Digest:       digest,
+			ID:           i.ID,
+			Repository:   repository,
+			SharedSize:   "N/A",
+			Size:         units.HumanSizeWithPrecision(float64(i.Size), 3),
+			Tag:          tag,
+			UniqueSize:   "N/A",
+			VirtualSize:  units.HumanSizeWithPrecision(float64(i.VirtualSize), 3),
+		})
+	}
+	return images
+}
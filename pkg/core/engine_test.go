@@ -0,0 +1,51 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestTerminalNewlines(t *testing.T) {
+	input := "a\nbc\n\n\nd"
+	expected := "a\r\nbc\r\n\r\n\r\nd"
+	for _, size := range []int{1, 2, 3, 4, 7, 64} {
+		reader := &terminalNewlines{r: strings.NewReader(input)}
+		var out bytes.Buffer
+		p := make([]byte, size)
+		for {
+			n, err := reader.Read(p)
+			if n > len(p) {
+				t.Fatalf("read %d bytes into a buffer of %d", n, len(p))
+			}
+			out.Write(p[:n])
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if out.String() != expected {
+			t.Fatalf("expected %q with reads of %d bytes, got %q", expected, size, out.String())
+		}
+	}
+	if err := iotest.TestReader(&terminalNewlines{r: iotest.OneByteReader(strings.NewReader(input))}, []byte(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTerminalNewlinesKeepsErrorUntilDrained(t *testing.T) {
+	reader := &terminalNewlines{r: iotest.DataErrReader(strings.NewReader("\n\n"))}
+	p := make([]byte, 2)
+	n, err := reader.Read(p)
+	if n != 2 || err != nil {
+		t.Fatalf("expected 2 bytes without an error, got %d and %v", n, err)
+	}
+	n, err = reader.Read(p)
+	if n != 2 || err != io.EOF {
+		t.Fatalf("expected the last 2 bytes with io.EOF, got %d and %v", n, err)
+	}
+}
@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crazydocker/pkg/config"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commands the executor runs to probe a host and to list its containers and
+// images through the cli
+const (
+	FakeHostnameCmd       = `hostnamectl | grep -Ei "Static hostname|Operating System" | cut -f2 -d ":"`
+	FakeListContainersCmd = `docker container ls --all --format "{{json . }}" --no-trunc`
+	FakeListImagesCmd     = `docker image ls --all --format "{{json . }}" --no-trunc`
+)
+
+// the web container and the nginx image of NewOnlineFakeHost
+const (
+	FakeContainerID = "3f4e1b2c9d8a"
+	FakeImageID     = "sha256:a8758716bb6a"
+)
+
+// FakeTransport is a scriptable in-memory transport for tests, commands are
+// answered with the responses registered through On
+type FakeTransport struct {
+	lock      sync.Mutex
+	responses map[string]FakeResponse
+	commands  []string
+	terminals []*FakeTerminal
+	// Err is returned by every call when set, it simulates a host which can
+	// not be reached
+	Err error
+	// Dialer is used by Dial, without it the docker socket can not be reached
+	// and the cli is used
+	Dialer func(network, address string) (net.Conn, error)
+}
+
+// FakeResponse is the scripted result of a command
+type FakeResponse struct {
+	Output string
+	Err    error
+	// Delay is waited before answering, it simulates a hung command
+	Delay time.Duration
+}
+
+func NewFakeTransport() *FakeTransport {
+	return &FakeTransport{responses: map[string]FakeResponse{}}
+}
+
+// NewOnlineFakeHost returns a fake transport answering the probes run when
+// the machines are loaded, it lists the web container and the nginx image
+func NewOnlineFakeHost() *FakeTransport {
+	return NewFakeTransport().
+		On(FakeHostnameCmd, " web-1\n Ubuntu 22.04.4 LTS\n", nil).
+		On("echo $SHELL", "/bin/bash\n", nil).
+		On(FakeListContainersCmd, `{"ID":"`+FakeContainerID+`","Names":"web","Image":"nginx:1.25","State":"running"}`+"\n", nil).
+		On(FakeListImagesCmd, `{"ID":"`+FakeImageID+`","Repository":"nginx","Tag":"1.25"}`+"\n", nil)
+}
+
+// FakeHostConfig is a config with a single password host
+func FakeHostConfig(ip string) string {
+	return "configList:\n  - sshConfig:\n      passwordAuth:\n        username: deploy\n        password: secret\n      ips:\n        - " + ip + "\n"
+}
+
+// NewFakeExecutor starts a command executor on the yaml config, the config
+// and the known hosts are kept in dir. The hosts use the transport, or ssh
+// when it is nil.
+func NewFakeExecutor(dir string, yaml string, transport Transport) (*CommandExecutor, error) {
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0600); err != nil {
+		return nil, err
+	}
+	c, err := config.NewConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	knownHosts, err := NewKnownHosts(filepath.Join(dir, "known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+	opts := []Option{WithConfig(c), WithKnownHosts(knownHosts)}
+	if transport != nil {
+		opts = append(opts, WithTransport(func(m *Machine) Transport { return transport }))
+	}
+	return NewCommandExecutor(opts...)
+}
+
+// On sets the output and error returned for the command
+func (f *FakeTransport) On(cmd string, output string, err error) *FakeTransport {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.responses[cmd] = FakeResponse{Output: output, Err: err}
+	return f
+}
+
+// Delay makes the command wait before answering
+func (f *FakeTransport) Delay(cmd string, delay time.Duration) *FakeTransport {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	response := f.responses[cmd]
+	response.Delay = delay
+	f.responses[cmd] = response
+	return f
+}
+
+// Commands returns every command run so far in order
+func (f *FakeTransport) Commands() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+// Terminals returns the terminals opened so far in order
+func (f *FakeTransport) Terminals() []*FakeTerminal {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]*FakeTerminal{}, f.terminals...)
+}
+
+func (f *FakeTransport) respond(ctx context.Context, cmd string) (FakeResponse, error) {
+	f.lock.Lock()
+	if f.Err != nil {
+		f.lock.Unlock()
+		return FakeResponse{}, &ConnectionError{Err: f.Err}
+	}
+	f.commands = append(f.commands, cmd)
+	response, ok := f.responses[cmd]
+	f.lock.Unlock()
+	if !ok {
+		return FakeResponse{}, fmt.Errorf("fake transport: no response for %q", cmd)
+	}
+	if response.Delay > 0 {
+		timer := time.NewTimer(response.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return FakeResponse{}, ctx.Err()
+		}
+	}
+	return response, nil
+}
+
+func (f *FakeTransport) Connect(ctx context.Context) error {
+	if f.Err != nil {
+		return &ConnectionError{Err: f.Err}
+	}
+	return nil
+}
+
+func (f *FakeTransport) Run(ctx context.Context, cmd string, stdin string) (string, error) {
+	response, err := f.respond(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	return response.Output, response.Err
+}
+
+func (f *FakeTransport) Stream(ctx context.Context, cmd string, stdin string) (io.ReadCloser, error) {
+	response, err := f.respond(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(&errReader{r: strings.NewReader(response.Output), err: response.Err}), nil
+}
+
+func (f *FakeTransport) Interactive(ctx context.Context, cmd string, size TerminalSize) (Terminal, error) {
+	response, err := f.respond(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	terminal := &FakeTerminal{Cmd: cmd, output: strings.NewReader(response.Output), err: response.Err, sizes: []TerminalSize{size.withDefaults()}}
+	f.lock.Lock()
+	f.terminals = append(f.terminals, terminal)
+	f.lock.Unlock()
+	return terminal, nil
+}
+
+func (f *FakeTransport) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if f.Err != nil {
+		return nil, &ConnectionError{Err: f.Err}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.Dialer == nil {
+		return nil, errors.New("fake transport: dial is not supported")
+	}
+	return f.Dialer(network, address)
+}
+
+func (f *FakeTransport) Close() error {
+	return nil
+}
+
+// FakeTerminal replays the scripted output of a command and records what is
+// sent to it
+type FakeTerminal struct {
+	Cmd    string
+	lock   sync.Mutex
+	output io.Reader
+	err    error
+	input  bytes.Buffer
+	sizes  []TerminalSize
+}
+
+func (t *FakeTerminal) Read(p []byte) (int, error) {
+	return t.output.Read(p)
+}
+
+func (t *FakeTerminal) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.input.Write(p)
+}
+
+func (t *FakeTerminal) Resize(size TerminalSize) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sizes = append(t.sizes, size)
+	return nil
+}
+
+func (t *FakeTerminal) Wait() error {
+	return t.err
+}
+
+func (t *FakeTerminal) Close() error {
+	return nil
+}
+
+// Input returns the keystrokes written to the terminal
+func (t *FakeTerminal) Input() []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]byte{}, t.input.Bytes()...)
+}
+
+// Sizes returns the size the terminal was opened with followed by every
+// resize
+func (t *FakeTerminal) Sizes() []TerminalSize {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]TerminalSize{}, t.sizes...)
+}
+
+// errReader returns err instead of io.EOF once r is consumed
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF && e.err != nil {
+		return n, e.err
+	}
+	return n, err
+}
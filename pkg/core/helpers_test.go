@@ -0,0 +1,16 @@
+package core
+
+import (
+	"testing"
+)
+
+// testExecutor starts a command executor on the config whose hosts all use
+// the transport
+func testExecutor(t *testing.T, yaml string, transport Transport) *CommandExecutor {
+	t.Helper()
+	ce, err := NewFakeExecutor(t.TempDir(), yaml, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ce
+}
@@ -0,0 +1,288 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const HostKeyTrusted = "trusted"
+const HostKeyPending = "pending"
+
+type HostKey struct {
+	Host        string
+	Type        string
+	Fingerprint string
+	Status      string
+}
+
+type HostKeyMismatchError struct {
+	Host    string
+	Key     ssh.PublicKey
+	Trusted []ssh.PublicKey
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	trusted := []string{}
+	for _, k := range e.Trusted {
+		trusted = append(trusted, ssh.FingerprintSHA256(k))
+	}
+	return fmt.Sprintf("host key mismatch for %s: server offered %s %s but trusted key is %s, approve the new key if this change is expected",
+		e.Host, e.Key.Type(), ssh.FingerprintSHA256(e.Key), strings.Join(trusted, ", "))
+}
+
+// KnownHosts is a trust-on-first-use host key store backed by a file in the
+// OpenSSH known_hosts format. Keys of unknown hosts are recorded on the first
+// connection, keys that do not match a trusted one are rejected and kept as
+// pending until they are approved.
+//
+// Hashed hosts, @cert-authority and @revoked lines are checked like OpenSSH
+// does before the store is consulted but they are never changed by it:
+// revoked keys are always rejected, hosts matching a hashed line or signed
+// by an authority are only accepted with that key and are not recorded.
+type KnownHosts struct {
+	path    string
+	lock    sync.Mutex
+	trusted map[string][]ssh.PublicKey
+	pending map[string]ssh.PublicKey
+	// lines which are not managed by the store (markers, hashed hosts) and
+	// are written back untouched
+	extra []string
+	// markers checks the keys against the extra lines, nil without any
+	markers ssh.HostKeyCallback
+	// authorities is set when there is a @cert-authority line
+	authorities bool
+	// probe is a key no host has, it looks up the keys of the extra lines
+	probe ssh.PublicKey
+}
+
+func NewKnownHosts(path string) (*KnownHosts, error) {
+	k := &KnownHosts{path: path, trusted: map[string][]ssh.PublicKey{}, pending: map[string]ssh.PublicKey{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+		}
+		if marker != "" || strings.HasPrefix(hosts[0], "|") {
+			k.extra = append(k.extra, line)
+			k.authorities = k.authorities || marker == "cert-authority"
+			continue
+		}
+		for _, host := range hosts {
+			k.trusted[host] = append(k.trusted[host], key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.extra) > 0 {
+		if err := k.loadMarkers(); err != nil {
+			return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+		}
+	}
+	return k, nil
+}
+
+// loadMarkers builds the checker of the extra lines, knownhosts only reads
+// files so they are copied to a temporary one
+func (k *KnownHosts) loadMarkers() error {
+	tmp, err := os.CreateTemp("", "known_hosts")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(strings.Join(k.extra, "\n") + "\n")
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	k.markers, err = knownhosts.New(tmp.Name())
+	if err != nil {
+		return err
+	}
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	k.probe, err = ssh.NewPublicKey(public)
+	return err
+}
+
+// checkMarkers checks the key against the extra lines, known is false when
+// none of them names the host
+func (k *KnownHosts) checkMarkers(hostname string, remote net.Addr, key ssh.PublicKey) (known bool, err error) {
+	if k.markers == nil {
+		return false, nil
+	}
+	err = k.markers(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+		return false, nil
+	}
+	if err != nil && strings.Contains(err.Error(), "no authorities for hostname") {
+		// a certificate of a host without an authority line is decided by
+		// the store like any other key, the probe tells whether a line
+		// names the host
+		if errors.As(k.markers(hostname, remote, k.probe), &keyErr) && len(keyErr.Want) == 0 {
+			return false, nil
+		}
+	}
+	return true, err
+}
+
+// HostKeyCallback verifies the key of the host being dialed against the store
+func (k *KnownHosts) HostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if known, err := k.checkMarkers(hostname, remote, key); known || err != nil {
+			return err
+		}
+		host := knownhosts.Normalize(hostname)
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		trusted := k.trusted[host]
+		if len(trusted) == 0 {
+			// trust on first use
+			k.trusted[host] = []ssh.PublicKey{key}
+			return k.save()
+		}
+		for _, t := range trusted {
+			if bytes.Equal(t.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		k.pending[host] = key
+		return &HostKeyMismatchError{Host: host, Key: key, Trusted: trusted}
+	}
+}
+
+// HostKeyAlgorithms returns the algorithms of the keys trusted for the
+// address so that the server presents a key we are able to verify
+func (k *KnownHosts) HostKeyAlgorithms(address string) []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	// nil lets the client offer every algorithm it supports
+	var algorithms []string
+	keys := k.trusted[knownhosts.Normalize(address)]
+	if len(keys) == 0 && k.markers != nil && !k.authorities {
+		// a hashed host, the probe fails with the keys of its lines
+		var keyErr *knownhosts.KeyError
+		if errors.As(k.markers(address, &net.TCPAddr{}, k.probe), &keyErr) {
+			for _, known := range keyErr.Want {
+				keys = append(keys, known.Key)
+			}
+		}
+	}
+	for _, key := range keys {
+		if key.Type() == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, key.Type())
+	}
+	return algorithms
+}
+
+func (k *KnownHosts) List() []HostKey {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	hostKeys := []HostKey{}
+	for host, keys := range k.trusted {
+		for _, key := range keys {
+			hostKeys = append(hostKeys, HostKey{Host: host, Type: key.Type(), Fingerprint: ssh.FingerprintSHA256(key), Status: HostKeyTrusted})
+		}
+	}
+	for host, key := range k.pending {
+		hostKeys = append(hostKeys, HostKey{Host: host, Type: key.Type(), Fingerprint: ssh.FingerprintSHA256(key), Status: HostKeyPending})
+	}
+	sort.Slice(hostKeys, func(i, j int) bool {
+		if hostKeys[i].Host == hostKeys[j].Host {
+			return hostKeys[i].Status > hostKeys[j].Status
+		}
+		return hostKeys[i].Host < hostKeys[j].Host
+	})
+	return hostKeys
+}
+
+// Approve replaces the trusted key of the host with the pending one, the
+// fingerprint must match the pending key
+func (k *KnownHosts) Approve(host string, fingerprint string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	key, ok := k.pending[host]
+	if !ok {
+		return fmt.Errorf("no pending host key for %s", host)
+	}
+	if ssh.FingerprintSHA256(key) != fingerprint {
+		return fmt.Errorf("fingerprint %s does not match the pending key of %s", fingerprint, host)
+	}
+	keys := []ssh.PublicKey{key}
+	for _, t := range k.trusted[host] {
+		if t.Type() != key.Type() {
+			keys = append(keys, t)
+		}
+	}
+	k.trusted[host] = keys
+	delete(k.pending, host)
+	return k.save()
+}
+
+// Revoke forgets every key of the host, the next connection records it again
+func (k *KnownHosts) Revoke(host string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	_, trusted := k.trusted[host]
+	_, pending := k.pending[host]
+	if !trusted && !pending {
+		return fmt.Errorf("no host key for %s", host)
+	}
+	delete(k.trusted, host)
+	delete(k.pending, host)
+	return k.save()
+}
+
+// save writes the store to disk, the caller must hold the lock
+func (k *KnownHosts) save() error {
+	hosts := []string{}
+	for host := range k.trusted {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var buf bytes.Buffer
+	for _, line := range k.extra {
+		fmt.Fprintln(&buf, line)
+	}
+	for _, host := range hosts {
+		for _, key := range k.trusted[host] {
+			fmt.Fprintln(&buf, knownhosts.Line([]string{host}, key))
+		}
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
@@ -0,0 +1,144 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var testRemote = &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 22}
+
+func testSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// testHostCert signs the key of the host with the authority
+func testHostCert(t *testing.T, authority ssh.Signer, host ssh.Signer, principal string) *ssh.Certificate {
+	t.Helper()
+	cert := &ssh.Certificate{Key: host.PublicKey(), CertType: ssh.HostCert, ValidPrincipals: []string{principal}, ValidBefore: ssh.CertTimeInfinity}
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testKnownHosts writes the lines to a known_hosts file and loads it
+func testKnownHosts(t *testing.T, lines ...string) (*KnownHosts, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if len(lines) > 0 {
+		if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k, err := NewKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, path
+}
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+	k, path := testKnownHosts(t)
+	first, second := testSigner(t), testSigner(t)
+	check := k.HostKeyCallback()
+	if err := check("10.0.0.5:22", testRemote, first.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if err := check("10.0.0.5:22", testRemote, first.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	var mismatch *HostKeyMismatchError
+	if err := check("10.0.0.5:22", testRemote, second.PublicKey()); !errors.As(err, &mismatch) {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+	if err := k.Approve("10.0.0.5", ssh.FingerprintSHA256(second.PublicKey())); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewKnownHosts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.HostKeyCallback()("10.0.0.5:22", testRemote, second.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKnownHostsMarkers(t *testing.T) {
+	authority, host, revoked, other := testSigner(t), testSigner(t), testSigner(t), testSigner(t)
+	k, path := testKnownHosts(t,
+		"@cert-authority *.example.com "+string(ssh.MarshalAuthorizedKey(authority.PublicKey())),
+		"@revoked * "+string(ssh.MarshalAuthorizedKey(revoked.PublicKey())),
+		knownhosts.Line([]string{knownhosts.HashHostname("10.0.0.5")}, host.PublicKey()),
+	)
+	tests := []struct {
+		name     string
+		hostname string
+		key      ssh.PublicKey
+		valid    bool
+		recorded bool
+	}{
+		{name: "hashed host with its key", hostname: "10.0.0.5:22", key: host.PublicKey(), valid: true},
+		{name: "hashed host with another key", hostname: "10.0.0.5:22", key: other.PublicKey()},
+		{name: "revoked key of an unknown host", hostname: "10.0.0.9:22", key: revoked.PublicKey()},
+		{name: "certificate of the authority", hostname: "web.example.com:22", key: testHostCert(t, authority, host, "web.example.com"), valid: true},
+		{name: "certificate for another principal", hostname: "web.example.com:22", key: testHostCert(t, authority, host, "db.example.com")},
+		{name: "certificate of another authority", hostname: "web.example.com:22", key: testHostCert(t, other, host, "web.example.com")},
+		{name: "plain key of a host under the authority", hostname: "web.example.com:22", key: host.PublicKey()},
+		{name: "unknown host", hostname: "10.0.0.9:22", key: other.PublicKey(), valid: true, recorded: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := k.HostKeyCallback()(test.hostname, testRemote, test.key)
+			if test.valid && err != nil {
+				t.Fatalf("expected the key to be accepted, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatal("expected the key to be rejected")
+			}
+			_, recorded := k.trusted[knownhosts.Normalize(test.hostname)]
+			if recorded != test.recorded {
+				t.Fatalf("expected recorded to be %t", test.recorded)
+			}
+		})
+	}
+	// the marker lines survive the save of the recorded host
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, marker := range []string{"@cert-authority", "@revoked", "|1|"} {
+		if !strings.Contains(string(data), marker) {
+			t.Fatalf("expected %s to be kept in %s", marker, data)
+		}
+	}
+}
+
+func TestKnownHostsAlgorithmsOfHashedHost(t *testing.T) {
+	host := testSigner(t)
+	k, _ := testKnownHosts(t, knownhosts.Line([]string{knownhosts.HashHostname("10.0.0.5")}, host.PublicKey()))
+	algorithms := k.HostKeyAlgorithms("10.0.0.5:22")
+	if len(algorithms) != 1 || algorithms[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("expected the algorithm of the hashed key, got %v", algorithms)
+	}
+	if algorithms := k.HostKeyAlgorithms("10.0.0.9:22"); algorithms != nil {
+		t.Fatalf("expected every algorithm for an unknown host, got %v", algorithms)
+	}
+}
@@ -0,0 +1,117 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ContainerAction is an action which can be run on a container
+type ContainerAction string
+
+const (
+	ActionStart   ContainerAction = "start"
+	ActionStop    ContainerAction = "stop"
+	ActionRestart ContainerAction = "restart"
+	ActionKill    ContainerAction = "kill"
+	ActionPause   ContainerAction = "pause"
+	ActionUnpause ContainerAction = "unpause"
+	ActionRemove  ContainerAction = "rm"
+)
+
+var containerActions = []ContainerAction{ActionStart, ActionStop, ActionRestart, ActionKill, ActionPause, ActionUnpause, ActionRemove}
+
+// ParseContainerAction returns the action of the name, anything else than
+// the known actions is rejected
+func ParseContainerAction(action string) (ContainerAction, error) {
+	for _, a := range containerActions {
+		if string(a) == action {
+			return a, nil
+		}
+	}
+	names := []string{}
+	for _, a := range containerActions {
+		names = append(names, string(a))
+	}
+	return "", &InvalidRequestError{Reason: fmt.Sprintf("unknown action %q, expected one of %s", action, strings.Join(names, ", "))}
+}
+
+// InvalidRequestError is returned for requests outside of what the
+// operations allow, nothing was run on the host
+type InvalidRequestError struct {
+	Reason string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return e.Reason
+}
+
+// referencePattern matches container ids and names and image ids and
+// references, anything the shell could interpret is left out
+var referencePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.:/@-]*$`)
+
+func validReference(kind string, reference string) error {
+	if !referencePattern.MatchString(reference) {
+		return &InvalidRequestError{Reason: fmt.Sprintf("invalid %s %q", kind, reference)}
+	}
+	return nil
+}
+
+// machine returns the machine of the host, unknown hosts are rejected
+func (ce *CommandExecutor) machine(ip string) (*Machine, error) {
+	m := ce.getMachine(ip)
+	if m == nil {
+		return nil, &InvalidRequestError{Reason: fmt.Sprintf("unknown host %q", ip)}
+	}
+	return m, nil
+}
+
+// CheckHost returns an error when the host is not known
+func (ce *CommandExecutor) CheckHost(ip string) error {
+	_, err := ce.machine(ip)
+	return err
+}
+
+// ResolveContainer returns the id of the container of the host named by the
+// reference, its id or one of its names. Containers which are not on the
+// host are rejected.
+func (ce *CommandExecutor) ResolveContainer(ctx context.Context, ip string, reference string) (string, error) {
+	if err := validReference("container", reference); err != nil {
+		return "", err
+	}
+	containers, err := ce.ListContainers(ctx, ip)
+	if err != nil {
+		return "", err
+	}
+	for _, c := range containers {
+		if c.ID == reference {
+			return c.ID, nil
+		}
+		for _, name := range strings.Split(c.Names, ",") {
+			if name == reference {
+				return c.ID, nil
+			}
+		}
+	}
+	return "", &InvalidRequestError{Reason: fmt.Sprintf("container %q not found on %s", reference, ip)}
+}
+
+// ResolveImage returns the id of the image of the host named by the
+// reference, its id or repository:tag. Images which are not on the host are
+// rejected.
+func (ce *CommandExecutor) ResolveImage(ctx context.Context, ip string, reference string) (string, error) {
+	if err := validReference("image", reference); err != nil {
+		return "", err
+	}
+	images, err := ce.ListImages(ctx, ip)
+	if err != nil {
+		return "", err
+	}
+	for _, i := range images {
+		if i.ID == reference || (i.Tag != "<none>" && i.Repository+":"+i.Tag == reference) {
+			return i.ID, nil
+		}
+	}
+	return "", &InvalidRequestError{Reason: fmt.Sprintf("image %q not found on %s", reference, ip)}
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const keepAliveInterval = 15 * time.Second
+const keepAliveTimeout = 10 * time.Second
+
+// sshPool keeps a single authenticated ssh client per machine alive and
+// multiplexes sessions on top of it. Dead connections are detected with
+// keepalives and redialed on the next request.
+type sshPool struct {
+	dial   func(ctx context.Context) (*ssh.Client, error)
+	client *ssh.Client
+	// dialing is set while a dial is in flight, requests arriving meanwhile
+	// wait for it instead of dialing again
+	dialing *poolDial
+	lock    sync.Mutex
+	closed  bool
+}
+
+// poolDial is a dial in flight, done is closed once client or err is set.
+// The dial is cancelled once every request waiting for it gave up.
+type poolDial struct {
+	done    chan struct{}
+	client  *ssh.Client
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newSSHPool(dial func(ctx context.Context) (*ssh.Client, error)) *sshPool {
+	return &sshPool{dial: dial}
+}
+
+var errPoolClosed = errors.New("connection pool is closed")
+
+// get returns the pooled client, dialing a new one if there is none. The
+// dial runs without the lock so a slow host does not block the requests
+// and the close of the pool, requests stop waiting for it once their
+// context is done and the dial stops when none is left waiting.
+func (p *sshPool) get(ctx context.Context) (*ssh.Client, error) {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, errPoolClosed
+	}
+	if p.client != nil {
+		client := p.client
+		p.lock.Unlock()
+		return client, nil
+	}
+	call := p.dialing
+	if call == nil {
+		dialCtx, cancel := context.WithCancel(context.Background())
+		call = &poolDial{done: make(chan struct{}), cancel: cancel}
+		p.dialing = call
+		go p.connect(dialCtx, call)
+	}
+	call.waiters++
+	p.lock.Unlock()
+	select {
+	case <-call.done:
+		return call.client, call.err
+	case <-ctx.Done():
+		p.abandon(call)
+		return nil, ctx.Err()
+	}
+}
+
+// abandon stops waiting for the dial, the last request to give up cancels
+// it so that a dead host does not keep the dial going
+func (p *sshPool) abandon(call *poolDial) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	call.waiters--
+	if call.waiters == 0 && p.dialing == call {
+		p.dialing = nil
+		call.cancel()
+	}
+}
+
+// connect dials for the waiting requests and pools the client, the client
+// of a dial nobody waits for anymore is closed
+func (p *sshPool) connect(ctx context.Context, call *poolDial) {
+	client, err := p.dial(ctx)
+	call.cancel()
+	p.lock.Lock()
+	abandoned := p.dialing != call
+	if !abandoned {
+		p.dialing = nil
+	}
+	switch {
+	case err == nil && abandoned:
+		client.Close()
+		err = context.Canceled
+	case err == nil && p.closed:
+		client.Close()
+		err = errPoolClosed
+	}
+	if err == nil {
+		p.client = client
+		go p.keepAlive(client)
+		call.client = client
+	}
+	call.err = err
+	p.lock.Unlock()
+	close(call.done)
+}
+
+// discard drops the client from the pool if it is still the pooled one
+func (p *sshPool) discard(client *ssh.Client) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.client == client {
+		p.client = nil
+	}
+	client.Close()
+}
+
+// newSession opens a session on the pooled client, redialing once if the
+// pooled connection turns out to be dead
+func (p *sshPool) newSession(ctx context.Context) (*ssh.Session, error) {
+	client, err := p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	var chanErr *ssh.OpenChannelError
+	if errors.As(err, &chanErr) {
+		// the connection is alive but the server refused the session
+		return nil, err
+	}
+	p.discard(client)
+	client, err = p.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewSession()
+}
+
+func (p *sshPool) keepAlive(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			p.discard(client)
+			return
+		case <-ticker.C:
+			if err := sendKeepAlive(client); err != nil {
+				p.discard(client)
+				return
+			}
+		}
+	}
+}
+
+func sendKeepAlive(client *ssh.Client) error {
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(keepAliveTimeout):
+		return fmt.Errorf("keepalive timed out after %s", keepAliveTimeout)
+	}
+}
+
+// Close closes the pooled client, any later request fails
+func (p *sshPool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	if p.dialing != nil {
+		p.dialing.cancel()
+	}
+	if p.client == nil {
+		return nil
+	}
+	err := p.client.Close()
+	p.client = nil
+	return err
+}
@@ -0,0 +1,256 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"crazydocker/pkg/sshtest"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func testSSHServer(t *testing.T) *sshtest.Server {
+	t.Helper()
+	s, err := sshtest.NewServer(sshtest.Config{User: "deploy", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func dialTestServer(s *sshtest.Server) (*ssh.Client, error) {
+	return ssh.Dial("tcp", s.Addr(), &ssh.ClientConfig{User: "deploy", Auth: []ssh.AuthMethod{ssh.Password("secret")}, HostKeyCallback: ssh.FixedHostKey(s.HostKey)})
+}
+
+func TestPoolDialsOnceForConcurrentRequests(t *testing.T) {
+	s := testSSHServer(t)
+	var dials int32
+	p := newSSHPool(func(ctx context.Context) (*ssh.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(50 * time.Millisecond)
+		return dialTestServer(s)
+	})
+	defer p.Close()
+	var wg sync.WaitGroup
+	clients := make([]*ssh.Client, 10)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := p.get(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			clients[i] = client
+		}(i)
+	}
+	wg.Wait()
+	if dials != 1 {
+		t.Fatalf("expected a single dial, got %d", dials)
+	}
+	for _, client := range clients {
+		if client != clients[0] {
+			t.Fatal("expected every request to get the pooled client")
+		}
+	}
+}
+
+func TestPoolRedialsDeadClient(t *testing.T) {
+	s := testSSHServer(t)
+	var dials int32
+	p := newSSHPool(func(ctx context.Context) (*ssh.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		return dialTestServer(s)
+	})
+	defer p.Close()
+	client, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	session, err := p.newSession(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Close()
+	if dials != 2 {
+		t.Fatalf("expected a redial, got %d dials", dials)
+	}
+}
+
+func TestPoolCloseDoesNotWaitForDial(t *testing.T) {
+	release := make(chan struct{})
+	p := newSSHPool(func(ctx context.Context) (*ssh.Client, error) {
+		<-release
+		return nil, errors.New("unreachable")
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.get(context.Background())
+		done <- err
+	}()
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked on the dial")
+	}
+	close(release)
+	if err := <-done; err == nil {
+		t.Fatal("expected the dial error")
+	}
+	if _, err := p.get(context.Background()); !errors.Is(err, errPoolClosed) {
+		t.Fatalf("expected %v, got %v", errPoolClosed, err)
+	}
+}
+
+func TestPoolCancelsDialNobodyWaitsFor(t *testing.T) {
+	s := testSSHServer(t)
+	var dials int32
+	cancelled := make(chan struct{})
+	p := newSSHPool(func(ctx context.Context) (*ssh.Client, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			// the host never answers
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		}
+		return dialTestServer(s)
+	})
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the dial to be cancelled once nobody waits for it")
+	}
+	// the next request dials again
+	client, err := p.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client == nil || atomic.LoadInt32(&dials) != 2 {
+		t.Fatalf("expected a second dial, got %d dials", dials)
+	}
+}
+
+func TestPoolKeepsDialOthersWaitFor(t *testing.T) {
+	s := testSSHServer(t)
+	release := make(chan struct{})
+	var dials int32
+	p := newSSHPool(func(ctx context.Context) (*ssh.Client, error) {
+		atomic.AddInt32(&dials, 1)
+		<-release
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return dialTestServer(s)
+	})
+	defer p.Close()
+	waiting := make(chan error, 1)
+	go func() {
+		_, err := p.get(context.Background())
+		waiting <- err
+	}()
+	// the other request waits for the dial before this one gives up
+	for joined := false; !joined; time.Sleep(time.Millisecond) {
+		p.lock.Lock()
+		joined = p.dialing != nil && p.dialing.waiters == 1
+		p.lock.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	// the other request still gets the client of the dial
+	close(release)
+	if err := <-waiting; err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Fatalf("expected a single dial, got %d", dials)
+	}
+}
+
+func TestDialDirectCancelsHandshake(t *testing.T) {
+	// the host accepts the connection but never answers the handshake
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = dialDirect(ctx, l.Addr().String(), &ssh.ClientConfig{User: "deploy", Timeout: time.Minute, HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the handshake to stop with the context, took %s", elapsed)
+	}
+}
+
+func TestTransportDialHonoursContext(t *testing.T) {
+	s := testSSHServer(t)
+	transport := &sshTransport{pool: newSSHPool(func(ctx context.Context) (*ssh.Client, error) { return dialTestServer(s) })}
+	defer transport.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := transport.Dial(ctx, "tcp", s.Addr()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// the status is updated by every operation while the api lists the
+// machines, run with -race
+func TestMachineStatusWhileListing(t *testing.T) {
+	transport := NewOnlineFakeHost()
+	ce := testExecutor(t, FakeHostConfig("10.1.1.1"), transport)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			ce.GetHostNameAndOs(context.Background(), "10.1.1.1")
+		}()
+		go func() {
+			defer wg.Done()
+			for _, m := range ce.ListMachines() {
+				if m.Status != MachineOnline {
+					t.Errorf("expected %s to be online", m.Ip)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	transport.Err = errors.New("connection refused")
+	ce.GetHostNameAndOs(context.Background(), "10.1.1.1")
+	if m := ce.ListMachines()[0]; m.Status != MachineOffline {
+		t.Fatalf("expected %s to be offline", m.Ip)
+	}
+}
@@ -0,0 +1,244 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/strslice"
+	"github.com/docker/go-connections/nat"
+)
+
+// runOptions are the settings of a container created through the engine api
+type runOptions struct {
+	name       string
+	config     *container.Config
+	hostConfig *container.HostConfig
+}
+
+// runFlagAliases maps the short flags to their long form
+var runFlagAliases = map[string]string{
+	"-e": "--env",
+	"-p": "--publish",
+	"-v": "--volume",
+	"-l": "--label",
+	"-w": "--workdir",
+	"-u": "--user",
+	"-h": "--hostname",
+	"-t": "--tty",
+	"-i": "--interactive",
+	"-d": "--detach",
+}
+
+// runBoolFlags are the flags without a value. --privileged is left out on
+// purpose, a privileged container owns the host.
+var runBoolFlags = map[string]bool{"--tty": true, "--interactive": true, "--detach": true, "--rm": true}
+
+// runValueFlags are the flags taking a value
+var runValueFlags = map[string]bool{
+	"--name": true, "--env": true, "--publish": true, "--volume": true, "--label": true, "--workdir": true,
+	"--user": true, "--hostname": true, "--entrypoint": true, "--network": true, "--net": true, "--restart": true,
+}
+
+// volumeName is a name docker accepts for a volume or a network, anything
+// else in front of the colon of a volume is a path on the host
+var volumeName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+
+// parseRunArgs turns the options of docker run into the engine api settings,
+// only the commonly used options are supported
+func parseRunArgs(args string) (*runOptions, error) {
+	words, err := splitArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	opts := &runOptions{config: &container.Config{}, hostConfig: &container.HostConfig{}}
+	ports := []string{}
+	for i := 0; i < len(words); i++ {
+		flag, value, hasValue := strings.Cut(words[i], "=")
+		if !strings.HasPrefix(flag, "-") {
+			return nil, fmt.Errorf("unexpected argument %q, only options are supported", words[i])
+		}
+		if len(flag) > 2 && !strings.HasPrefix(flag, "--") {
+			// combined short flags like -it
+			for _, c := range flag[1:] {
+				if !runBoolFlags[runFlagAliases["-"+string(c)]] {
+					return nil, fmt.Errorf("unsupported option %s", flag)
+				}
+				applyRunBoolFlag(opts, runFlagAliases["-"+string(c)])
+			}
+			continue
+		}
+		if alias, ok := runFlagAliases[flag]; ok {
+			flag = alias
+		}
+		if runBoolFlags[flag] {
+			applyRunBoolFlag(opts, flag)
+			continue
+		}
+		if !runValueFlags[flag] {
+			return nil, fmt.Errorf("unsupported option %s", flag)
+		}
+		if !hasValue {
+			if i+1 >= len(words) {
+				return nil, fmt.Errorf("option %s requires a value", flag)
+			}
+			i++
+			value = words[i]
+		}
+		switch flag {
+		case "--name":
+			opts.name = value
+		case "--env":
+			opts.config.Env = append(opts.config.Env, value)
+		case "--publish":
+			ports = append(ports, value)
+		case "--volume":
+			if err := checkVolume(value); err != nil {
+				return nil, err
+			}
+			opts.hostConfig.Binds = append(opts.hostConfig.Binds, value)
+		case "--label":
+			if opts.config.Labels == nil {
+				opts.config.Labels = map[string]string{}
+			}
+			k, v, _ := strings.Cut(value, "=")
+			opts.config.Labels[k] = v
+		case "--workdir":
+			opts.config.WorkingDir = value
+		case "--user":
+			opts.config.User = value
+		case "--hostname":
+			opts.config.Hostname = value
+		case "--entrypoint":
+			opts.config.Entrypoint = strslice.StrSlice{value}
+		case "--network", "--net":
+			if err := checkNetwork(value); err != nil {
+				return nil, err
+			}
+			opts.hostConfig.NetworkMode = container.NetworkMode(value)
+		case "--restart":
+			policy, err := parseRestartPolicy(value)
+			if err != nil {
+				return nil, err
+			}
+			opts.hostConfig.RestartPolicy = policy
+		default:
+			return nil, fmt.Errorf("unsupported option %s", flag)
+		}
+	}
+	exposed, bindings, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		return nil, err
+	}
+	opts.config.ExposedPorts = exposed
+	opts.hostConfig.PortBindings = bindings
+	return opts, nil
+}
+
+func applyRunBoolFlag(opts *runOptions, flag string) {
+	switch flag {
+	case "--tty":
+		opts.config.Tty = true
+	case "--interactive":
+		opts.config.OpenStdin = true
+	case "--rm":
+		opts.hostConfig.AutoRemove = true
+	}
+	// --detach is the default
+}
+
+// checkVolume allows named and anonymous volumes only, a bind of a host
+// path like / or the docker socket would hand the host to the container
+func checkVolume(value string) error {
+	source, _, hasTarget := strings.Cut(value, ":")
+	if !hasTarget {
+		// an anonymous volume, the value is the path in the container
+		return nil
+	}
+	if !volumeName.MatchString(source) {
+		return fmt.Errorf("volume %q binds a path of the host, only named volumes are supported", value)
+	}
+	return nil
+}
+
+// checkNetwork allows the bridge, none and user networks, the host network
+// and the namespace of another container would let the container out
+func checkNetwork(value string) error {
+	if value == "host" || strings.HasPrefix(value, "container:") {
+		return fmt.Errorf("network %q shares the network of the host or of another container, only bridge, none and named networks are supported", value)
+	}
+	if !volumeName.MatchString(value) {
+		return fmt.Errorf("invalid network %q", value)
+	}
+	return nil
+}
+
+func parseRestartPolicy(value string) (container.RestartPolicy, error) {
+	name, count, hasCount := strings.Cut(value, ":")
+	policy := container.RestartPolicy{Name: container.RestartPolicyMode(name)}
+	switch name {
+	case "no", "always", "unless-stopped":
+		if hasCount {
+			return policy, fmt.Errorf("restart policy %s does not take a retry count", name)
+		}
+	case "on-failure":
+		if hasCount {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 0 {
+				return policy, fmt.Errorf("invalid retry count %q", count)
+			}
+			policy.MaximumRetryCount = n
+		}
+	default:
+		return policy, fmt.Errorf("invalid restart policy %q", value)
+	}
+	return policy, nil
+}
+
+// splitArgs splits the arguments like a shell would, supporting single and
+// double quotes and backslash escapes
+func splitArgs(args string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range args {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape in arguments")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
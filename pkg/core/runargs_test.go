@@ -0,0 +1,72 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRunArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  string
+		binds []string
+		err   string
+	}{
+		{name: "no options", args: ""},
+		{name: "named volume", args: "-v data:/var/lib/data", binds: []string{"data:/var/lib/data"}},
+		{name: "named volume with mode", args: "--volume=my-data.1:/data:ro", binds: []string{"my-data.1:/data:ro"}},
+		{name: "anonymous volume", args: "-v /cache", binds: []string{"/cache"}},
+		{name: "host root", args: "-v /:/host", err: "binds a path of the host"},
+		{name: "docker socket", args: "--volume /var/run/docker.sock:/var/run/docker.sock", err: "binds a path of the host"},
+		{name: "relative path", args: "-v ./data:/data", err: "binds a path of the host"},
+		{name: "home path", args: "-v=~/data:/data", err: "binds a path of the host"},
+		{name: "privileged", args: "--privileged", err: "unsupported option --privileged"},
+		{name: "privileged with a value", args: "--privileged=true", err: "unsupported option --privileged"},
+		{name: "bridge network", args: "--network bridge"},
+		{name: "named network", args: "--net=backend_default"},
+		{name: "host network", args: "--network host", err: `network "host" shares the network`},
+		{name: "host network with equals", args: "--net=host", err: `network "host" shares the network`},
+		{name: "network of another container", args: "--network container:db", err: `network "container:db" shares the network`},
+		{name: "unknown short flag", args: "-itP", err: "unsupported option -itP"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts, err := parseRunArgs(test.args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.hostConfig.Privileged {
+				t.Fatal("expected the container not to be privileged")
+			}
+			if !reflect.DeepEqual(opts.hostConfig.Binds, test.binds) {
+				t.Fatalf("expected the binds %v, got %v", test.binds, opts.hostConfig.Binds)
+			}
+		})
+	}
+}
+
+func TestParseRunArgsOptions(t *testing.T) {
+	opts, err := parseRunArgs(`--name api -it --rm -e "GREETING=hello world" -p 8080:80 -l tier=web --restart on-failure:3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.name != "api" || !opts.config.Tty || !opts.config.OpenStdin || !opts.hostConfig.AutoRemove {
+		t.Fatalf("expected the name and the flags to be set, got %+v %+v", opts.config, opts.hostConfig)
+	}
+	if len(opts.config.Env) != 1 || opts.config.Env[0] != "GREETING=hello world" {
+		t.Fatalf("expected the quoted env, got %v", opts.config.Env)
+	}
+	if bindings := opts.hostConfig.PortBindings["80/tcp"]; len(bindings) != 1 || bindings[0].HostPort != "8080" {
+		t.Fatalf("expected port 80 to be published on 8080, got %v", opts.hostConfig.PortBindings)
+	}
+	if opts.config.Labels["tier"] != "web" || opts.hostConfig.RestartPolicy.MaximumRetryCount != 3 {
+		t.Fatalf("expected the label and the restart policy, got %v %+v", opts.config.Labels, opts.hostConfig.RestartPolicy)
+	}
+}
@@ -0,0 +1,157 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+const defaultTerminalCols = 80
+const defaultTerminalRows = 40
+
+// TerminalSize is the size of the browser terminal in characters
+type TerminalSize struct {
+	Cols int
+	Rows int
+}
+
+// withDefaults returns the size with missing dimensions set to the defaults
+func (s TerminalSize) withDefaults() TerminalSize {
+	if s.Cols <= 0 {
+		s.Cols = defaultTerminalCols
+	}
+	if s.Rows <= 0 {
+		s.Rows = defaultTerminalRows
+	}
+	return s
+}
+
+// Messages on the exec websocket: binary frames carry raw keystrokes, text
+// frames carry a JSON control message of one of the types below.
+const terminalMessageInput = "input"
+const terminalMessageResize = "resize"
+
+type terminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+func parseTerminalMessage(data []byte) (*terminalMessage, error) {
+	var msg *terminalMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("invalid control message: %w", err)
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("invalid control message: %s", data)
+	}
+	switch msg.Type {
+	case terminalMessageInput:
+	case terminalMessageResize:
+		if msg.Cols <= 0 || msg.Rows <= 0 {
+			return nil, fmt.Errorf("invalid terminal size %dx%d", msg.Cols, msg.Rows)
+		}
+	default:
+		return nil, fmt.Errorf("unknown control message type %q", msg.Type)
+	}
+	return msg, nil
+}
+
+// readTerminalInput writes the keystrokes of the websocket to stdin and
+// applies the resize messages until the client goes away
+func readTerminalInput(conn *websocket.Conn, stdin io.Writer, resize func(TerminalSize) error) {
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Printf("reader err :%s\n", err)
+			return
+		}
+		if messageType == websocket.TextMessage {
+			msg, err := parseTerminalMessage(data)
+			if err != nil {
+				log.Printf("reader err :%s\n", err)
+				continue
+			}
+			if msg.Type == terminalMessageResize {
+				if err := resize(TerminalSize{Cols: msg.Cols, Rows: msg.Rows}); err != nil {
+					log.Printf("resize err :%s\n", err)
+				}
+				continue
+			}
+			data = []byte(msg.Data)
+		}
+		_, err = stdin.Write(data)
+		if err != nil {
+			log.Printf("stdin write err :%s\n", err)
+			return
+		}
+	}
+}
+
+// writeTerminalOutput writes the output to the websocket until the remote
+// side closes it or the client goes away
+func writeTerminalOutput(conn *websocket.Conn, stdout io.Reader) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := stdout.Read(buf)
+		if n > 0 {
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				log.Printf("writer err :%s\n", err)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("stdout read err :%s\n", err)
+			}
+			return
+		}
+	}
+}
+
+// TerminalRecorder receives what an interactive session shows, it is set on
+// the context of the session with WithTerminalRecorder
+type TerminalRecorder interface {
+	// Resize is called with the size the terminal is opened with and on
+	// every resize
+	Resize(cols int, rows int)
+	// Output is called with every chunk written to the terminal
+	Output(data []byte)
+}
+
+type terminalRecorderKey struct{}
+
+// WithTerminalRecorder records the interactive sessions run with the context
+func WithTerminalRecorder(ctx context.Context, recorder TerminalRecorder) context.Context {
+	return context.WithValue(ctx, terminalRecorderKey{}, recorder)
+}
+
+// recorderOutput is the writer side of a recorder
+type recorderOutput struct {
+	recorder TerminalRecorder
+}
+
+func (r recorderOutput) Write(p []byte) (int, error) {
+	r.recorder.Output(p)
+	return len(p), nil
+}
+
+// recordTerminal tees the output and the resizes of a session into the
+// recorder of the context, they are returned as they are without one
+func recordTerminal(ctx context.Context, size TerminalSize, stdout io.Reader, resize func(TerminalSize) error) (io.Reader, func(TerminalSize) error) {
+	recorder, ok := ctx.Value(terminalRecorderKey{}).(TerminalRecorder)
+	if !ok {
+		return stdout, resize
+	}
+	size = size.withDefaults()
+	recorder.Resize(size.Cols, size.Rows)
+	return io.TeeReader(stdout, recorderOutput{recorder: recorder}), func(size TerminalSize) error {
+		recorder.Resize(size.Cols, size.Rows)
+		return resize(size)
+	}
+}
@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"crazydocker/pkg/config"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// operations with a timeout of their own
+const (
+	OperationList    = "list"
+	OperationInspect = "inspect"
+	OperationAction  = "action"
+	OperationCreate  = "create"
+	OperationProbe   = "probe"
+)
+
+var defaultTimeouts = config.Timeouts{
+	List:    30 * time.Second,
+	Inspect: 15 * time.Second,
+	Action:  60 * time.Second,
+	Create:  2 * time.Minute,
+	Probe:   15 * time.Second,
+}
+
+// TimeoutError is returned when an operation did not finish in time, the
+// remote command is killed by then
+type TimeoutError struct {
+	Operation string
+	Timeout   time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Operation, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// timeout returns the configured timeout of the operation or its default
+func (ce *CommandExecutor) timeout(operation string) time.Duration {
+	timeouts := ce.config.Timeouts()
+	pick := func(configured, fallback time.Duration) time.Duration {
+		if configured > 0 {
+			return configured
+		}
+		return fallback
+	}
+	switch operation {
+	case OperationList:
+		return pick(timeouts.List, defaultTimeouts.List)
+	case OperationInspect:
+		return pick(timeouts.Inspect, defaultTimeouts.Inspect)
+	case OperationAction:
+		return pick(timeouts.Action, defaultTimeouts.Action)
+	case OperationCreate:
+		return pick(timeouts.Create, defaultTimeouts.Create)
+	}
+	return pick(timeouts.Probe, defaultTimeouts.Probe)
+}
+
+// withTimeout runs fn with the timeout of the operation, running out of
+// time is reported as a TimeoutError while a cancelled ctx is returned as is
+func (ce *CommandExecutor) withTimeout(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	timeout := ce.timeout(operation)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := fn(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Operation: operation, Timeout: timeout}
+	}
+	return err
+}
@@ -0,0 +1,308 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Transport runs commands on a host, the commands are killed once their
+// context is done
+type Transport interface {
+	// Connect makes sure the host can be reached
+	Connect(ctx context.Context) error
+	// Run runs the command and returns its combined output, stdin is
+	// written to the command when set
+	Run(ctx context.Context, cmd string, stdin string) (string, error)
+	// Stream runs the command and returns its combined output as it is
+	// written, closing the stream stops the command
+	Stream(ctx context.Context, cmd string, stdin string) (io.ReadCloser, error)
+	// Interactive runs the command on a pty of the given size, an empty
+	// command starts the login shell of the user. Nothing but the keystrokes
+	// is written to the pty, secrets go through Run.
+	Interactive(ctx context.Context, cmd string, size TerminalSize) (Terminal, error)
+	// Dial opens a connection to the address as seen from the host, the
+	// context only bounds the dial
+	Dial(ctx context.Context, network, address string) (net.Conn, error)
+	Close() error
+}
+
+// Terminal is a command running on a pty, reads return its output and
+// writes are sent as keystrokes
+type Terminal interface {
+	io.ReadWriter
+	Resize(size TerminalSize) error
+	// Wait waits for the command to exit
+	Wait() error
+	Close() error
+}
+
+// TransportFactory returns the transport used to reach the host of a machine
+type TransportFactory func(m *Machine) Transport
+
+// ConnectionError is returned by transports when the host can not be reached,
+// errors of the command itself are returned as they are
+type ConnectionError struct {
+	Err error
+}
+
+func (e *ConnectionError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// sshTransport runs commands over the pooled ssh connection of a machine
+type sshTransport struct {
+	pool *sshPool
+}
+
+func newSSHTransport(m *Machine) Transport {
+	return &sshTransport{pool: newSSHPool(m.getSSHConn)}
+}
+
+func (t *sshTransport) Connect(ctx context.Context) error {
+	if _, err := t.pool.get(ctx); err != nil {
+		return &ConnectionError{Err: err}
+	}
+	return nil
+}
+
+func (t *sshTransport) newSession(ctx context.Context) (*ssh.Session, error) {
+	session, err := t.pool.newSession(ctx)
+	if err != nil {
+		var chanErr *ssh.OpenChannelError
+		if !errors.As(err, &chanErr) {
+			return nil, &ConnectionError{Err: err}
+		}
+		return nil, err
+	}
+	return session, nil
+}
+
+// killOnDone kills the remote command and closes the session once the
+// context is done, the returned function stops watching the context
+func killOnDone(ctx context.Context, session *ssh.Session) func() bool {
+	return context.AfterFunc(ctx, func() {
+		// closing the session alone leaves commands without a pty running
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+	})
+}
+
+func (t *sshTransport) Run(ctx context.Context, cmd string, stdin string) (string, error) {
+	session, err := t.newSession(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	defer killOnDone(ctx, session)()
+	var out lockedBuffer
+	session.Stdout = &out
+	session.Stderr = &out
+	if err := startWithStdin(session, cmd, stdin); err != nil {
+		return "", err
+	}
+	err = session.Wait()
+	if ctx.Err() != nil {
+		return out.String(), ctx.Err()
+	}
+	return out.String(), err
+}
+
+// startWithStdin starts the command and writes stdin to it. A command which
+// exits without reading its input, like sudo when no password is needed,
+// closes the channel first, that is not an error of the command.
+func startWithStdin(session *ssh.Session, cmd string, stdin string) error {
+	if stdin == "" {
+		return session.Start(cmd)
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+	go func() {
+		io.WriteString(w, stdin)
+		w.Close()
+	}()
+	return nil
+}
+
+// lockedBuffer collects stdout and stderr, they are copied concurrently
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// sshStream is the output of a command, closing it closes the session
+type sshStream struct {
+	*io.PipeReader
+	session *ssh.Session
+}
+
+func (s *sshStream) Close() error {
+	s.session.Close()
+	return s.PipeReader.Close()
+}
+
+func (t *sshTransport) Stream(ctx context.Context, cmd string, stdin string) (io.ReadCloser, error) {
+	session, err := t.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	session.Stdout = w
+	session.Stderr = w
+	if err := startWithStdin(session, cmd, stdin); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stop := killOnDone(ctx, session)
+	go func() {
+		// the reader gets the exit error of the command once the output is consumed
+		err := session.Wait()
+		stop()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		w.CloseWithError(err)
+		session.Close()
+	}()
+	return &sshStream{PipeReader: r, session: session}, nil
+}
+
+// sshTerminal is a command running on an ssh pty
+type sshTerminal struct {
+	session *ssh.Session
+	stdin   io.Writer
+	stdout  io.Reader
+	stop    func() bool
+}
+
+func (t *sshTerminal) Read(p []byte) (int, error) {
+	return t.stdout.Read(p)
+}
+
+func (t *sshTerminal) Write(p []byte) (int, error) {
+	return t.stdin.Write(p)
+}
+
+func (t *sshTerminal) Resize(size TerminalSize) error {
+	return t.session.WindowChange(size.Rows, size.Cols)
+}
+
+func (t *sshTerminal) Wait() error {
+	return t.session.Wait()
+}
+
+func (t *sshTerminal) Close() error {
+	t.stop()
+	return t.session.Close()
+}
+
+func (t *sshTransport) Interactive(ctx context.Context, cmd string, size TerminalSize) (Terminal, error) {
+	session, err := t.newSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// use pty here as it combines stdout and error
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	size = size.withDefaults()
+	if err := session.RequestPty("xterm", size.Rows, size.Cols, modes); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdinPipe, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if cmd == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(cmd)
+	}
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &sshTerminal{session: session, stdin: stdinPipe, stdout: stdout, stop: killOnDone(ctx, session)}, nil
+}
+
+func (t *sshTransport) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	client, err := t.pool.get(ctx)
+	if err != nil {
+		return nil, &ConnectionError{Err: err}
+	}
+	return client.DialContext(ctx, network, address)
+}
+
+func (t *sshTransport) Close() error {
+	return t.pool.Close()
+}
+
+// noShellTransport is used by docker endpoints which have no host to run
+// commands on
+type noShellTransport struct {
+	host string
+}
+
+func (t *noShellTransport) err() error {
+	return fmt.Errorf("%s is a docker endpoint without shell access", t.host)
+}
+
+func (t *noShellTransport) Connect(ctx context.Context) error {
+	return t.err()
+}
+
+func (t *noShellTransport) Run(ctx context.Context, cmd string, stdin string) (string, error) {
+	return "", t.err()
+}
+
+func (t *noShellTransport) Stream(ctx context.Context, cmd string, stdin string) (io.ReadCloser, error) {
+	return nil, t.err()
+}
+
+func (t *noShellTransport) Interactive(ctx context.Context, cmd string, size TerminalSize) (Terminal, error) {
+	return nil, t.err()
+}
+
+func (t *noShellTransport) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, t.err()
+}
+
+func (t *noShellTransport) Close() error {
+	return nil
+}
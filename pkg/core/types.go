@@ -1,17 +1,16 @@
 package core
 
 import (
+	"context"
 	"crazydocker/pkg/config"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net"
-	"os"
-	"os/exec"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/ssh"
 )
@@ -21,170 +20,187 @@ type MachineStatus int
 const MachineOnline = 1
 const MachineOffline = 0
 
+const defaultConnectTimeout = 5 * time.Second
+
 type MachineSSHConfig struct {
 	*config.PasswordAuth
 	*config.SSHAuth
-	ClientConfig *ssh.ClientConfig `json:"-"`
+	// User overrides the username of the auth settings
+	User           string
+	ConnectTimeout time.Duration
+	JumpHost       *config.JumpHost
+	// PrivilegeEscalation changes how the docker cli is run
+	PrivilegeEscalation *config.PrivilegeEscalation
 }
 
 type Machine struct {
-	Ip        string
-	parsedIp  net.IP
-	Status    MachineStatus
-	Os        string
-	HostName  string
-	Shell     string
-	Error     string
-	SSHConfig *MachineSSHConfig `json:"-"`
+	// Ip identifies the machine, it is the address of the host followed by
+	// the port when the port is not the default one
+	Ip       string
+	Name     string
+	Port     int
+	address  string
+	parsedIp net.IP
+	Status   MachineStatus
+	Os       string
+	HostName string
+	Shell    string
+	Error    string
+	// DockerAccess tells whether docker is reached through the engine api
+	// or the cli
+	DockerAccess string
+	SSHConfig    *MachineSSHConfig `json:"-"`
+	transport    Transport
+	docker       *dockerAccess
+	knownHosts   *KnownHosts
+	// endpoint is set for docker daemons reached without ssh
+	endpoint *config.DockerEndpoint
+	// access holds the bindings of the host and of its group
+	access []config.RoleBinding
+	// lock guards the listed fields, probes and operations update them
+	// while the machines are listed
+	lock sync.Mutex
 }
 
-func (m *Machine) getSSHConn() (*ssh.Client, error) {
-	if m.SSHConfig.ClientConfig == nil {
-		config := &ssh.ClientConfig{
-			User:            m.SSHConfig.PasswordAuth.Username,
-			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-			Auth: []ssh.AuthMethod{
-				ssh.Password(m.SSHConfig.Password),
-			},
-			Timeout: 5 * time.Second,
-		}
-		if m.SSHConfig.SSHAuth.PrivateKeyFile != "" {
-			pemByes, err := os.ReadFile(fmt.Sprintf("%s/%s", os.Getenv("CONFIG_FOLDER"), m.SSHConfig.SSHAuth.PrivateKeyFile))
-			if err != nil {
-				return nil, err
-			}
-			signer, err := ssh.ParsePrivateKey(pemByes)
-			if err != nil {
-				return nil, err
-			}
-			config.User = m.SSHConfig.SSHAuth.Username
-			config.Auth = []ssh.AuthMethod{
-				ssh.PublicKeys(signer),
-			}
-		}
-		m.SSHConfig.ClientConfig = config
-	}
-	return ssh.Dial("tcp", net.JoinHostPort(m.Ip, "22"), m.SSHConfig.ClientConfig)
+func newMachine(host config.HostConfig, parsedIp net.IP, sshConfig *MachineSSHConfig, knownHosts *KnownHosts, newTransport TransportFactory) *Machine {
+	m := &Machine{Ip: machineID(host), Name: host.Name, Port: host.Port, address: host.Address, Status: MachineOnline, parsedIp: parsedIp, SSHConfig: sshConfig, docker: &dockerAccess{}, knownHosts: knownHosts, access: host.Access}
+	m.transport = newTransport(m)
+	return m
 }
 
-func (m *Machine) RunCommand(cmd string) (string, error) {
-	conn, err := m.getSSHConn()
+// newEndpointMachine returns the machine of a docker endpoint, the host of
+// the endpoint identifies the machine
+func newEndpointMachine(endpoint config.DockerEndpoint) *Machine {
+	return &Machine{Ip: endpoint.Host, Name: endpoint.Name, address: endpoint.Host, Status: MachineOnline, transport: &noShellTransport{host: endpoint.Host}, docker: &dockerAccess{}, endpoint: &endpoint, access: endpoint.Access}
+}
+
+func (m *Machine) getSSHConn(ctx context.Context) (*ssh.Client, error) {
+	// the client config is built on every dial so that changes to key files
+	// are picked up when the pool reconnects
+	hops, err := jumpHops(m.SSHConfig.JumpHost, m.knownHosts)
 	if err != nil {
-		m.Status = MachineOffline
-		return "", err
+		return nil, err
 	}
-	defer conn.Close()
-	session, err := conn.NewSession()
+	address := net.JoinHostPort(m.address, strconv.Itoa(m.Port))
+	clientConfig, release, err := newClientConfig(m.SSHConfig.PasswordAuth, m.SSHConfig.SSHAuth, m.SSHConfig.User, m.SSHConfig.ConnectTimeout, address, m.knownHosts)
 	if err != nil {
-		return "", err
+		releaseHops(hops)
+		return nil, err
 	}
-	defer session.Close()
-	out, err := session.CombinedOutput(cmd)
-	return strings.TrimSpace(string(out)), err
+	return dialHops(ctx, append(hops, &hop{address: address, config: clientConfig, release: release}))
 }
 
-func (m *Machine) StreamCommand(writeConn *websocket.Conn, cmd string) error {
-	conn, err := m.getSSHConn()
+// machineID returns the key used to look up the machine of the host
+func machineID(host config.HostConfig) string {
+	if host.Port == config.DefaultSSHPort {
+		return host.Address
+	}
+	return net.JoinHostPort(host.Address, strconv.Itoa(host.Port))
+}
+
+// updateStatus marks the machine offline when the transport could not reach
+// the host
+func (m *Machine) updateStatus(err error) {
+	if m.endpoint != nil {
+		// endpoints are marked by the docker backend
+		return
+	}
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		m.setStatus(MachineOffline)
+	} else {
+		m.setStatus(MachineOnline)
+	}
+}
+
+func (m *Machine) setStatus(status MachineStatus) {
+	m.update(func() { m.Status = status })
+}
+
+// update changes listed fields of the machine under its lock
+func (m *Machine) update(f func()) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	f()
+}
+
+// snapshot returns a copy of the listed fields of the machine
+func (m *Machine) snapshot() *Machine {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return &Machine{Ip: m.Ip, Name: m.Name, Port: m.Port, Status: m.Status, Os: m.Os, HostName: m.HostName, Shell: m.Shell, Error: m.Error, DockerAccess: m.DockerAccess}
+}
+
+// Close releases the connection and the docker client of the machine
+func (m *Machine) Close() error {
+	m.docker.close()
+	return m.transport.Close()
+}
+
+func (m *Machine) RunCommand(ctx context.Context, cmd string) (string, error) {
+	return m.runCommand(ctx, cmd, "")
+}
+
+func (m *Machine) runCommand(ctx context.Context, cmd string, stdin string) (string, error) {
+	out, err := m.transport.Run(ctx, cmd, stdin)
+	m.updateStatus(err)
+	return strings.TrimSpace(out), err
+}
+
+// StreamCommand writes the output of the command to the websocket until it
+// exits or the client goes away
+func (m *Machine) StreamCommand(ctx context.Context, writeConn *websocket.Conn, cmd string) error {
+	return m.streamCommand(ctx, writeConn, cmd, "")
+}
+
+func (m *Machine) streamCommand(ctx context.Context, writeConn *websocket.Conn, cmd string, stdin string) error {
+	defer writeConn.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := m.transport.Stream(ctx, cmd, stdin)
+	m.updateStatus(err)
 	if err != nil {
 		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
-		m.Status = MachineOffline
 		return err
 	}
+	defer stream.Close()
+	// stop the command once the client goes away
 	go func() {
-		defer writeConn.Close()
-		ticker := time.NewTicker(5 * time.Second)
-		for {
-			<-ticker.C
-			session, err := conn.NewSession()
-			if err != nil {
-				writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
-				ticker.Stop()
-				return
-			}
-			modes := ssh.TerminalModes{
-				ssh.ECHO:          0,
-				ssh.TTY_OP_ISPEED: 14400,
-				ssh.TTY_OP_OSPEED: 14400,
-			}
-			err = session.RequestPty("xterm", 80, 40, modes)
-			if err != nil {
-				writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
-				session.Close()
-				ticker.Stop()
-				return
-			}
-			err = writeConn.WriteMessage(websocket.PingMessage, []byte(""))
-			if err != nil {
-				ticker.Stop()
-				session.Close()
-				return
-			}
-			output, err := session.CombinedOutput(cmd)
-			if err != nil {
-				writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
-			} else {
-				writeConn.WriteMessage(websocket.TextMessage, output)
-			}
-			session.Close()
-		}
+		<-readUntilClosed(writeConn)
+		cancel()
+		stream.Close()
 	}()
+	writeTerminalOutput(writeConn, &terminalNewlines{r: stream})
 	return nil
 }
 
-func (m *Machine) GetShell(writeConn *websocket.Conn) error {
-	return m.ExecCommand(writeConn, m.Shell)
+func (m *Machine) GetShell(ctx context.Context, writeConn *websocket.Conn, size TerminalSize) error {
+	// an empty command starts the login shell of the user
+	return m.ExecCommand(ctx, writeConn, "", size)
+}
+
+func (m *Machine) ExecCommand(ctx context.Context, writeConn *websocket.Conn, cmd string, size TerminalSize) error {
+	return m.execCommand(ctx, writeConn, cmd, size)
 }
 
-func (m *Machine) ExecCommand(writeConn *websocket.Conn, cmd string) error {
+func (m *Machine) execCommand(ctx context.Context, writeConn *websocket.Conn, cmd string, size TerminalSize) error {
 	defer writeConn.Close()
-	// use pty here as it combines stdout and error
-	var command *exec.Cmd
-	if m.SSHConfig.Password != "" {
-		command = exec.Command("sshpass", "-p", m.SSHConfig.Password, "ssh", "-tt", "-o StrictHostKeyChecking=no", "-o UserKnownHostsFile=/dev/null", fmt.Sprintf("%s@%s", m.SSHConfig.PasswordAuth.Username, m.Ip), cmd)
-	} else {
-		command = exec.Command("ssh", "-tt", "-i", fmt.Sprintf("%s/%s", os.Getenv("CONFIG_FOLDER"), m.SSHConfig.PrivateKeyFile), "-o StrictHostKeyChecking=no", "-o UserKnownHostsFile=/dev/null", fmt.Sprintf("%s@%s", m.SSHConfig.SSHAuth.Username, m.Ip), cmd)
-	}
-	ptmx, err := pty.Start(command)
+	terminal, err := m.transport.Interactive(ctx, cmd, size)
+	m.updateStatus(err)
 	if err != nil {
 		writeConn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf("{\"err:\"%s\"}", err.Error())))
 		return err
 	}
-	defer ptmx.Close()
+	defer terminal.Close()
+	stdout, resize := recordTerminal(ctx, size, terminal, terminal.Resize)
 	// go routine to read message
 	go func() {
-		for {
-			defer ptmx.Close()
-			_, data, err := writeConn.ReadMessage()
-			if err != nil {
-				log.Printf("reader err :%s\n", err)
-				return
-			}
-			_, err = ptmx.Write(data)
-			if err != nil {
-				log.Printf("ptmx write err :%s\n", err)
-				return
-			}
-		}
-	}()
-	// go routine to write message
-	go func() {
-		defer ptmx.Close()
-		buf := make([]byte, 1024)
-		for {
-			n, err := ptmx.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("ptmx read err :%s\n", err)
-					return
-				}
-			}
-			if err := writeConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
-				log.Printf("writer err :%s\n", err)
-				return
-			}
-		}
+		// closing the terminal ends the remote command once the client is gone
+		defer terminal.Close()
+		readTerminalInput(writeConn, terminal, resize)
 	}()
-	command.Wait()
+	writeTerminalOutput(writeConn, stdout)
+	terminal.Wait()
 	return nil
 }
 
@@ -0,0 +1,285 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the keys are fetched again for unknown key ids at most this often, the
+// provider rotates them from time to time
+const keyRefreshInterval = time.Minute
+
+// clockSkew is tolerated between the provider and this server
+const clockSkew = time.Minute
+
+// algorithms are the signatures accepted on id tokens
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+}
+
+// jwk is a public key of the provider
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("malformed key")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the key, keys of other kinds or uses are skipped
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("malformed key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("malformed key")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// keySet holds the signing keys of the provider by their id
+type keySet struct {
+	uri     string
+	getJSON func(ctx context.Context, u string, v interface{}) error
+	lock    sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newKeySet(uri string, getJSON func(ctx context.Context, u string, v interface{}) error) *keySet {
+	return &keySet{uri: uri, getJSON: getJSON, keys: map[string]crypto.PublicKey{}}
+}
+
+// key returns the key with the id, an empty id is only accepted when the
+// provider has a single key
+func (s *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if key, ok := s.find(kid); ok {
+		return key, nil
+	}
+	if time.Since(s.fetched) < keyRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := s.getJSON(ctx, s.uri, &set); err != nil {
+		return nil, fmt.Errorf("unable to fetch the signing keys of the oidc provider: %w", err)
+	}
+	s.fetched = time.Now()
+	s.keys = map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			s.keys[k.Kid] = key
+		}
+	}
+	if key, ok := s.find(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// find looks the key up, the caller must hold the lock
+func (s *keySet) find(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// checkSignature verifies the signature of the signed part of a token
+func checkSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	hash, ok := algorithms[alg]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			break
+		}
+		if rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil {
+			return nil
+		}
+		return errors.New("invalid id token signature")
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			break
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid id token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(k, digest, r, s) {
+			return nil
+		}
+		return errors.New("invalid id token signature")
+	}
+	return fmt.Errorf("the signing key does not match the algorithm %q", alg)
+}
+
+// audience is the aud claim, a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// verify checks the id token of a login and returns the user it names
+func (p *Provider) verify(ctx context.Context, idToken string, nonce string) (*Identity, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, errors.New("malformed id token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed id token signature")
+	}
+	if _, ok := algorithms[header.Alg]; !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm %q", header.Alg)
+	}
+	key, err := p.keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed id token claims")
+	}
+	var claims struct {
+		Issuer   string   `json:"iss"`
+		Subject  string   `json:"sub"`
+		Audience audience `json:"aud"`
+		Expires  int64    `json:"exp"`
+		Nonce    string   `json:"nonce"`
+	}
+	all := map[string]interface{}{}
+	if json.Unmarshal(payload, &claims) != nil || json.Unmarshal(payload, &all) != nil {
+		return nil, errors.New("malformed id token claims")
+	}
+	if claims.Issuer != p.settings.Issuer {
+		return nil, fmt.Errorf("the id token was issued by %q", claims.Issuer)
+	}
+	found := false
+	for _, a := range claims.Audience {
+		found = found || a == p.settings.ClientID
+	}
+	if !found {
+		return nil, errors.New("the id token is not meant for this client")
+	}
+	if time.Now().After(time.Unix(claims.Expires, 0).Add(clockSkew)) {
+		return nil, errors.New("the id token expired")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("the id token does not belong to this login")
+	}
+	identity := &Identity{Subject: claims.Subject, Groups: []string{}, Expires: time.Unix(claims.Expires, 0)}
+	// the subject is unique and never changes for the issuer
+	claim := p.settings.UsernameClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	identity.Username = claims.Subject
+	if claim != "sub" {
+		identity.Username, _ = all[claim].(string)
+	}
+	if identity.Username == "" {
+		return nil, fmt.Errorf("the id token has no %s claim", claim)
+	}
+	switch groups := all[p.settings.GroupsClaim].(type) {
+	case string:
+		identity.Groups = append(identity.Groups, groups)
+	case []interface{}:
+		for _, g := range groups {
+			if name, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	return identity, nil
+}
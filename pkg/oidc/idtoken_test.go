@@ -0,0 +1,156 @@
+package oidc
+
+import (
+	"context"
+	"crazydocker/pkg/config"
+	"crazydocker/pkg/oidctest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClientID = "dockerfrenzy"
+const testNonce = "n0nce"
+
+// testProvider returns a provider of a test issuer with its endpoints and
+// keys known, the username is read from the claim
+func testProvider(t *testing.T, usernameClaim string) (*Provider, *oidctest.Issuer) {
+	t.Helper()
+	issuer, err := oidctest.NewIssuer(oidctest.Config{ClientID: testClientID, Username: "alice", Groups: []string{"ops"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+	p, err := NewProvider(config.OIDC{
+		Issuer:        issuer.URL(),
+		ClientID:      testClientID,
+		RedirectURL:   "http://127.0.0.1/oidc/callback",
+		UsernameClaim: usernameClaim,
+		GroupsClaim:   "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.endpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return p, issuer
+}
+
+func TestVerify(t *testing.T) {
+	p, issuer := testProvider(t, "preferred_username")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name   string
+		header map[string]string
+		claims map[string]interface{}
+		nonce  string
+		err    string
+	}{
+		{name: "valid"},
+		{name: "audience list", claims: map[string]interface{}{"aud": []string{"other", testClientID}}},
+		{name: "wrong nonce", nonce: "other", err: "does not belong to this login"},
+		{name: "wrong audience", claims: map[string]interface{}{"aud": "other"}, err: "not meant for this client"},
+		{name: "wrong issuer", claims: map[string]interface{}{"iss": "https://idp.example.com"}, err: "issued by"},
+		{name: "expired", claims: map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, err: "expired"},
+		{name: "no expiry", claims: map[string]interface{}{"exp": nil}, err: "expired"},
+		{name: "unknown key", header: map[string]string{"kid": "rotated"}, err: `unknown signing key "rotated"`},
+		// the rsa signature is checked as if it was an ecdsa one
+		{name: "algorithm of another key type", header: map[string]string{"alg": "ES256"}, err: "does not match the algorithm"},
+		{name: "symmetric algorithm", header: map[string]string{"alg": "HS256"}, err: "unsupported signature algorithm"},
+		{name: "no algorithm", header: map[string]string{"alg": "none"}, err: "unsupported signature algorithm"},
+		// the token is signed as rs256 but claims a stronger hash
+		{name: "other hash", header: map[string]string{"alg": "RS512"}, err: "invalid id token signature"},
+		{name: "no username", claims: map[string]interface{}{"preferred_username": nil}, err: "has no preferred_username claim"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := map[string]string{"alg": "RS256", "kid": oidctest.KeyID, "typ": "JWT"}
+			for k, v := range test.header {
+				header[k] = v
+			}
+			claims := map[string]interface{}{
+				"iss":                issuer.URL(),
+				"sub":                "sub-alice",
+				"aud":                testClientID,
+				"exp":                expires.Unix(),
+				"nonce":              testNonce,
+				"preferred_username": "alice",
+				"groups":             []string{"ops", "dev"},
+			}
+			for k, v := range test.claims {
+				if v == nil {
+					delete(claims, k)
+					continue
+				}
+				claims[k] = v
+			}
+			token, err := issuer.Sign(header, claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce := testNonce
+			if test.nonce != "" {
+				nonce = test.nonce
+			}
+			identity, err := p.verify(context.Background(), token, nonce)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &Identity{Subject: "sub-alice", Username: "alice", Groups: []string{"ops", "dev"}, Expires: expires}
+			if !reflect.DeepEqual(identity, want) {
+				t.Fatalf("expected %+v, got %+v", want, identity)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsTamperedClaims(t *testing.T) {
+	p, issuer := testProvider(t, "preferred_username")
+	claims := map[string]interface{}{"iss": issuer.URL(), "sub": "sub-bob", "aud": testClientID, "exp": time.Now().Add(time.Hour).Unix(), "nonce": testNonce, "preferred_username": "bob"}
+	token, err := issuer.Sign(map[string]string{"alg": "RS256", "kid": oidctest.KeyID}, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims["preferred_username"] = "admin"
+	forged, err := issuer.Sign(map[string]string{"alg": "RS256", "kid": oidctest.KeyID}, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the claims of the forged token with the signature of the first one
+	parts, forgedParts := strings.Split(token, "."), strings.Split(forged, ".")
+	if _, err := p.verify(context.Background(), parts[0]+"."+forgedParts[1]+"."+parts[2], testNonce); err == nil || !strings.Contains(err.Error(), "invalid id token signature") {
+		t.Fatalf("expected the signature to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyUsesSubjectByDefault(t *testing.T) {
+	p, issuer := testProvider(t, "")
+	claims := map[string]interface{}{"iss": issuer.URL(), "sub": "sub-alice", "aud": testClientID, "exp": time.Now().Add(time.Hour).Unix(), "nonce": testNonce, "preferred_username": "admin"}
+	token, err := issuer.Sign(map[string]string{"alg": "RS256", "kid": oidctest.KeyID}, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the user renamed itself at the provider, its subject stays
+	identity, err := p.verify(context.Background(), token, testNonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Username != "sub-alice" {
+		t.Fatalf("expected the subject as the username, got %s", identity.Username)
+	}
+	delete(claims, "sub")
+	if token, err = issuer.Sign(map[string]string{"alg": "RS256", "kid": oidctest.KeyID}, claims); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.verify(context.Background(), token, testNonce); err == nil || !strings.Contains(err.Error(), "has no sub claim") {
+		t.Fatalf("expected a token without subject to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+// Package oidc signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE.
+package oidc
+
+import (
+	"context"
+	"crazydocker/pkg/config"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logins have to be finished within this time
+const loginTTL = 10 * time.Minute
+
+const requestTimeout = 10 * time.Second
+
+var ErrUnknownState = errors.New("unknown or expired login, start again")
+
+// Identity is the user the provider signed in
+type Identity struct {
+	Subject  string
+	Username string
+	Groups   []string
+	// Expires is the expiry of the id token
+	Expires time.Time
+}
+
+// discovery holds the endpoints of the provider
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// pendingLogin is a login sent to the provider which did not come back yet
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	next     string
+	expires  time.Time
+}
+
+// Provider talks to the provider of the settings, its endpoints and keys are
+// fetched when first needed
+type Provider struct {
+	settings     config.OIDC
+	clientSecret string
+	client       *http.Client
+	lock         sync.Mutex
+	discovery    *discovery
+	keys         *keySet
+	pending      map[string]*pendingLogin
+}
+
+func NewProvider(settings config.OIDC) (*Provider, error) {
+	secret, err := config.ResolveSecret(settings.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{
+		settings:     settings,
+		clientSecret: secret,
+		client:       &http.Client{Timeout: requestTimeout},
+		pending:      map[string]*pendingLogin{},
+	}, nil
+}
+
+// Settings returns the settings the provider was made with
+func (p *Provider) Settings() config.OIDC {
+	return p.settings
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// getJSON fetches a JSON document of the provider
+func (p *Provider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// endpoints returns the discovery document of the provider, it is fetched
+// once
+func (p *Provider) endpoints(ctx context.Context) (*discovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := &discovery{}
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.settings.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("unable to discover the oidc provider: %w", err)
+	}
+	if d.Issuer != p.settings.Issuer {
+		return nil, fmt.Errorf("the oidc provider calls itself %q instead of %q", d.Issuer, p.settings.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("the discovery document of the oidc provider is missing endpoints")
+	}
+	p.discovery = d
+	p.keys = newKeySet(d.JWKSURI, p.getJSON)
+	return d, nil
+}
+
+// AuthCodeURL starts a login and returns the url of the provider to send the
+// browser to and the state which comes back with it. next is handed back
+// once the login is done.
+func (p *Provider) AuthCodeURL(ctx context.Context, next string) (authURL string, state string, err error) {
+	d, err := p.endpoints(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	login := &pendingLogin{next: next, expires: time.Now().Add(loginTTL)}
+	if state, err = randomString(); err != nil {
+		return "", "", err
+	}
+	if login.verifier, err = randomString(); err != nil {
+		return "", "", err
+	}
+	if login.nonce, err = randomString(); err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(login.verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.settings.ClientID},
+		"redirect_uri":          {p.settings.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid", "profile", "email"}, p.settings.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", "", err
+	}
+	for key, values := range u.Query() {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	for key, pending := range p.pending {
+		if now.After(pending.expires) {
+			delete(p.pending, key)
+		}
+	}
+	p.pending[state] = login
+	return u.String(), state, nil
+}
+
+// tokenResponse is the answer of the token endpoint
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange finishes the login of the state with the code the provider sent
+// back, it returns the signed in user and the next of AuthCodeURL
+func (p *Provider) Exchange(ctx context.Context, state string, code string) (*Identity, string, error) {
+	p.lock.Lock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	p.lock.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return nil, "", ErrUnknownState
+	}
+	d, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.settings.RedirectURL},
+		"client_id":     {p.settings.ClientID},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.settings.ClientID), url.QueryEscape(p.clientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var token tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, "", fmt.Errorf("unable to read the answer of the token endpoint: %w", err)
+	}
+	if token.Error != "" {
+		return nil, "", fmt.Errorf("the oidc provider refused the code: %s %s", token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return nil, "", fmt.Errorf("the token endpoint returned %s without an id token", resp.Status)
+	}
+	identity, err := p.verify(ctx, token.IDToken, login.nonce)
+	if err != nil {
+		return nil, "", err
+	}
+	return identity, login.next, nil
+}
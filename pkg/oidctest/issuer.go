@@ -0,0 +1,230 @@
+// Package oidctest provides an in-process OpenID Connect provider which signs
+// in a configured user without asking, single sign-on can be exercised
+// without an identity provider.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// KeyID is the id of the signing key of the issuer
+const KeyID = "oidctest"
+
+// Config holds the client accepted by the issuer and the user it signs in
+type Config struct {
+	ClientID string
+	// ClientSecret is expected with basic auth on the token endpoint, public
+	// clients are accepted when empty
+	ClientSecret string
+	Username     string
+	Groups       []string
+	// TokenTTL is how long the id tokens are valid, an hour by default
+	TokenTTL time.Duration
+}
+
+// grant is an authorization code waiting to be exchanged
+type grant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	username    string
+	groups      []string
+}
+
+// Issuer is the provider, it listens on a local port until closed
+type Issuer struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	lock   sync.Mutex
+	config Config
+	grants map[string]*grant
+}
+
+func NewIssuer(config Config) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	i := &Issuer{key: key, config: config, grants: map[string]*grant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/jwks", i.jwks)
+	mux.HandleFunc("/authorize", i.authorize)
+	mux.HandleFunc("/token", i.token)
+	i.server = httptest.NewServer(mux)
+	return i, nil
+}
+
+// URL is the issuer to configure
+func (i *Issuer) URL() string {
+	return i.server.URL
+}
+
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// SetUser changes the user signed in by the next logins
+func (i *Issuer) SetUser(username string, groups []string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.config.Username = username
+	i.config.Groups = groups
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (i *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"issuer":                                i.URL(),
+		"authorization_endpoint":                i.URL() + "/authorize",
+		"token_endpoint":                        i.URL() + "/token",
+		"jwks_uri":                              i.URL() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (i *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(i.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(i.key.E)).Bytes()),
+		}},
+	})
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// authorize signs the configured user in right away and sends the browser
+// back with a code
+func (i *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", 400)
+		return
+	}
+	if query.Get("client_id") != i.config.ClientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", 400)
+		return
+	}
+	code := randomString()
+	i.lock.Lock()
+	i.grants[code] = &grant{
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		username:    i.config.Username,
+		groups:      i.config.Groups,
+	}
+	i.lock.Unlock()
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", query.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// token exchanges a code for an id token, the code can only be used once
+func (i *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+		writeJSON(w, 400, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if i.config.ClientSecret != "" {
+		id, secret, _ := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if id != i.config.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(i.config.ClientSecret)) != 1 {
+			writeJSON(w, 401, map[string]string{"error": "invalid_client"})
+			return
+		}
+	}
+	i.lock.Lock()
+	g, ok := i.grants[r.PostForm.Get("code")]
+	delete(i.grants, r.PostForm.Get("code"))
+	i.lock.Unlock()
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("client_id") != i.config.ClientID ||
+		r.PostForm.Get("redirect_uri") != g.redirectURI || base64.RawURLEncoding.EncodeToString(challenge[:]) != g.challenge {
+		writeJSON(w, 400, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	ttl := i.config.TokenTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	idToken, err := i.sign(map[string]interface{}{
+		"iss":                i.URL(),
+		"sub":                "sub-" + g.username,
+		"aud":                i.config.ClientID,
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(ttl).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.username,
+		"groups":             g.groups,
+	})
+	if err != nil {
+		writeJSON(w, 500, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, 200, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// sign returns the claims as a RS256 signed token
+func (i *Issuer) sign(claims map[string]interface{}) (string, error) {
+	return i.Sign(map[string]string{"alg": "RS256", "kid": KeyID, "typ": "JWT"}, claims)
+}
+
+// Sign signs the header and the claims with the RS256 key of the issuer
+// whatever the header says, tests use it to hand clients tokens the issuer
+// would not issue
+func (i *Issuer) Sign(header map[string]string, claims map[string]interface{}) (string, error) {
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,53 @@
+// Package rbac defines the roles users can be bound to and what they allow.
+package rbac
+
+import "fmt"
+
+// Role is what a user may do on a host, each role includes the ones below
+// it
+type Role int
+
+const (
+	// RoleNone can not see the host at all
+	RoleNone Role = iota
+	// RoleViewer lists containers and images and reads logs
+	RoleViewer
+	// RoleOperator runs container actions, creates containers and execs
+	// into them
+	RoleOperator
+	// RoleAdmin gets a shell on the host and manages the server config
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleNone:     "none",
+	RoleViewer:   "viewer",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("role(%d)", int(r))
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// Allows tells if the role includes the required one
+func (r Role) Allows(required Role) bool {
+	return r >= required
+}
+
+// ParseRole returns the role of the name used in the config
+func ParseRole(name string) (Role, error) {
+	for role, n := range roleNames {
+		if n == name && role != RoleNone {
+			return role, nil
+		}
+	}
+	return RoleNone, fmt.Errorf("unknown role %q, expected viewer, operator or admin", name)
+}
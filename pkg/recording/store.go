@@ -0,0 +1,305 @@
+// Package recording stores the output of terminal sessions as asciicast v2
+// files (https://docs.asciinema.org/manual/asciicast/v2/) so they can be
+// played back with asciinema.
+package recording
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const extension = ".cast"
+
+var idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+var ErrNotFound = errors.New("recording not found")
+
+// Meta describes a recorded session
+type Meta struct {
+	ID        string
+	User      string
+	Host      string
+	Container string `json:",omitempty"`
+	Command   string
+	Time      time.Time
+	// Duration is the time between the start and the last output
+	Duration time.Duration
+	Size     int64
+}
+
+// header is the first line of an asciicast v2 file, the fields after env are
+// ours and ignored by players
+type header struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env"`
+	User      string            `json:"user"`
+	Host      string            `json:"host"`
+	Container string            `json:"container,omitempty"`
+	Command   string            `json:"command"`
+}
+
+// Store keeps the recordings in a folder, one file per session
+type Store struct {
+	dir string
+}
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+extension)
+}
+
+// Create starts the recording of a session, the file is written once the
+// size of the terminal is known
+func (s *Store) Create(meta Meta) (*Recording, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	meta.ID = hex.EncodeToString(b)
+	meta.Time = time.Now()
+	file, err := os.OpenFile(s.path(meta.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recording{meta: meta, file: file}, nil
+}
+
+// Open returns the file of the recording
+func (s *Store) Open(id string) (*os.File, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	file, err := os.Open(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return file, err
+}
+
+// Get returns the description of the recording
+func (s *Store) Get(id string) (*Meta, error) {
+	if !idPattern.MatchString(id) {
+		return nil, ErrNotFound
+	}
+	meta, err := readMeta(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return meta, err
+}
+
+// List returns the recordings, the newest first
+func (s *Store) List() ([]Meta, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+extension))
+	if err != nil {
+		return nil, err
+	}
+	recordings := []Meta{}
+	for _, path := range paths {
+		if !idPattern.MatchString(strings.TrimSuffix(filepath.Base(path), extension)) {
+			continue
+		}
+		meta, err := readMeta(path)
+		if err != nil {
+			// recordings which did not get any output yet have no header
+			continue
+		}
+		recordings = append(recordings, *meta)
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Time.After(recordings[j].Time)
+	})
+	return recordings, nil
+}
+
+// Cleanup deletes the recordings older than the retention, nothing is
+// deleted when the retention is not set
+func (s *Store) Cleanup(retention time.Duration) error {
+	if retention <= 0 {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+extension))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if time.Since(info.ModTime()) > retention {
+			if err := os.Remove(path); err != nil {
+				log.Printf("unable to delete recording %s :%s\n", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readMeta reads the header and the time of the last event of a recording
+func readMeta(path string) (*Meta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("%s has no header", path)
+	}
+	var h header
+	if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+		return nil, err
+	}
+	var last float64
+	for scanner.Scan() {
+		var event []json.RawMessage
+		if json.Unmarshal(scanner.Bytes(), &event) == nil && len(event) > 0 {
+			json.Unmarshal(event[0], &last)
+		}
+	}
+	return &Meta{
+		ID:        strings.TrimSuffix(filepath.Base(path), extension),
+		User:      h.User,
+		Host:      h.Host,
+		Container: h.Container,
+		Command:   h.Command,
+		Time:      time.Unix(h.Timestamp, 0),
+		Duration:  time.Duration(last * float64(time.Second)),
+		Size:      info.Size(),
+	}, nil
+}
+
+// Recording writes the events of a session, it implements
+// core.TerminalRecorder
+type Recording struct {
+	meta    Meta
+	lock    sync.Mutex
+	file    *os.File
+	started bool
+	// pending holds the start of a utf-8 sequence cut at the end of a chunk
+	pending []byte
+	err     error
+}
+
+// ID returns the id the recording is stored under
+func (r *Recording) ID() string {
+	return r.meta.ID
+}
+
+// write appends a line to the file, the first error is logged and stops
+// the recording. The caller must hold the lock.
+func (r *Recording) write(v interface{}) {
+	if r.err != nil {
+		return
+	}
+	line, err := json.Marshal(v)
+	if err == nil {
+		line = append(line, '\n')
+		_, err = r.file.Write(line)
+	}
+	if err != nil {
+		r.err = err
+		log.Printf("unable to write recording %s :%s\n", r.meta.ID, err)
+	}
+}
+
+func (r *Recording) elapsed() float64 {
+	return float64(time.Since(r.meta.Time).Microseconds()) / 1e6
+}
+
+// Resize writes the header on the first call and a resize event afterwards
+func (r *Recording) Resize(cols int, rows int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.started {
+		r.started = true
+		r.write(&header{
+			Version:   2,
+			Width:     cols,
+			Height:    rows,
+			Timestamp: r.meta.Time.Unix(),
+			Title:     fmt.Sprintf("%s on %s", r.meta.User, r.meta.Host),
+			Env:       map[string]string{"TERM": "xterm"},
+			User:      r.meta.User,
+			Host:      r.meta.Host,
+			Container: r.meta.Container,
+			Command:   r.meta.Command,
+		})
+		return
+	}
+	r.write([]interface{}{r.elapsed(), "r", fmt.Sprintf("%dx%d", cols, rows)})
+}
+
+// Output writes an output event, the output is dropped until the header is
+// written
+func (r *Recording) Output(data []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.started {
+		return
+	}
+	// players expect valid utf-8, a sequence cut at the end of the chunk is
+	// written with the next one
+	data = append(r.pending, data...)
+	data, r.pending = splitIncomplete(data)
+	if len(data) > 0 {
+		r.write([]interface{}{r.elapsed(), "o", strings.ToValidUTF8(string(data), "\uFFFD")})
+	}
+}
+
+// splitIncomplete returns the data without a trailing incomplete utf-8
+// sequence and that sequence
+func splitIncomplete(data []byte) ([]byte, []byte) {
+	for i := 1; i <= utf8.UTFMax-1 && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i], append([]byte{}, data[len(data)-i:]...)
+			}
+			break
+		}
+	}
+	return data, nil
+}
+
+// Close ends the recording, recordings which never started are deleted
+func (r *Recording) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.pending) > 0 && r.started {
+		r.write([]interface{}{r.elapsed(), "o", strings.ToValidUTF8(string(r.pending), "\uFFFD")})
+	}
+	err := r.file.Close()
+	if !r.started {
+		os.Remove(r.file.Name())
+	}
+	return err
+}
@@ -0,0 +1,72 @@
+package sshtest
+
+import (
+	"embed"
+	"fmt"
+	"time"
+)
+
+// ids of the containers and images of the default fixtures
+const WebContainerID = "3f4e1b2c9d8a7e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+const CacheContainerID = "8a9b0c1d2e3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b"
+const NginxImageID = "sha256:a8758716bb6aa4d90071160d27028fe4eaee7ce8166221a97d30440c8eac2be6"
+const RedisImageID = "sha256:7614ae9453d1d87e740a2056257a6de7135c84037c367e1fffa92ae922784631"
+
+// CreatedContainerID is printed by docker run
+const CreatedContainerID = "c0ffee0123456789abcdef0123456789abcdef0123456789abcdef0123456789"
+
+//go:embed fixtures
+var fixtureFiles embed.FS
+
+// Fixture is the answer to a command
+type Fixture struct {
+	Output     string
+	ExitStatus uint32
+	// Follow keeps the command running after the output is written until the
+	// client closes the session, like docker logs --follow
+	Follow bool
+	// Interactive runs an echo shell instead of writing the output
+	Interactive bool
+	// Delay is waited before anything is written, it simulates a hung command
+	// which only ends early when it is killed
+	Delay time.Duration
+}
+
+func fixture(name string) string {
+	data, err := fixtureFiles.ReadFile("fixtures/" + name)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+// DefaultFixtures answers the commands run by the api against a host with
+// the web and cache containers and the nginx and redis images, the outputs
+// were recorded from a real host
+func DefaultFixtures() map[string]Fixture {
+	fixtures := map[string]Fixture{
+		`hostnamectl | grep -Ei "Static hostname|Operating System" | cut -f2 -d ":"`: {Output: fixture("hostnamectl.txt")},
+		"echo $SHELL": {Output: "/bin/bash\n"},
+		`docker container ls --all --format "{{json . }}" --no-trunc`:                       {Output: fixture("containers.jsonl")},
+		`docker image ls --all --format "{{json . }}" --no-trunc`:                           {Output: fixture("images.jsonl")},
+		fmt.Sprintf("docker container inspect '%s'", WebContainerID):                        {Output: fixture("container_inspect.json")},
+		fmt.Sprintf("docker image inspect '%s'", NginxImageID):                              {Output: fixture("image_inspect.json")},
+		fmt.Sprintf("docker logs --follow '%s'", WebContainerID):                            {Output: fixture("logs.txt"), Follow: true},
+		fmt.Sprintf("docker exec -it '%s' sh", WebContainerID):                              {Interactive: true},
+		fmt.Sprintf(`docker inspect '%s' --format "{{ index .RepoTags 0 }}"`, NginxImageID): {Output: "nginx:1.25\n"},
+		fmt.Sprintf(`docker inspect '%s' --format "{{ index .RepoTags 0 }}"`, RedisImageID): {Output: "redis:7.2\n"},
+	}
+	for _, id := range []string{WebContainerID, CacheContainerID} {
+		for _, action := range []string{"start", "stop", "restart", "kill", "pause", "unpause", "rm"} {
+			fixtures[fmt.Sprintf("docker '%s' '%s'", action, id)] = Fixture{Output: id + "\n"}
+		}
+	}
+	return fixtures
+}
+
+// DefaultPrefixFixtures answers commands with variable arguments
+func DefaultPrefixFixtures() map[string]Fixture {
+	return map[string]Fixture{
+		"docker run -d ": {Output: CreatedContainerID + "\n"},
+	}
+}
@@ -0,0 +1,433 @@
+// Package sshtest provides an in-process ssh server emulating a docker host,
+// it answers the commands run by the api from recorded fixtures so the whole
+// stack can be exercised without docker hosts.
+package sshtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Config holds the credentials accepted by the server and the fixtures it
+// answers with
+type Config struct {
+	User     string
+	Password string
+	// AuthorizedKeys are accepted for public key auth
+	AuthorizedKeys []ssh.PublicKey
+	// Fixtures are looked up by the exact command, DefaultFixtures is used
+	// when nil
+	Fixtures map[string]Fixture
+	// PrefixFixtures answer the commands starting with the key when there is
+	// no exact match, DefaultPrefixFixtures is used when nil
+	PrefixFixtures map[string]Fixture
+	// SudoPassword is expected on stdin by commands run with sudo -S, from
+	// the askpass helper by sudo -A and in the terminal by plain sudo. sudo
+	// does not ask for a password when empty.
+	SudoPassword string
+}
+
+// Server is a running fake ssh server
+type Server struct {
+	// HostKey is the key presented by the server
+	HostKey  ssh.PublicKey
+	config   *ssh.ServerConfig
+	listener net.Listener
+	lock     sync.Mutex
+	fixtures map[string]Fixture
+	prefixes map[string]Fixture
+	sudo     string
+	commands []string
+	resizes  [][2]uint32
+	signals  []string
+	// askpass holds the scripts of the askpass helpers by path
+	askpass map[string]string
+	helpers int
+	conns   map[net.Conn]struct{}
+	wg      sync.WaitGroup
+}
+
+// NewServer starts a server listening on a random local port
+func NewServer(c Config) (*Server, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{HostKey: signer.PublicKey(), fixtures: c.Fixtures, prefixes: c.PrefixFixtures, sudo: c.SudoPassword, askpass: map[string]string{}, conns: map[net.Conn]struct{}{}}
+	if s.fixtures == nil {
+		s.fixtures = DefaultFixtures()
+	}
+	if s.prefixes == nil {
+		s.prefixes = DefaultPrefixFixtures()
+	}
+	s.config = &ssh.ServerConfig{}
+	if c.Password != "" {
+		s.config.PasswordCallback = func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == c.User && string(password) == c.Password {
+				return nil, nil
+			}
+			return nil, errors.New("invalid password")
+		}
+	}
+	if len(c.AuthorizedKeys) > 0 {
+		s.config.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() != c.User {
+				return nil, errors.New("unknown user")
+			}
+			for _, k := range c.AuthorizedKeys {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("key not authorized")
+		}
+	}
+	s.config.AddHostKey(signer)
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the host:port the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Host returns the address the server listens on without the port
+func (s *Server) Host() string {
+	host, _, _ := net.SplitHostPort(s.Addr())
+	return host
+}
+
+// Port returns the port the server listens on
+func (s *Server) Port() int {
+	_, port, _ := net.SplitHostPort(s.Addr())
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// Handle sets the fixture answering the command
+func (s *Server) Handle(cmd string, f Fixture) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fixtures[cmd] = f
+}
+
+// Commands returns every command run so far in order
+func (s *Server) Commands() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+// Resizes returns the terminal sizes requested so far as columns and rows
+func (s *Server) Resizes() [][2]uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([][2]uint32{}, s.resizes...)
+}
+
+// Signals returns the signals sent to commands so far in order, without the
+// SIG prefix
+func (s *Server) Signals() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.signals...)
+}
+
+// Close stops the server and drops every connection
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.lock.Lock()
+		s.conns[conn] = struct{}{}
+		s.lock.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+			s.lock.Lock()
+			delete(s.conns, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			// there is no docker socket to forward to, clients fall back to
+			// the cli
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go s.handleSession(channel, requests)
+	}
+}
+
+func (s *Server) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	// killed is closed once the client kills the command or goes away
+	killed := make(chan struct{})
+	var kill sync.Once
+	defer kill.Do(func() { close(killed) })
+	started := false
+	for req := range requests {
+		switch req.Type {
+		case "pty-req", "env":
+			req.Reply(true, nil)
+		case "window-change":
+			var size struct {
+				Cols, Rows, Width, Height uint32
+			}
+			if ssh.Unmarshal(req.Payload, &size) == nil {
+				s.lock.Lock()
+				s.resizes = append(s.resizes, [2]uint32{size.Cols, size.Rows})
+				s.lock.Unlock()
+			}
+		case "shell":
+			if started {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go s.run(channel, Fixture{Interactive: true}, killed)
+		case "exec":
+			var payload struct{ Command string }
+			if started || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go s.exec(channel, payload.Command, killed)
+		case "signal":
+			var signal struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &signal)
+			s.lock.Lock()
+			s.signals = append(s.signals, signal.Signal)
+			s.lock.Unlock()
+			kill.Do(func() { close(killed) })
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// lookup returns the fixture of the command, unknown commands fail like
+// they would in a shell
+func (s *Server) lookup(cmd string) Fixture {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if f, ok := s.fixtures[cmd]; ok {
+		return f
+	}
+	for prefix, f := range s.prefixes {
+		if strings.HasPrefix(cmd, prefix) {
+			return f
+		}
+	}
+	return Fixture{Output: fmt.Sprintf("sh: 1: %s: not found\n", strings.Fields(cmd + " ")[0]), ExitStatus: 127}
+}
+
+const sudoPrefix = "sudo -S -p '' "
+
+// askpassCommand is run by the api to create the askpass helper of a
+// terminal session, the script is its stdin
+const askpassCommand = `umask 077 && f=$(mktemp) && cat > "$f" && chmod 700 "$f" && echo "$f"`
+
+// exec answers the command, commands run through sudo are answered like the
+// command without sudo once the password was checked
+func (s *Server) exec(channel ssh.Channel, cmd string, killed <-chan struct{}) {
+	s.lock.Lock()
+	s.commands = append(s.commands, cmd)
+	s.lock.Unlock()
+	denied := Fixture{Output: "Sorry, try again.\nsudo: no password was provided\n", ExitStatus: 1}
+	switch {
+	case cmd == askpassCommand:
+		script, _ := io.ReadAll(channel)
+		s.lock.Lock()
+		s.helpers++
+		path := fmt.Sprintf("/tmp/tmp.askpass%d", s.helpers)
+		s.askpass[path] = string(script)
+		s.lock.Unlock()
+		s.run(channel, Fixture{Output: path + "\n"}, killed)
+		return
+	case strings.HasPrefix(cmd, "rm -f '"):
+		s.lock.Lock()
+		delete(s.askpass, strings.Trim(strings.TrimPrefix(cmd, "rm -f "), "'"))
+		s.lock.Unlock()
+		s.run(channel, Fixture{}, killed)
+		return
+	case strings.HasPrefix(cmd, sudoPrefix):
+		if s.sudo != "" && readLine(channel) != s.sudo {
+			s.run(channel, denied, killed)
+			return
+		}
+		cmd = strings.TrimPrefix(cmd, sudoPrefix)
+	case strings.HasPrefix(cmd, "SUDO_ASKPASS="):
+		path, rest, _ := strings.Cut(strings.TrimPrefix(cmd, "SUDO_ASKPASS="), " sudo -A ")
+		path = strings.Trim(path, "'")
+		if s.sudo != "" {
+			// the helper removes itself once sudo ran it
+			s.lock.Lock()
+			script, ok := s.askpass[path]
+			delete(s.askpass, path)
+			s.lock.Unlock()
+			if !ok || !strings.Contains(script, "'"+s.sudo+"'") {
+				s.run(channel, denied, killed)
+				return
+			}
+		}
+		cmd = rest
+	case strings.HasPrefix(cmd, "sudo "):
+		if s.sudo != "" {
+			channel.Write([]byte("[sudo] password: "))
+			if readLine(channel) != s.sudo {
+				s.run(channel, denied, killed)
+				return
+			}
+			channel.Write([]byte("\r\n"))
+		}
+		cmd = strings.TrimPrefix(cmd, "sudo ")
+	}
+	s.run(channel, s.lookup(cmd), killed)
+}
+
+// AskpassHelpers returns the paths of the askpass helpers which were not
+// removed
+func (s *Server) AskpassHelpers() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	paths := []string{}
+	for path := range s.askpass {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// readLine reads a line from the channel one byte at a time so that nothing
+// after it is consumed
+func readLine(channel ssh.Channel) string {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		if _, err := channel.Read(b); err != nil || b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r")
+		}
+		line = append(line, b[0])
+	}
+}
+
+func (s *Server) run(channel ssh.Channel, f Fixture, killed <-chan struct{}) {
+	status := f.ExitStatus
+	if f.Delay > 0 {
+		timer := time.NewTimer(f.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-killed:
+			// killed commands exit without their output like with SIGKILL
+			channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Message    string
+				Lang       string
+			}{Signal: "KILL"}))
+			channel.Close()
+			return
+		}
+	}
+	switch {
+	case f.Interactive:
+		status = echoShell(channel)
+	default:
+		channel.Write([]byte(f.Output))
+		if f.Follow {
+			// wait for the client to go away
+			buf := make([]byte, 256)
+			for {
+				if _, err := channel.Read(buf); err != nil {
+					break
+				}
+			}
+		}
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+	channel.Close()
+}
+
+// echoShell echoes the input back like a pty would, the line exit ends it
+func echoShell(channel ssh.Channel) uint32 {
+	channel.Write([]byte("$ "))
+	line := []byte{}
+	buf := make([]byte, 256)
+	for {
+		n, err := channel.Read(buf)
+		if err != nil {
+			return 0
+		}
+		for _, b := range buf[:n] {
+			if b != '\r' && b != '\n' {
+				line = append(line, b)
+				channel.Write([]byte{b})
+				continue
+			}
+			channel.Write([]byte("\r\n"))
+			if string(line) == "exit" {
+				return 0
+			}
+			if len(line) > 0 {
+				channel.Write(append(line, '\r', '\n'))
+			}
+			channel.Write([]byte("$ "))
+			line = line[:0]
+		}
+	}
+}